@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DAILY_CACHE_ENV_VAR = "APOD_DAILY_CACHE"
+	PREFETCH_ENV_VAR    = "PREFETCH_TODAY"
+)
+
+// dailyCache holds images fetched by date, until the day they were fetched on rolls over in APOD_TIMEZONE
+type dailyCache struct {
+	sync.Mutex
+	zone  *time.Location
+	day   string
+	store map[string]Image
+}
+
+// newDailyCache instantiates dailyCache if APOD_DAILY_CACHE is enabled, and returns a pointer to it
+// it returns nil when caching is disabled, which is the default
+func newDailyCache(zone *time.Location) *dailyCache {
+	enabled := os.Getenv(DAILY_CACHE_ENV_VAR)
+	if enabled == "" {
+		return nil
+	}
+	on, err := strconv.ParseBool(enabled)
+	if err != nil {
+		panic(fmt.Sprintf("environment variable %s must be a boolean, got '%s'", DAILY_CACHE_ENV_VAR, enabled))
+	}
+	if !on {
+		return nil
+	}
+	return &dailyCache{zone: zone, store: map[string]Image{}}
+}
+
+// rollover empties the cache if the day changed since it was filled, the caller must hold the lock
+func (c *dailyCache) rollover() {
+	today := apodDate(time.Now(), c.zone)
+	if c.day != today {
+		c.day = today
+		c.store = map[string]Image{}
+	}
+}
+
+// get returns the image cached for date, if any
+func (c *dailyCache) get(date string) (Image, bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.rollover()
+	image, ok := c.store[date]
+	return image, ok
+}
+
+// put caches the image fetched for date
+func (c *dailyCache) put(date string, image Image) {
+	c.Lock()
+	defer c.Unlock()
+	c.rollover()
+	c.store[date] = image
+}
+
+// evict drops every cached date whose image has the given url
+func (c *dailyCache) evict(url imageURL) {
+	c.Lock()
+	defer c.Unlock()
+	for date, image := range c.store {
+		if imageURL(image.Url) == url {
+			delete(c.store, date)
+		}
+	}
+}
+
+// prefetchEnabled reports whether today's image is fetched on startup, read from PREFETCH_TODAY, false by default
+func prefetchEnabled() bool {
+	enabled := os.Getenv(PREFETCH_ENV_VAR)
+	if enabled == "" {
+		return false
+	}
+	on, err := strconv.ParseBool(enabled)
+	if err != nil {
+		panic(fmt.Sprintf("environment variable %s must be a boolean, got '%s'", PREFETCH_ENV_VAR, enabled))
+	}
+	return on
+}
+
+// prefetchToday fetches and stores today's image in APOD_TIMEZONE in the background, caching it if APOD_DAILY_CACHE is enabled
+// so the first request for it doesn't wait on NASA, the outcome is only logged, and the fetch is bounded by NASA_DEADLINE_SECONDS
+func (i *imageStore) prefetchToday() {
+	if i.keys == nil {
+		slog.Warn("NASA API key not configured, skipping the prefetch of today's image")
+		return
+	}
+	go func() {
+		date := i.today()
+		ctx, cancel := context.WithTimeout(context.Background(), i.deadline)
+		defer cancel()
+		image, err := i.imageByDate(ctx, date, false)
+		if err != nil {
+			slog.Error("prefetching today's image", "date", date, "error", err)
+			return
+		}
+		slog.Info("prefetched today's image", "date", date, "url", image.Url)
+	}()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDailyCache(t *testing.T) {
+	s := newTestServer(t, DAILY_CACHE_ENV_VAR+"=true", MODE_ENV_VAR+"="+MODE_TODAY)
+	for _, date := range []string{"2024-01-01", "2024-01-01", "2024-01-02"} {
+		if image := s.fetchImage(t, date); image.Date != date {
+			t.Errorf("got image of %s, want %s", image.Date, date)
+		}
+	}
+	if calls := s.nasa.calls.Load(); calls != 2 {
+		t.Errorf("got %d upstream calls for 2 dates, want 2", calls)
+	}
+
+	// today's image is cached like any other date
+	s.nasa.calls.Store(0)
+	expectStatus(t, s.get(t, "/image"), http.StatusOK)
+	expectStatus(t, s.get(t, "/image"), http.StatusOK)
+	if calls := s.nasa.calls.Load(); calls != 1 {
+		t.Errorf("got %d upstream calls for today twice, want 1", calls)
+	}
+
+	// random images are never cached
+	s.nasa.calls.Store(0)
+	expectStatus(t, s.get(t, "/image?"+COUNT_PARAM+"=1"), http.StatusOK)
+	expectStatus(t, s.get(t, "/image?"+COUNT_PARAM+"=1"), http.StatusOK)
+	if calls := s.nasa.calls.Load(); calls != 2 {
+		t.Errorf("got %d upstream calls for 2 random images, want 2", calls)
+	}
+}
+
+func TestDailyCacheDisabled(t *testing.T) {
+	s := newTestServer(t)
+	s.fetchImage(t, "2024-01-01")
+	s.fetchImage(t, "2024-01-01")
+	if calls := s.nasa.calls.Load(); calls != 2 {
+		t.Errorf("got %d upstream calls without the cache, want 2", calls)
+	}
+
+	t.Setenv(DAILY_CACHE_ENV_VAR, "sometimes")
+	expectPanic(t, DAILY_CACHE_ENV_VAR+"=sometimes", func() { newDailyCache(nil) })
+}
+
+// waitForLog waits up to 5 seconds for a record with msg to be logged, failing the test if none is
+func waitForLog(t *testing.T, logs *logRecords, msg string) map[string]interface{} {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if records := logs.withMessage(t, msg); len(records) > 0 {
+			return records[0]
+		}
+	}
+	t.Fatalf("nothing logged with message %q", msg)
+	return nil
+}
+
+func TestPrefetchToday(t *testing.T) {
+	s := newTestServer(t, ATTEMPTS_ENV_VAR+"=1", PREFETCH_ENV_VAR+"=true", DAILY_CACHE_ENV_VAR+"=true", MODE_ENV_VAR+"="+MODE_TODAY, TIMEZONE_ENV_VAR+"=Pacific/Kiritimati")
+	logs := captureLogs(t)
+	if !prefetchEnabled() {
+		t.Fatalf("prefetch disabled with %s=true", PREFETCH_ENV_VAR)
+	}
+	start := time.Now()
+	s.images.prefetchToday()
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("prefetch blocked startup for %v, want it in the background", elapsed)
+	}
+
+	today := apodDate(time.Now(), s.images.zone)
+	record := waitForLog(t, logs, "prefetched today's image")
+	if record["date"] != today {
+		t.Errorf("got %v prefetched, want today in Kiritimati, %s", record["date"], today)
+	}
+	if _, err := s.storage.GetImage(imageURL(stubImage(today).Url)); err != nil {
+		t.Errorf("today's image wasn't stored: %v", err)
+	}
+	calls := s.nasa.calls.Load()
+	if image := s.fetchImage(t, today); image.Date != today {
+		t.Errorf("got image of %s, want today's", image.Date)
+	}
+	expectStatus(t, s.get(t, "/image"), http.StatusOK)
+	if after := s.nasa.calls.Load(); after != calls {
+		t.Errorf("got %d more upstream calls for today's image, want it served from the cache", after-calls)
+	}
+
+	// a failed prefetch is only logged
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	s.images.cache = newDailyCache(s.images.zone)
+	s.images.prefetchToday()
+	if record := waitForLog(t, logs, "prefetching today's image"); record[slog.LevelKey] != "ERROR" {
+		t.Errorf("got record %v, want the failure logged as an error", record)
+	}
+
+	t.Setenv(PREFETCH_ENV_VAR, "")
+	if prefetchEnabled() {
+		t.Errorf("prefetch enabled without %s, want it off by default", PREFETCH_ENV_VAR)
+	}
+	t.Setenv(PREFETCH_ENV_VAR, "soon")
+	expectPanic(t, PREFETCH_ENV_VAR+"=soon", func() { prefetchEnabled() })
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	IMPORT_MODE_PARAM = "mode"
+	IMPORT_MERGE      = "merge"
+	IMPORT_REPLACE    = "replace"
+	IMPORT_ENV_VAR    = "MAX_IMPORT_BYTES"
+	DEFAULT_IMPORT    = 64 << 20
+)
+
+// maxImportBytes returns the largest document /import accepts, read from MAX_IMPORT_BYTES
+// it is separate from MAX_BODY_BYTES, since an export of a full store is far larger than any other request
+func maxImportBytes() int64 {
+	return bytesEnv(IMPORT_ENV_VAR, DEFAULT_IMPORT)
+}
+
+// exportHandler returns a handler for /export, dumping every stored image and user with their ratings as a Snapshot
+// the document has the same shape as the DATA_DIR files, so it can be used to back up or move the data to another server
+func exportHandler(storage Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != GET {
+			methodNotAllowed(w, GET)
+			return
+		}
+		snapshot, err := storage.Snapshot()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "exporting data", "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to export data")
+			return
+		}
+		w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(snapshot)
+	}
+}
+
+// ImportResult counts what POST /import loaded
+type ImportResult struct {
+	Users   int `json:"users"`
+	Images  int `json:"images"`
+	Ratings int `json:"ratings"`
+}
+
+// validateSnapshot checks every image, user and rating of a snapshot sent to /import, normalizing their keys
+// the images are keyed by their own url, whatever key they were sent under, and missing timestamps count as now
+func validateSnapshot(snapshot Snapshot, scale ratingScale, today string) (Snapshot, error) {
+	valid := Snapshot{Images: map[imageURL]Image{}, Users: map[userEmail]map[imageURL]storedRating{}}
+	for key, image := range snapshot.Images {
+		if err := validateImage(&image, today); err != nil {
+			return Snapshot{}, fmt.Errorf("image %s: %w", key, err)
+		}
+		valid.Images[imageURL(image.Url)] = image
+	}
+	now := time.Now().UTC()
+	for email, userRatings := range snapshot.Users {
+		if !validEmail(string(email)) {
+			return Snapshot{}, fmt.Errorf("user %s: invalid email address", email)
+		}
+		normalized := normalizeEmail(string(email))
+		if valid.Users[normalized] == nil {
+			valid.Users[normalized] = map[imageURL]storedRating{}
+		}
+		for key, stored := range userRatings {
+			url, err := normalizeImageURL(string(key))
+			if err != nil {
+				return Snapshot{}, fmt.Errorf("rating of user %s: %w", email, err)
+			}
+			if !scale.contains(stored.Value) {
+				return Snapshot{}, fmt.Errorf("rating of image %s by user %s: must be an integer %d-%d, got %d", key, email, scale.min, scale.max, stored.Value)
+			}
+			if stored.CreatedAt.IsZero() {
+				stored.CreatedAt = now
+			}
+			if stored.UpdatedAt.IsZero() {
+				stored.UpdatedAt = stored.CreatedAt
+			}
+			valid.Users[normalized][url] = stored
+		}
+	}
+	return valid, nil
+}
+
+// importHandler returns a handler for /import, loading a Snapshot as produced by /export
+// 'mode=merge' (the default) adds it to what is stored, 'mode=replace' discards everything stored first
+// the whole document is validated before anything is loaded, it responds with how many users, images and ratings it held
+// ratings must be on scale, and image dates no later than today in zone
+func importHandler(storage Storage, scale ratingScale, zone *time.Location) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != POST {
+			methodNotAllowed(w, POST)
+			return
+		}
+		if !requireJSON(w, r) {
+			return
+		}
+		mode := r.URL.Query().Get(IMPORT_MODE_PARAM)
+		switch mode {
+		case "":
+			mode = IMPORT_MERGE
+		case IMPORT_MERGE, IMPORT_REPLACE:
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("query param '%s' must be '%s' or '%s', got '%s'", IMPORT_MODE_PARAM, IMPORT_MERGE, IMPORT_REPLACE, mode))
+			return
+		}
+
+		var snapshot Snapshot
+		if err := decodeBody(r, &snapshot); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		snapshot, err := validateSnapshot(snapshot, scale, apodDate(time.Now(), zone))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := storage.Restore(snapshot, mode == IMPORT_REPLACE); err != nil {
+			slog.ErrorContext(r.Context(), "importing data", "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to import data")
+			return
+		}
+
+		result := ImportResult{Users: len(snapshot.Users), Images: len(snapshot.Images)}
+		for _, userRatings := range snapshot.Users {
+			result.Ratings += len(userRatings)
+		}
+		slog.InfoContext(r.Context(), "data imported", "mode", mode, "users", result.Users, "images", result.Images, "ratings", result.Ratings)
+		w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// seed stores two fetched images and two users, one of them with ratings of both
+func (s *testServer) seed(t *testing.T) {
+	t.Helper()
+	s.fetchImage(t, "2024-01-01")
+	s.fetchImage(t, "2024-01-02")
+	s.createUser(t, "ada@example.com")
+	s.createUser(t, "grace@example.com")
+	s.saveRating(t, "ada@example.com", stubImage("2024-01-01").Url, 5)
+	s.saveRating(t, "ada@example.com", stubImage("2024-01-02").Url, 2)
+}
+
+// export returns everything stored in s, read back through GET /export
+func (s *testServer) export(t *testing.T) Snapshot {
+	t.Helper()
+	resp := s.get(t, "/export")
+	expectStatus(t, resp, http.StatusOK)
+	var snapshot Snapshot
+	resp.decode(t, &snapshot)
+	return snapshot
+}
+
+func TestExport(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, append(env, API_TOKEN_ENV_VAR+"=secret")...)
+		s.seed(t)
+
+		snapshot := s.export(t)
+		if len(snapshot.Images) != 2 || !reflect.DeepEqual(snapshot.Images[imageURL(stubImage("2024-01-01").Url)], stubImage("2024-01-01")) {
+			t.Errorf("got images %+v, want both fetched images keyed by url", snapshot.Images)
+		}
+		if len(snapshot.Users) != 2 || len(snapshot.Users["grace@example.com"]) != 0 {
+			t.Errorf("got users %+v, want ada and grace, grace without ratings", snapshot.Users)
+		}
+		ratings := snapshot.Users["ada@example.com"]
+		first := ratings[imageURL(stubImage("2024-01-01").Url)]
+		if len(ratings) != 2 || first.Value != 5 || ratings[imageURL(stubImage("2024-01-02").Url)].Value != 2 || first.CreatedAt.IsZero() {
+			t.Errorf("got ratings %+v, want both of ada's with their timestamps", ratings)
+		}
+	})
+}
+
+func TestExportNeedsToken(t *testing.T) {
+	s := newTestServer(t, API_TOKEN_ENV_VAR+"=secret")
+	s.token = ""
+	expectStatus(t, s.get(t, "/export"), http.StatusUnauthorized)
+	expectStatus(t, s.get(t, "/export", API_TOKEN_HEADER, "guess"), http.StatusForbidden)
+	expectStatus(t, s.get(t, "/export", API_TOKEN_HEADER, "secret"), http.StatusOK)
+
+	// everyone's data is never served without a token configured
+	s = newTestServer(t)
+	expectStatus(t, s.get(t, "/export"), http.StatusServiceUnavailable)
+}
+
+func TestImport(t *testing.T) {
+	source := newTestServer(t, API_TOKEN_ENV_VAR+"=secret")
+	source.seed(t)
+	exported := source.export(t)
+
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, append(env, API_TOKEN_ENV_VAR+"=secret")...)
+		s.createUser(t, "alan@example.com")
+
+		resp := s.request(t, POST, "/import", exported)
+		expectStatus(t, resp, http.StatusOK)
+		var result ImportResult
+		resp.decode(t, &result)
+		if result != (ImportResult{Users: 2, Images: 2, Ratings: 2}) {
+			t.Errorf("got %+v, want 2 users, 2 images and 2 ratings loaded", result)
+		}
+		merged := s.export(t)
+		if len(merged.Users) != 3 || merged.Users["alan@example.com"] == nil {
+			t.Errorf("got users %v merged, want alan kept alongside the imported ones", merged.Users)
+		}
+		delete(merged.Users, "alan@example.com")
+		expectSameSnapshot(t, merged, exported)
+		if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 2 || ratings[0].Rating != 5 {
+			t.Errorf("got ratings %+v, want ada's imported ratings", ratings)
+		}
+
+		resp = s.request(t, POST, "/import?"+IMPORT_MODE_PARAM+"="+IMPORT_REPLACE, exported)
+		expectStatus(t, resp, http.StatusOK)
+		expectSameSnapshot(t, s.export(t), exported)
+	})
+}
+
+// expectSameSnapshot fails the test unless got holds the images, users and ratings of want, timestamps to the instant
+func expectSameSnapshot(t *testing.T, got, want Snapshot) {
+	t.Helper()
+	if !reflect.DeepEqual(got.Images, want.Images) {
+		t.Errorf("got images %+v, want %+v", got.Images, want.Images)
+	}
+	if len(got.Users) != len(want.Users) {
+		t.Fatalf("got users %v, want %v", got.Users, want.Users)
+	}
+	for email, ratings := range want.Users {
+		if len(got.Users[email]) != len(ratings) {
+			t.Errorf("user %s: got ratings %+v, want %+v", email, got.Users[email], ratings)
+		}
+		for url, stored := range ratings {
+			loaded, ok := got.Users[email][url]
+			if !ok || loaded.Value != stored.Value || !loaded.CreatedAt.Equal(stored.CreatedAt) || !loaded.UpdatedAt.Equal(stored.UpdatedAt) {
+				t.Errorf("user %s, image %s: got rating %+v, want %+v", email, url, loaded, stored)
+			}
+		}
+	}
+}
+
+func TestImportNeedsToken(t *testing.T) {
+	source := newTestServer(t, API_TOKEN_ENV_VAR+"=secret")
+	source.seed(t)
+	exported := source.export(t)
+
+	s := newTestServer(t, API_TOKEN_ENV_VAR+"=secret")
+	s.token = ""
+	expectStatus(t, s.request(t, POST, "/import", exported), http.StatusUnauthorized)
+	expectStatus(t, s.request(t, POST, "/import", exported, API_TOKEN_HEADER, "guess"), http.StatusForbidden)
+	s.token = "secret"
+	if snapshot := s.export(t); len(snapshot.Users) != 0 || len(snapshot.Images) != 0 {
+		t.Errorf("got %+v after imports without the token, want nothing loaded", snapshot)
+	}
+
+	// nobody's data is overwritten without a token configured
+	s = newTestServer(t)
+	s.createUser(t, "alan@example.com")
+	expectStatus(t, s.request(t, POST, "/import?"+IMPORT_MODE_PARAM+"="+IMPORT_REPLACE, exported), http.StatusServiceUnavailable)
+	expectStatus(t, s.get(t, "/user?"+EMAIL_PARAM+"=alan@example.com"), http.StatusOK)
+	expectStatus(t, s.get(t, "/user?"+EMAIL_PARAM+"=ada@example.com"), http.StatusNotFound)
+	resp := s.get(t, "/images")
+	expectStatus(t, resp, http.StatusOK)
+	var images []Image
+	resp.decode(t, &images)
+	if len(images) != 0 {
+		t.Errorf("got images %+v after an import without a token configured, want none", images)
+	}
+}
+
+func TestImportRejected(t *testing.T) {
+	s := newTestServer(t, IMPORT_ENV_VAR+"=512", API_TOKEN_ENV_VAR+"=secret")
+	s.createUser(t, "ada@example.com")
+	before := s.ratingsOf(t, "ada@example.com")
+
+	invalid := Snapshot{Users: map[userEmail]map[imageURL]storedRating{
+		"ada@example.com":   {imageURL(stubImage("2024-01-01").Url): {Value: 4}},
+		"grace@example.com": {imageURL(stubImage("2024-01-02").Url): {Value: 9}},
+	}}
+	resp := s.request(t, POST, "/import", invalid)
+	expectStatus(t, resp, http.StatusBadRequest)
+	if after := s.ratingsOf(t, "ada@example.com"); len(after) != len(before) {
+		t.Errorf("got ratings %+v after a rejected import, want nothing of it loaded", after)
+	}
+	expectStatus(t, s.request(t, POST, "/import", `{"users": {"not an email": {}}}`), http.StatusBadRequest)
+	expectStatus(t, s.request(t, POST, "/import?"+IMPORT_MODE_PARAM+"=overwrite", Snapshot{}), http.StatusBadRequest)
+
+	// MAX_IMPORT_BYTES, not MAX_BODY_BYTES, caps the document
+	large := Snapshot{Users: map[userEmail]map[imageURL]storedRating{}}
+	for n := 0; n < 20; n++ {
+		large.Users[userEmail(fmt.Sprintf("user%d@example.com", n))] = nil
+	}
+	expectStatus(t, s.request(t, POST, "/import", large), http.StatusRequestEntityTooLarge)
+	t.Setenv(IMPORT_ENV_VAR, "big")
+	expectPanic(t, IMPORT_ENV_VAR+"=big", func() { maxImportBytes() })
+}
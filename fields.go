@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const FIELDS_PARAM = "fields"
+
+// imageFields are the JSON fields of an image response that the 'fields' query param can select
+var imageFields = []string{
+	"date", "explanation", "title", "url", "media_type", "thumbnail_url", "copyright", "hdurl", "concept_tags",
+	"isVideo", "year", "month", "day",
+}
+
+// parseFields reads the comma separated 'fields' query param, nil meaning every field is returned
+func parseFields(r *http.Request) ([]string, error) {
+	param := r.URL.Query().Get(FIELDS_PARAM)
+	if param == "" {
+		return nil, nil
+	}
+	var fields []string
+	for _, field := range strings.Split(param, ",") {
+		field = strings.TrimSpace(field)
+		if !slices.Contains(imageFields, field) {
+			return nil, fmt.Errorf("query param '%s' has unknown field '%s', must be among %s", FIELDS_PARAM, field, strings.Join(imageFields, ", "))
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// project returns only the given fields of image, which must encode to a JSON object
+func project(image interface{}, fields []string) map[string]json.RawMessage {
+	body, _ := json.Marshal(image)
+	var all map[string]json.RawMessage
+	json.Unmarshal(body, &all)
+	kept := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			kept[field] = value
+		}
+	}
+	return kept
+}
+
+// projectAll is project for a list of images
+func projectAll[T any](images []T, fields []string) []map[string]json.RawMessage {
+	kept := make([]map[string]json.RawMessage, 0, len(images))
+	for _, image := range images {
+		kept = append(kept, project(image, fields))
+	}
+	return kept
+}
+
+// projectImages narrows the images in v, as passed to writeImages, down to fields, unless fields is nil
+func projectImages(v interface{}, fields []string) interface{} {
+	if fields == nil {
+		return v
+	}
+	switch v := v.(type) {
+	case ImageResponse:
+		return project(v, fields)
+	case []ImageResponse:
+		return projectAll(v, fields)
+	case []Image:
+		return projectAll(v, fields)
+	case DatesResult:
+		return struct {
+			Images []map[string]json.RawMessage `json:"images"`
+			Errors []DateError                  `json:"errors,omitempty"`
+		}{projectAll(v.Images, fields), v.Errors}
+	}
+	return v
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFieldsProjection(t *testing.T) {
+	s := newTestServer(t)
+	image := stubImage("2023-07-04")
+	s.fetchImage(t, image.Date)
+	want := map[string]interface{}{"title": image.Title, "url": image.Url, "date": image.Date}
+
+	for _, query := range []string{
+		DATE_PARAM + "=" + image.Date,
+		URL_PARAM + "=" + url.QueryEscape(image.Url),
+	} {
+		resp := s.get(t, "/image?"+query+"&"+FIELDS_PARAM+"=title,url,date")
+		expectStatus(t, resp, http.StatusOK)
+		var got map[string]interface{}
+		resp.decode(t, &got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GET /image?%s: got %v, want %v", query, got, want)
+		}
+	}
+
+	// lists are projected image by image, computed fields included
+	resp := s.get(t, "/image?"+COUNT_PARAM+"=2&"+FIELDS_PARAM+"=year,%20isVideo")
+	expectStatus(t, resp, http.StatusOK)
+	var list []map[string]interface{}
+	resp.decode(t, &list)
+	if len(list) != 2 || !reflect.DeepEqual(list[0], map[string]interface{}{"year": 2020.0, "isVideo": false}) {
+		t.Errorf("got %v, want 2 images with only their year and isVideo", list)
+	}
+
+	calls := s.nasa.calls.Load()
+	resp = s.get(t, "/image?"+DATE_PARAM+"="+image.Date+"&"+FIELDS_PARAM+"=title,author")
+	expectStatus(t, resp, http.StatusBadRequest)
+	var body errorResponse
+	resp.decode(t, &body)
+	if !strings.Contains(body.Error.Message, "unknown field 'author'") {
+		t.Errorf("got message %q, want it to name the unknown field", body.Error.Message)
+	}
+	if s.nasa.calls.Load() != calls {
+		t.Errorf("a request with an unknown field was sent to NASA")
+	}
+}
@@ -1,3 +1,8 @@
 module github.com/ccamac01/nasa-apod-api-go
 
-go 1.13
+go 1.22
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.22
+	golang.org/x/sync v0.7.0
+)
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const TEST_API_KEY = "test-key"
+
+// TestMain keeps the server's logs out of the test output
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// stubNASA stands in for NASA's APOD API, counting the calls it gets and recording their queries
+// it answers like the real API by default, see apodImages, until a test swaps in a handler of its own
+type stubNASA struct {
+	*httptest.Server
+	calls atomic.Int64
+
+	handlerLock sync.Mutex
+	handler     http.HandlerFunc
+	queries     []url.Values
+}
+
+// newStubNASA starts a stubNASA, closed when the test ends
+func newStubNASA(t *testing.T) *stubNASA {
+	t.Helper()
+	nasa := &stubNASA{handler: apodImages}
+	nasa.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nasa.calls.Add(1)
+		nasa.handlerLock.Lock()
+		handler := nasa.handler
+		nasa.queries = append(nasa.queries, r.URL.Query())
+		nasa.handlerLock.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(nasa.Close)
+	return nasa
+}
+
+// handle answers every later call to NASA with handler
+func (nasa *stubNASA) handle(handler http.HandlerFunc) {
+	nasa.handlerLock.Lock()
+	defer nasa.handlerLock.Unlock()
+	nasa.handler = handler
+}
+
+// lastQuery returns the query of the latest call to NASA, nil if there was none
+func (nasa *stubNASA) lastQuery() url.Values {
+	nasa.handlerLock.Lock()
+	defer nasa.handlerLock.Unlock()
+	if len(nasa.queries) == 0 {
+		return nil
+	}
+	return nasa.queries[len(nasa.queries)-1]
+}
+
+// stubImage is the image stubNASA returns for date
+func stubImage(date string) Image {
+	return Image{
+		Date:        date,
+		Explanation: "The sky on " + date,
+		Title:       "Image of " + date,
+		Url:         "https://apod.nasa.gov/apod/image/" + date + ".jpg",
+		MediaType:   "image",
+		HDUrl:       "https://apod.nasa.gov/apod/image/hd/" + date + ".jpg",
+	}
+}
+
+// apodImages answers like NASA's APOD API: a single image for 'date' (or today, without params),
+// an array for 'count' (dated back from 2020-01-31) or for every day from 'start_date' to 'end_date'
+func apodImages(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var body interface{}
+	switch {
+	case query.Get(DATE_PARAM) != "":
+		body = stubImage(query.Get(DATE_PARAM))
+	case query.Get(COUNT_PARAM) != "":
+		n, _ := strconv.Atoi(query.Get(COUNT_PARAM))
+		images := []Image{}
+		first, _ := time.Parse(DATE_LAYOUT, "2020-01-31")
+		for day := 0; day < n; day++ {
+			images = append(images, stubImage(first.AddDate(0, 0, -day).Format(DATE_LAYOUT)))
+		}
+		body = images
+	case query.Get(START_DATE_PARAM) != "":
+		images := []Image{}
+		start, _ := time.Parse(DATE_LAYOUT, query.Get(START_DATE_PARAM))
+		end, _ := time.Parse(DATE_LAYOUT, query.Get(END_DATE_PARAM))
+		for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+			images = append(images, stubImage(day.Format(DATE_LAYOUT)))
+		}
+		body = images
+	default:
+		body = stubImage(time.Now().Format(DATE_LAYOUT))
+	}
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.Header().Set(RATELIMIT_HEADER, "999")
+	json.NewEncoder(w).Encode(body)
+}
+
+// testServer is the whole server, routes and middleware included, in front of a stubNASA
+type testServer struct {
+	*httptest.Server
+	nasa    *stubNASA
+	images  *imageStore
+	users   *users
+	storage Storage
+	token   string
+}
+
+// newTestServer starts a testServer, stopped when the test ends, configured by env, "NAME=value" pairs
+// by default it uses in-memory storage without DATA_DIR, a single API key, no rate limit and no API token
+func newTestServer(t *testing.T, env ...string) *testServer {
+	t.Helper()
+	nasa := newStubNASA(t)
+	defaults := []string{
+		API_KEY_ENV_VAR + "=" + TEST_API_KEY,
+		API_KEYS_ENV_VAR + "=",
+		BASE_URL_ENV_VAR + "=" + nasa.URL + "/planetary/apod",
+		STORAGE_ENV_VAR + "=",
+		DATA_DIR_ENV_VAR + "=",
+		RATE_LIMIT_ENV_VAR + "=0",
+		API_TOKEN_ENV_VAR + "=",
+		WEBHOOK_ENV_VAR + "=",
+	}
+	for _, pair := range append(defaults, env...) {
+		name, value, _ := strings.Cut(pair, "=")
+		t.Setenv(name, value)
+	}
+
+	storage, err := newStorage()
+	if err != nil {
+		t.Fatalf("creating storage: %v", err)
+	}
+	s := &testServer{nasa: nasa, storage: storage, token: os.Getenv(API_TOKEN_ENV_VAR)}
+	s.images = newImageStore(storage)
+	s.users = newUsers(storage)
+	s.Server = httptest.NewServer(newRouter(s.images, s.users))
+	t.Cleanup(func() {
+		s.Close()
+		s.images.webhook.wait()
+		if err := storage.Close(); err != nil {
+			t.Errorf("closing storage: %v", err)
+		}
+	})
+	return s
+}
+
+// forEachBackend runs test as a subtest against each storage backend, passing the env selecting it to newTestServer
+func forEachBackend(t *testing.T, test func(t *testing.T, env []string)) {
+	t.Run(MEMORY_BACKEND, func(t *testing.T) {
+		test(t, []string{STORAGE_ENV_VAR + "=" + MEMORY_BACKEND})
+	})
+	t.Run(SQLITE_BACKEND, func(t *testing.T) {
+		test(t, []string{STORAGE_ENV_VAR + "=" + SQLITE_BACKEND, SQLITE_PATH_ENV_VAR + "=" + filepath.Join(t.TempDir(), SQLITE_FILE)})
+	})
+}
+
+// logRecords collects what the server logs during a test
+type logRecords struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (logs *logRecords) Write(p []byte) (int, error) {
+	logs.Lock()
+	defer logs.Unlock()
+	return logs.buf.Write(p)
+}
+
+// withMessage returns the records logged so far with msg, decoded from JSON
+func (logs *logRecords) withMessage(t *testing.T, msg string) []map[string]interface{} {
+	t.Helper()
+	logs.Lock()
+	defer logs.Unlock()
+	var records []map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(logs.buf.Bytes()), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("decoding log record %q: %v", line, err)
+		}
+		if record[slog.MessageKey] == msg {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// captureLogs logs as setupLogging does, at debug level, into the returned logRecords until the test ends
+func captureLogs(t *testing.T) *logRecords {
+	logs := &logRecords{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+// expectPanic fails the test unless f panics, as the env readers do on a setting they can't parse
+func expectPanic(t *testing.T, what string, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s was accepted, want a panic", what)
+		}
+	}()
+	f()
+}
+
+// testResponse is a response with its body already read
+type testResponse struct {
+	*http.Response
+	body []byte
+}
+
+// decode unmarshals the JSON body of resp into v, failing the test if it can't
+func (resp *testResponse) decode(t *testing.T, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(resp.body, v); err != nil {
+		t.Fatalf("decoding response body %q: %v", resp.body, err)
+	}
+}
+
+// errorCode returns the code of the JSON error resp carries
+func (resp *testResponse) errorCode(t *testing.T) string {
+	t.Helper()
+	var body errorResponse
+	resp.decode(t, &body)
+	return body.Error.Code
+}
+
+// expectStatus fails the test unless resp has status want
+func expectStatus(t *testing.T, resp *testResponse, want int) {
+	t.Helper()
+	if resp.StatusCode != want {
+		t.Fatalf("%s %s: got status %d, want %d, body %q", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, want, resp.body)
+	}
+}
+
+// request sends method path to s, with body marshaled as JSON unless nil or already a string, and headers as name, value pairs
+// a JSON body is sent with a JSON content-type, unless headers set one, and the API token is sent whenever s has one
+func (s *testServer) request(t *testing.T, method, path string, body interface{}, headers ...string) *testResponse {
+	t.Helper()
+	var reader io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(body)
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("encoding request body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set(CONTENT_TYPE, APPLICATION_JSON)
+	}
+	if s.token != "" {
+		req.Header.Set(API_TOKEN_HEADER, s.token)
+	}
+	for n := 0; n+1 < len(headers); n += 2 {
+		req.Header.Set(headers[n], headers[n+1])
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading body: %v", method, path, err)
+	}
+	return &testResponse{Response: resp, body: data}
+}
+
+// get sends a GET for path to s
+func (s *testServer) get(t *testing.T, path string, headers ...string) *testResponse {
+	t.Helper()
+	return s.request(t, GET, path, nil, headers...)
+}
+
+// createUser creates the user with email, failing the test unless it is created
+func (s *testServer) createUser(t *testing.T, email string) {
+	t.Helper()
+	expectStatus(t, s.request(t, POST, "/user", User{Email: email}), http.StatusCreated)
+}
+
+// saveRating saves the rating of imageURL by the user with email, failing the test unless it is created
+func (s *testServer) saveRating(t *testing.T, email, imageURL string, value int) User {
+	t.Helper()
+	resp := s.request(t, POST, "/rating", User{Email: email, ImageURL: imageURL, Rating: value})
+	expectStatus(t, resp, http.StatusCreated)
+	var saved User
+	resp.decode(t, &saved)
+	return saved
+}
+
+// fetchImage fetches the image of date through /image, failing the test unless it is returned
+func (s *testServer) fetchImage(t *testing.T, date string) ImageResponse {
+	t.Helper()
+	resp := s.get(t, "/image?"+DATE_PARAM+"="+date)
+	expectStatus(t, resp, http.StatusOK)
+	var image ImageResponse
+	resp.decode(t, &image)
+	return image
+}
+
+// ratingsOf returns the ratings of the user with email, read back through GET /rating
+func (s *testServer) ratingsOf(t *testing.T, email string) []RatingEntry {
+	t.Helper()
+	resp := s.get(t, "/rating?"+EMAIL_PARAM+"="+email)
+	expectStatus(t, resp, http.StatusOK)
+	var ratings []RatingEntry
+	resp.decode(t, &ratings)
+	return ratings
+}
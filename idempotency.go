@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	IDEMPOTENCY_HEADER  = "Idempotency-Key"
+	IDEMPOTENCY_ENV_VAR = "IDEMPOTENCY_TTL_SECONDS"
+	DEFAULT_IDEMPOTENCY = time.Hour
+	MAX_IDEMPOTENCY     = 10000
+)
+
+// idempotentResponse is the response to the first request sent with an Idempotency-Key, replayed to its retries
+// done is false while that request is still being handled
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyKeys remembers the responses to requests sent with an Idempotency-Key for ttl
+type idempotencyKeys struct {
+	sync.Mutex
+	ttl       time.Duration
+	responses map[string]*idempotentResponse
+}
+
+// newIdempotencyKeys instantiates idempotencyKeys, keeping responses for IDEMPOTENCY_TTL_SECONDS, and returns a pointer to it
+func newIdempotencyKeys() *idempotencyKeys {
+	return &idempotencyKeys{
+		ttl:       secondsEnv(IDEMPOTENCY_ENV_VAR, DEFAULT_IDEMPOTENCY),
+		responses: map[string]*idempotentResponse{},
+	}
+}
+
+// begin returns the response already recorded for key, or else records that a request with key is under way and returns nil
+func (k *idempotencyKeys) begin(key string, fingerprint [sha256.Size]byte) *idempotentResponse {
+	k.Lock()
+	defer k.Unlock()
+	now := time.Now()
+	if resp, ok := k.responses[key]; ok && now.Before(resp.expires) {
+		return resp
+	}
+	if len(k.responses) >= MAX_IDEMPOTENCY {
+		k.prune(now)
+	}
+	// a request is given the whole ttl to finish, in case it never does
+	k.responses[key] = &idempotentResponse{fingerprint: fingerprint, expires: now.Add(k.ttl)}
+	return nil
+}
+
+// finish records the response to the request with key, or forgets key if the request failed on the server's side
+// or never completed, so that a retry is handled afresh
+func (k *idempotencyKeys) finish(key string, rec *recordingWriter, completed bool) {
+	k.Lock()
+	defer k.Unlock()
+	resp := k.responses[key]
+	if resp == nil {
+		return
+	}
+	if !completed || rec.status >= http.StatusInternalServerError {
+		delete(k.responses, key)
+		return
+	}
+	resp.done = true
+	resp.status = rec.status
+	resp.contentType = rec.Header().Get(CONTENT_TYPE)
+	resp.body = rec.buf.Bytes()
+	resp.expires = time.Now().Add(k.ttl)
+}
+
+// prune drops the expired responses, the caller must hold the lock
+func (k *idempotencyKeys) prune(now time.Time) {
+	for key, resp := range k.responses {
+		if !now.Before(resp.expires) {
+			delete(k.responses, key)
+		}
+	}
+}
+
+// recordingWriter keeps a copy of the response it passes on
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (rec *recordingWriter) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recordingWriter) Write(b []byte) (int, error) {
+	rec.buf.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent replays the original response to a POST retried with the same Idempotency-Key header, instead of handling it again
+// so a client retrying after a network error doesn't get a 409 for the rating its first attempt created
+// the same key sent with a different request is rejected with a 422, and one sent while the first is still being handled with a 409
+// requests without the header, or other than POST, are handled as usual
+func idempotent(keys *idempotencyKeys, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IDEMPOTENCY_HEADER)
+		if r.Method != POST || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256.Sum256([]byte(r.URL.RequestURI() + "\n" + string(body)))
+
+		if resp := keys.begin(key, fingerprint); resp != nil {
+			switch {
+			case resp.fingerprint != fingerprint:
+				writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+			case !resp.done:
+				writeError(w, http.StatusConflict, "a request with this Idempotency-Key is still being handled, retry later")
+			default:
+				if resp.contentType != "" {
+					w.Header().Set(CONTENT_TYPE, resp.contentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(resp.status)
+				w.Write(resp.body)
+			}
+			return
+		}
+
+		rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() { keys.finish(key, rec, completed) }()
+		next.ServeHTTP(rec, r)
+		completed = true
+	})
+}
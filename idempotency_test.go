@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotentRating(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		s.createUser(t, "ada@example.com")
+		rating := User{Email: "ada@example.com", ImageURL: stubImage("2024-01-01").Url, Rating: 4}
+
+		first := s.request(t, POST, "/rating", rating, IDEMPOTENCY_HEADER, "retry-1")
+		expectStatus(t, first, http.StatusCreated)
+		retried := s.request(t, POST, "/rating", rating, IDEMPOTENCY_HEADER, "retry-1")
+		expectStatus(t, retried, http.StatusCreated)
+		if !bytes.Equal(retried.body, first.body) || retried.Header.Get(CONTENT_TYPE) != first.Header.Get(CONTENT_TYPE) {
+			t.Errorf("got %q replayed, want the original %q", retried.body, first.body)
+		}
+		if retried.Header.Get("Idempotent-Replayed") != "true" || first.Header.Get("Idempotent-Replayed") != "" {
+			t.Errorf("want only the replay marked Idempotent-Replayed")
+		}
+		if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 1 || ratings[0].Rating != 4 {
+			t.Errorf("got ratings %+v, want the single one created", ratings)
+		}
+
+		// without the key, or with a fresh one, the duplicate is reported as before
+		expectStatus(t, s.request(t, POST, "/rating", rating), http.StatusConflict)
+		expectStatus(t, s.request(t, POST, "/rating", rating, IDEMPOTENCY_HEADER, "retry-2"), http.StatusConflict)
+		// reusing a key for another request is a client bug
+		rating.Rating = 5
+		expectStatus(t, s.request(t, POST, "/rating", rating, IDEMPOTENCY_HEADER, "retry-1"), http.StatusUnprocessableEntity)
+	})
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	calls := 0
+	status := http.StatusCreated
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := idempotent(newIdempotencyKeys(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		writeError(w, status, "handled")
+	}))
+	send := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(POST, path, strings.NewReader(`{}`))
+		req.Header.Set(IDEMPOTENCY_HEADER, key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// a failure on the server's side is forgotten, so the retry is handled afresh
+	status = http.StatusServiceUnavailable
+	send("/rating", "k")
+	status = http.StatusCreated
+	if rec := send("/rating", "k"); rec.Code != http.StatusCreated || calls != 2 {
+		t.Errorf("got status %d after %d calls, want the retry of a 503 handled again", rec.Code, calls)
+	}
+	// a client error is a result like any other
+	status = http.StatusBadRequest
+	send("/rating", "bad")
+	if rec := send("/rating", "bad"); rec.Code != http.StatusBadRequest || calls != 3 {
+		t.Errorf("got status %d after %d calls, want the 400 replayed", rec.Code, calls)
+	}
+
+	// a retry arriving while the first request is still handled must wait for it
+	status = http.StatusCreated
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		send("/slow", "slow")
+	}()
+	<-started
+	if rec := send("/slow", "slow"); rec.Code != http.StatusConflict {
+		t.Errorf("got status %d for a retry while the first request is handled, want 409", rec.Code)
+	}
+	close(release)
+	<-done
+	if rec := send("/slow", "slow"); rec.Code != http.StatusCreated || rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("got status %d once the first request was done, want its 201 replayed", rec.Code)
+	}
+
+	// the responses expire after the ttl
+	keys := newIdempotencyKeys()
+	keys.ttl = time.Millisecond
+	keys.begin("old", [32]byte{})
+	time.Sleep(5 * time.Millisecond)
+	if resp := keys.begin("old", [32]byte{1}); resp != nil {
+		t.Errorf("got %+v for an expired key, want it forgotten", resp)
+	}
+
+	t.Setenv(IDEMPOTENCY_ENV_VAR, "forever")
+	expectPanic(t, IDEMPOTENCY_ENV_VAR+"=forever", func() { newIdempotencyKeys() })
+}
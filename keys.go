@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	API_KEYS_ENV_VAR = "NASA_API_KEYS"
+	KEY_COOLDOWN     = time.Hour
+)
+
+// KeyQuota is what NASA last reported of the hourly quota left on one of the API keys, as shown by /health/upstream
+type KeyQuota struct {
+	Key       string `json:"key"`
+	Remaining *int   `json:"remaining"`
+}
+
+// apiKeys rotates calls to NASA among several API keys, round-robin, so the quotas add up
+// a key NASA answered 429 for is skipped for KEY_COOLDOWN, NASA's quotas being hourly
+type apiKeys struct {
+	sync.Mutex
+	keys      []string
+	urls      []string
+	remaining []int // -1 until NASA reports it
+	cooldown  []time.Time
+	next      int
+}
+
+// configuredKeys returns the API keys read from NASA_API_KEYS, comma separated, or else the single NASA_API_KEY
+func configuredKeys() []string {
+	var keys []string
+	for _, key := range strings.Split(os.Getenv(API_KEYS_ENV_VAR), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		if key := os.Getenv(API_KEY_ENV_VAR); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// newAPIKeys instantiates apiKeys for calls to baseURL with keys, and returns a pointer to it
+// it returns nil if there are no keys
+func newAPIKeys(baseURL string, keys []string) *apiKeys {
+	if len(keys) == 0 {
+		return nil
+	}
+	k := &apiKeys{keys: keys, remaining: make([]int, len(keys)), cooldown: make([]time.Time, len(keys))}
+	for n, key := range keys {
+		k.urls = append(k.urls, upstreamURL(baseURL, key))
+		k.remaining[n] = -1
+	}
+	return k
+}
+
+// len returns how many keys there are
+func (k *apiKeys) len() int {
+	return len(k.keys)
+}
+
+// pick returns the index and upstream URL of the next key in turn, skipping those cooling down after a 429
+// if every key is cooling down, the next one in turn is returned anyway
+func (k *apiKeys) pick() (int, string) {
+	k.Lock()
+	defer k.Unlock()
+	now := time.Now()
+	n := k.next
+	for tried := 0; tried < len(k.keys); tried++ {
+		candidate := (k.next + tried) % len(k.keys)
+		if now.After(k.cooldown[candidate]) {
+			n = candidate
+			break
+		}
+	}
+	k.next = (n + 1) % len(k.keys)
+	return n, k.urls[n]
+}
+
+// observe records the quota NASA reported on resp for key n, a 429 putting the key to rest for KEY_COOLDOWN
+func (k *apiKeys) observe(n int, resp *http.Response) {
+	k.Lock()
+	defer k.Unlock()
+	if remaining, err := strconv.Atoi(resp.Header.Get(RATELIMIT_HEADER)); err == nil {
+		k.remaining[n] = remaining
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		k.remaining[n] = 0
+		k.cooldown[n] = time.Now().Add(KEY_COOLDOWN)
+	}
+}
+
+// quotas returns the last known quota of every key, which are masked down to their last 4 characters
+func (k *apiKeys) quotas() []KeyQuota {
+	k.Lock()
+	defer k.Unlock()
+	quotas := make([]KeyQuota, len(k.keys))
+	for n, key := range k.keys {
+		masked := "..."
+		if len(key) > 8 {
+			masked += key[len(key)-4:]
+		}
+		quotas[n].Key = masked
+		if k.remaining[n] >= 0 {
+			remaining := k.remaining[n]
+			quotas[n].Remaining = &remaining
+		}
+	}
+	return quotas
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const TEST_API_KEYS = "alpha-key-0001, bravo-key-0002,charlie-key-0003"
+
+// keysUsed returns the API key of every call NASA got so far, in order
+func (nasa *stubNASA) keysUsed() []string {
+	nasa.handlerLock.Lock()
+	defer nasa.handlerLock.Unlock()
+	var keys []string
+	for _, query := range nasa.queries {
+		keys = append(keys, query.Get(API_KEY_PARAM))
+	}
+	return keys
+}
+
+// quotaPerKey answers with the image for 'date', or today's, reporting a quota of its own for each key
+func quotaPerKey(w http.ResponseWriter, r *http.Request) {
+	quota := map[string]string{"alpha-key-0001": "100", "bravo-key-0002": "200", "charlie-key-0003": "300"}
+	date := r.URL.Query().Get(DATE_PARAM)
+	if date == "" {
+		date = time.Now().Format(DATE_LAYOUT)
+	}
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.Header().Set(RATELIMIT_HEADER, quota[r.URL.Query().Get(API_KEY_PARAM)])
+	json.NewEncoder(w).Encode(stubImage(date))
+}
+
+func TestKeyRotation(t *testing.T) {
+	s := newTestServer(t, API_KEYS_ENV_VAR+"="+TEST_API_KEYS)
+	s.nasa.handle(quotaPerKey)
+	for day := 1; day <= 4; day++ {
+		s.fetchImage(t, fmt.Sprintf("2024-01-0%d", day))
+	}
+	if got, want := s.nasa.keysUsed(), []string{"alpha-key-0001", "bravo-key-0002", "charlie-key-0003", "alpha-key-0001"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %v, want them in turn", got)
+	}
+
+	health := s.upstreamHealth(t, http.StatusOK)
+	remaining := map[string]int{}
+	for _, quota := range health.Keys {
+		if quota.Remaining == nil {
+			t.Fatalf("got quotas %+v, want every key's reported", health.Keys)
+		}
+		remaining[quota.Key] = *quota.Remaining
+	}
+	if want := map[string]int{"...0001": 100, "...0002": 200, "...0003": 300}; !reflect.DeepEqual(remaining, want) {
+		t.Errorf("got quotas %v, want each key's own, masked", remaining)
+	}
+
+	// the single NASA_API_KEY is the fallback
+	t.Setenv(API_KEYS_ENV_VAR, " , ")
+	if keys := configuredKeys(); !reflect.DeepEqual(keys, []string{TEST_API_KEY}) {
+		t.Errorf("got keys %v, want %s alone", keys, TEST_API_KEY)
+	}
+}
+
+func TestKeySwitchOnRateLimit(t *testing.T) {
+	s := newTestServer(t, API_KEYS_ENV_VAR+"=alpha-key-0001,bravo-key-0002", ATTEMPTS_ENV_VAR+"=1")
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get(API_KEY_PARAM) == "alpha-key-0001" {
+			w.Header().Set(RATELIMIT_HEADER, "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		apodImages(w, r)
+	})
+
+	// a 429 moves straight on to the next key, without backoff or using up the single attempt
+	start := time.Now()
+	s.fetchImage(t, "2024-01-01")
+	if elapsed := time.Since(start); elapsed >= BASE_BACKOFF {
+		t.Errorf("switching keys took %v, want no backoff", elapsed)
+	}
+	// and the exhausted key is left to rest
+	s.fetchImage(t, "2024-01-02")
+	if got, want := s.nasa.keysUsed(), []string{"alpha-key-0001", "bravo-key-0002", "bravo-key-0002"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %v, want alpha skipped after its 429", got)
+	}
+
+	// once every key is exhausted, NASA's 429 is passed on
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	expectStatus(t, s.get(t, "/image?"+DATE_PARAM+"=2024-01-03"), http.StatusTooManyRequests)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+const LOG_LEVEL_ENV_VAR = "LOG_LEVEL"
+
+// setupLogging installs a JSON slog logger as the default, at the level read from LOG_LEVEL (defaults to info)
+func setupLogging() {
+	var level slog.Level
+	if l := os.Getenv(LOG_LEVEL_ENV_VAR); l != "" {
+		if err := level.UnmarshalText([]byte(l)); err != nil {
+			panic(fmt.Sprintf("environment variable %s must be one of debug, info, warn or error, got '%s'", LOG_LEVEL_ENV_VAR, l))
+		}
+	}
+	handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(requestIDHandler{handler}))
+}
+
+// requestIDHandler adds the request ID, if any, to records logged with a request's context
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"testing"
+)
+
+func TestFailedFetchLogged(t *testing.T) {
+	s := newTestServer(t, ATTEMPTS_ENV_VAR+"=1")
+	s.images.client = &http.Client{Transport: failingTransport{}}
+	logs := captureLogs(t)
+
+	resp := s.get(t, "/image?"+DATE_PARAM+"=2024-01-01", REQUEST_ID_HEADER, "req-1")
+	expectStatus(t, resp, http.StatusBadGateway)
+	records := logs.withMessage(t, "fetching NASA image")
+	if len(records) != 1 {
+		t.Fatalf("got %d records of the failed fetch, want 1", len(records))
+	}
+	record := records[0]
+	if record[slog.LevelKey] != "ERROR" || record["request_id"] != "req-1" || record["error"] == nil {
+		t.Errorf("got record %v, want an error with the request id and the error", record)
+	}
+
+	s.createUser(t, "ada@example.com")
+	s.saveRating(t, "ada@example.com", stubImage("2024-01-01").Url, 4)
+	records = logs.withMessage(t, "rating saved")
+	if len(records) != 1 || records[0]["email"] != "ada@example.com" || records[0]["image_url"] != stubImage("2024-01-01").Url || records[0]["rating"] != 4.0 {
+		t.Errorf("got records %v, want the rating saved with its email, image url and value", records)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	previous := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	for level, enabled := range map[string]slog.Level{"": slog.LevelInfo, "debug": slog.LevelDebug, "WARN": slog.LevelWarn, "error": slog.LevelError} {
+		t.Setenv(LOG_LEVEL_ENV_VAR, level)
+		setupLogging()
+		ctx := context.Background()
+		if !slog.Default().Enabled(ctx, enabled) || slog.Default().Enabled(ctx, enabled-1) {
+			t.Errorf("%s=%q: want logging from %v up", LOG_LEVEL_ENV_VAR, level, enabled)
+		}
+	}
+	t.Setenv(LOG_LEVEL_ENV_VAR, "loud")
+	expectPanic(t, LOG_LEVEL_ENV_VAR+"=loud", setupLogging)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+const (
+	IMAGE_CACHE_SIZE_ENV_VAR = "IMAGE_CACHE_SIZE"
+	DEFAULT_IMAGE_CACHE_SIZE = 500
+)
+
+// imageCacheSize returns how many images the in-memory store keeps, read from IMAGE_CACHE_SIZE if set
+func imageCacheSize() int {
+	size := os.Getenv(IMAGE_CACHE_SIZE_ENV_VAR)
+	if size == "" {
+		return DEFAULT_IMAGE_CACHE_SIZE
+	}
+	n, err := strconv.Atoi(size)
+	if err != nil || n <= 0 {
+		panic(fmt.Sprintf("environment variable %s must be a positive integer, got '%s'", IMAGE_CACHE_SIZE_ENV_VAR, size))
+	}
+	return n
+}
+
+// imageLRU holds up to max images keyed by url, evicting the least recently used one when full
+// it is not safe for concurrent use
+type imageLRU struct {
+	max   int
+	order *list.List
+	items map[imageURL]*list.Element
+}
+
+// newImageLRU instantiates imageLRU and returns a pointer to it
+func newImageLRU(max int) *imageLRU {
+	return &imageLRU{
+		max:   max,
+		order: list.New(),
+		items: map[imageURL]*list.Element{},
+	}
+}
+
+// get returns the image stored under url and marks it as most recently used
+func (l *imageLRU) get(url imageURL) (Image, bool) {
+	elem, ok := l.items[url]
+	if !ok {
+		return Image{}, false
+	}
+	l.order.MoveToFront(elem)
+	return elem.Value.(Image), true
+}
+
+// has reports whether an image is stored under url, without marking it as used
+func (l *imageLRU) has(url imageURL) bool {
+	_, ok := l.items[url]
+	return ok
+}
+
+// put stores image as the most recently used, evicting the least recently used image if over capacity
+func (l *imageLRU) put(image Image) {
+	url := imageURL(image.Url)
+	if elem, ok := l.items[url]; ok {
+		elem.Value = image
+		l.order.MoveToFront(elem)
+		return
+	}
+	l.items[url] = l.order.PushFront(image)
+	if l.order.Len() > l.max {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, imageURL(oldest.Value.(Image).Url))
+	}
+}
+
+// remove deletes the image stored under url, reporting whether there was one
+func (l *imageLRU) remove(url imageURL) bool {
+	elem, ok := l.items[url]
+	if !ok {
+		return false
+	}
+	l.order.Remove(elem)
+	delete(l.items, url)
+	return true
+}
+
+// all returns every stored image, most recently used first, without changing their order
+func (l *imageLRU) all() []Image {
+	images := make([]Image, 0, l.order.Len())
+	for elem := l.order.Front(); elem != nil; elem = elem.Next() {
+		images = append(images, elem.Value.(Image))
+	}
+	return images
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestImageLRU(t *testing.T) {
+	lru := newImageLRU(2)
+	first, second, third := stubImage("2024-01-01"), stubImage("2024-01-02"), stubImage("2024-01-03")
+	lru.put(first)
+	lru.put(second)
+	if _, ok := lru.get(imageURL(first.Url)); !ok {
+		t.Fatalf("lost %s under capacity", first.Date)
+	}
+	lru.put(third)
+
+	if lru.has(imageURL(second.Url)) {
+		t.Errorf("kept %s, the least recently used, over capacity", second.Date)
+	}
+	if got := lru.all(); !reflect.DeepEqual(got, []Image{third, first}) {
+		t.Errorf("got %+v, want the most recently used first, %s then %s", got, third.Date, first.Date)
+	}
+
+	// storing an image again replaces it, without taking more room
+	first.Title = "Retitled"
+	lru.put(first)
+	if image, _ := lru.get(imageURL(first.Url)); image.Title != "Retitled" || len(lru.all()) != 2 {
+		t.Errorf("got %+v among %d images, want %s replaced in place", image, len(lru.all()), first.Date)
+	}
+	if !lru.remove(imageURL(first.Url)) || lru.remove(imageURL(first.Url)) || len(lru.all()) != 1 {
+		t.Errorf("want %s removed exactly once", first.Date)
+	}
+}
+
+func TestImageCacheSize(t *testing.T) {
+	s := newTestServer(t, IMAGE_CACHE_SIZE_ENV_VAR+"=2")
+	stored := func(date string) bool {
+		t.Helper()
+		return s.get(t, "/image?"+URL_PARAM+"="+url.QueryEscape(stubImage(date).Url)).StatusCode == http.StatusOK
+	}
+	s.fetchImage(t, "2024-01-01")
+	s.fetchImage(t, "2024-01-02")
+	if !stored("2024-01-01") {
+		t.Fatalf("lost 2024-01-01 under capacity")
+	}
+	s.fetchImage(t, "2024-01-03")
+
+	if stored("2024-01-02") {
+		t.Errorf("kept 2024-01-02, the least recently used, over capacity")
+	}
+	if !stored("2024-01-01") || !stored("2024-01-03") {
+		t.Errorf("evicted a recently used image")
+	}
+
+	t.Setenv(IMAGE_CACHE_SIZE_ENV_VAR, "0")
+	expectPanic(t, IMAGE_CACHE_SIZE_ENV_VAR+"=0", func() { imageCacheSize() })
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upper bounds, in seconds, of the latency histogram buckets, matching Prometheus' defaults
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observations into cumulative latency buckets
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{buckets: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for n, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[n]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// write prints the histogram in the Prometheus text format, labels being "" or a rendered label set
+func (h *histogram) write(b *strings.Builder, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for n, bound := range latencyBuckets {
+		fmt.Fprintf(b, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[n])
+	}
+	fmt.Fprintf(b, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(b, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(b, "%s_count%s %d\n", name, labels, h.count)
+}
+
+type requestKey struct {
+	path   string
+	method string
+	status int
+}
+
+// metrics holds the counters and histograms exposed at /metrics
+type metrics struct {
+	sync.Mutex
+	requests        map[requestKey]uint64
+	latencies       map[string]*histogram
+	upstreamLatency *histogram
+	upstreamErrors  uint64
+}
+
+// newMetrics instantiates metrics and returns a pointer to it
+func newMetrics() *metrics {
+	return &metrics{
+		requests:        map[requestKey]uint64{},
+		latencies:       map[string]*histogram{},
+		upstreamLatency: newHistogram(),
+	}
+}
+
+// appMetrics is shared by the request middleware and the upstream client
+var appMetrics = newMetrics()
+
+func (m *metrics) observeRequest(path, method string, status int, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.requests[requestKey{path, method, status}]++
+	if m.latencies[path] == nil {
+		m.latencies[path] = newHistogram()
+	}
+	m.latencies[path].observe(d)
+}
+
+// observeUpstream records a single call to NASA's APOD API, failed is true for network errors and non-200 responses
+func (m *metrics) observeUpstream(d time.Duration, failed bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.upstreamLatency.observe(d)
+	if failed {
+		m.upstreamErrors++
+	}
+}
+
+// handler serves the metrics in the Prometheus text exposition format
+func (m *metrics) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != GET {
+		methodNotAllowed(w, GET)
+		return
+	}
+
+	m.Lock()
+	var b strings.Builder
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, c int) bool {
+		if keys[a].path != keys[c].path {
+			return keys[a].path < keys[c].path
+		}
+		if keys[a].method != keys[c].method {
+			return keys[a].method < keys[c].method
+		}
+		return keys[a].status < keys[c].status
+	})
+	b.WriteString("# HELP apod_http_requests_total Requests served, by endpoint, method and status.\n")
+	b.WriteString("# TYPE apod_http_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "apod_http_requests_total{path=%q,method=%q,status=\"%d\"} %d\n", key.path, key.method, key.status, m.requests[key])
+	}
+
+	paths := make([]string, 0, len(m.latencies))
+	for path := range m.latencies {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	b.WriteString("# HELP apod_http_request_duration_seconds Latency of requests, by endpoint.\n")
+	b.WriteString("# TYPE apod_http_request_duration_seconds histogram\n")
+	for _, path := range paths {
+		m.latencies[path].write(&b, "apod_http_request_duration_seconds", fmt.Sprintf("path=%q", path))
+	}
+
+	b.WriteString("# HELP apod_upstream_fetch_duration_seconds Latency of calls to NASA's APOD API.\n")
+	b.WriteString("# TYPE apod_upstream_fetch_duration_seconds histogram\n")
+	m.upstreamLatency.write(&b, "apod_upstream_fetch_duration_seconds", "")
+	b.WriteString("# HELP apod_upstream_errors_total Calls to NASA's APOD API that failed or didn't respond 200.\n")
+	b.WriteString("# TYPE apod_upstream_errors_total counter\n")
+	fmt.Fprintf(&b, "apod_upstream_errors_total %d\n", m.upstreamErrors)
+	m.Unlock()
+
+	w.Header().Set(CONTENT_TYPE, "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(b.String()))
+}
+
+// instrument counts every request served by next, labelled by the mux pattern it matched to keep the endpoints bounded
+func instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		appMetrics.observeRequest(pattern, r.Method, rec.status, time.Since(start))
+	})
+}
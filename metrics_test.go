@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape reads the samples exposed at /metrics, keyed by name and labels
+func (s *testServer) scrape(t *testing.T) map[string]float64 {
+	t.Helper()
+	resp := s.get(t, "/metrics")
+	expectStatus(t, resp, http.StatusOK)
+	if got := resp.Header.Get(CONTENT_TYPE); !strings.HasPrefix(got, "text/plain") {
+		t.Fatalf("got content-type %q, want the text exposition format", got)
+	}
+	samples := map[string]float64{}
+	lines := bufio.NewScanner(bytes.NewReader(resp.body))
+	for lines.Scan() {
+		if strings.HasPrefix(lines.Text(), "#") {
+			continue
+		}
+		name, value, _ := strings.Cut(lines.Text(), " ")
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("parsing sample %q: %v", lines.Text(), err)
+		}
+		samples[name] = n
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t, ATTEMPTS_ENV_VAR+"=1")
+	before := s.scrape(t)
+
+	s.fetchImage(t, "2024-01-01")
+	s.fetchImage(t, "2024-01-02")
+	// every URL of a pattern is counted together
+	expectStatus(t, s.get(t, "/rating/ada@example.com/"+url.PathEscape(stubImage("2024-01-01").Url)), http.StatusNotFound)
+	expectStatus(t, s.get(t, "/rating/grace@example.com/"+url.PathEscape(stubImage("2024-01-02").Url)), http.StatusNotFound)
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	expectStatus(t, s.get(t, "/image?"+DATE_PARAM+"=2024-01-03"), http.StatusBadGateway)
+
+	after := s.scrape(t)
+	for name, want := range map[string]float64{
+		`apod_http_requests_total{path="/image",method="GET",status="200"}`:                     2,
+		`apod_http_requests_total{path="/rating/{email}/{imageURL}",method="GET",status="404"}`: 2,
+		`apod_http_requests_total{path="/image",method="GET",status="502"}`:                     1,
+		`apod_http_request_duration_seconds_count{path="/image"}`:                               3,
+		"apod_upstream_fetch_duration_seconds_count":                                            3,
+		"apod_upstream_errors_total":                                                            1,
+	} {
+		if got := after[name] - before[name]; got != want {
+			t.Errorf("%s went up by %v, want %v", name, got, want)
+		}
+	}
+}
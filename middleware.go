@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	REQUEST_ID_HEADER = "X-Request-ID"
+	CORS_ENV_VAR      = "CORS_ALLOWED_ORIGIN"
+	CORS_METHODS      = "GET, POST, PUT, DELETE, OPTIONS"
+	CORS_HEADERS      = "Content-Type, X-Request-ID, X-API-Token, Authorization, Idempotency-Key"
+	API_TOKEN_ENV_VAR = "APP_API_TOKEN"
+	API_TOKEN_HEADER  = "X-API-Token"
+	BEARER_PREFIX     = "Bearer "
+	MAX_BODY_ENV_VAR  = "MAX_BODY_BYTES"
+	DEFAULT_MAX_BODY  = 1 << 20
+	MIN_GZIP_BYTES    = 1024
+	PRETTY_PARAM      = "pretty"
+
+	REQUEST_TIMEOUT_ENV_VAR = "REQUEST_TIMEOUT_SECONDS"
+	DEFAULT_REQUEST_TIMEOUT = 15 * time.Second
+)
+
+type requestIDKey struct{}
+
+// newRequestID generates a random (version 4) UUID
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// requestID returns the ID stored in ctx by withRequestID, or "" if there is none
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID tags every request with the incoming X-Request-ID header, or a generated one if absent
+// the ID is stored in the request context, for logging, and echoed in the response header
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(REQUEST_ID_HEADER)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(REQUEST_ID_HEADER, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// statusRecorder wraps http.ResponseWriter to remember the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// logRequests logs the method, path, status code and latency of every request served by next
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		slog.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"latency", time.Since(start),
+		)
+	})
+}
+
+// corsOrigin returns the origin allowed to call the API from a browser, read from CORS_ALLOWED_ORIGIN (defaults to any)
+func corsOrigin() string {
+	if origin := os.Getenv(CORS_ENV_VAR); origin != "" {
+		return origin
+	}
+	return "*"
+}
+
+// withCORS sets the CORS headers allowing browser clients from origin, and answers OPTIONS preflight requests with a 204
+func withCORS(origin string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", CORS_METHODS)
+		w.Header().Set("Access-Control-Allow-Headers", CORS_HEADERS)
+		if origin != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bytesEnv reads a positive number of bytes from the environment variable name, or returns fallback if unset
+func bytesEnv(name string, fallback int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		panic(fmt.Sprintf("environment variable %s must be a positive integer, got '%s'", name, value))
+	}
+	return n
+}
+
+// maxBodyBytes returns the largest request body accepted, read from MAX_BODY_BYTES
+func maxBodyBytes() int64 {
+	return bytesEnv(MAX_BODY_ENV_VAR, DEFAULT_MAX_BODY)
+}
+
+// limitBody caps every request body at max bytes, reads past it fail with an *http.MaxBytesError
+func limitBody(max int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows a gzip response
+func acceptsGzip(header string) bool {
+	for _, coding := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter buffers the start of a response, compressing it only once it reaches MIN_GZIP_BYTES
+type gzipWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+	gz     *gzip.Writer
+}
+
+func (g *gzipWriter) WriteHeader(status int) {
+	g.status = status
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	g.buf = append(g.buf, p...)
+	if len(g.buf) >= MIN_GZIP_BYTES && g.Header().Get("Content-Encoding") == "" {
+		g.Header().Set("Content-Encoding", "gzip")
+		g.Header().Del("Content-Length")
+		g.ResponseWriter.WriteHeader(g.status)
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+		if _, err := g.gz.Write(g.buf); err != nil {
+			return 0, err
+		}
+		g.buf = nil
+	}
+	return len(p), nil
+}
+
+// finish flushes the compressed stream, or else sends the small buffered body as is
+func (g *gzipWriter) finish() {
+	if g.gz != nil {
+		g.gz.Close()
+		return
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) > 0 {
+		g.ResponseWriter.Write(g.buf)
+	}
+}
+
+// compress gzips response bodies of at least MIN_GZIP_BYTES for clients sending Accept-Encoding: gzip
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		g := &gzipWriter{ResponseWriter: w, status: http.StatusOK}
+		defer g.finish()
+		next.ServeHTTP(g, r)
+	})
+}
+
+// prettyWriter buffers a response so that a JSON body can be indented once it is complete
+type prettyWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (p *prettyWriter) WriteHeader(status int) {
+	p.status = status
+}
+
+func (p *prettyWriter) Write(b []byte) (int, error) {
+	return p.buf.Write(b)
+}
+
+// finish sends the buffered body, indented if it is JSON, anything else as is
+func (p *prettyWriter) finish() {
+	body := p.buf.Bytes()
+	if strings.HasPrefix(p.Header().Get(CONTENT_TYPE), APPLICATION_JSON) {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, bytes.TrimSpace(body), "", "  "); err == nil {
+			indented.WriteByte('\n')
+			body = indented.Bytes()
+			p.Header().Del("Content-Length")
+		}
+	}
+	p.ResponseWriter.WriteHeader(p.status)
+	p.ResponseWriter.Write(body)
+}
+
+// prettyJSON indents the JSON responses of requests with the query param 'pretty=true', for humans reading them with curl
+// responses stay compact by default
+func prettyJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.URL.Query().Get(PRETTY_PARAM)
+		if value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		pretty, err := strconv.ParseBool(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("query param '%s' must be a boolean, got '%s'", PRETTY_PARAM, value))
+			return
+		}
+		if !pretty {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p := &prettyWriter{ResponseWriter: w, status: http.StatusOK}
+		defer p.finish()
+		next.ServeHTTP(p, r)
+	})
+}
+
+// requestTimeout returns how long a request may take before it is answered with a 503, read from REQUEST_TIMEOUT_SECONDS
+func requestTimeout() time.Duration {
+	timeout := os.Getenv(REQUEST_TIMEOUT_ENV_VAR)
+	if timeout == "" {
+		return DEFAULT_REQUEST_TIMEOUT
+	}
+	seconds, err := strconv.Atoi(timeout)
+	if err != nil || seconds <= 0 {
+		panic(fmt.Sprintf("environment variable %s must be a positive integer, got '%s'", REQUEST_TIMEOUT_ENV_VAR, timeout))
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// jsonTimeoutWriter marks the 503 body http.TimeoutHandler writes, which comes without a content-type, as JSON
+// every 503 written by the handlers themselves already carries one, so it is left alone
+// http.TimeoutHandler also replaces the headers set before it with the handler's, so the Vary values the outer
+// middleware set, vary, are added back next to the handler's own
+type jsonTimeoutWriter struct {
+	http.ResponseWriter
+	vary []string
+}
+
+func (j jsonTimeoutWriter) WriteHeader(status int) {
+	if status == http.StatusServiceUnavailable && j.Header().Get(CONTENT_TYPE) == "" {
+		j.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	}
+	for _, v := range j.vary {
+		if !slices.Contains(j.Header().Values("Vary"), v) {
+			j.Header().Add("Vary", v)
+		}
+	}
+	j.ResponseWriter.WriteHeader(status)
+}
+
+// withTimeout answers with a 503 JSON error once next has run for longer than timeout
+// the request context is canceled at the same time, aborting any call to NASA still in flight
+func withTimeout(timeout time.Duration, next http.Handler) http.Handler {
+	body, _ := json.Marshal(errorResponse{Error: errorBody{Code: "request_timeout", Message: "request timed out"}})
+	timeoutHandler := http.TimeoutHandler(next, timeout, string(body))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeoutHandler.ServeHTTP(jsonTimeoutWriter{w, slices.Clone(w.Header().Values("Vary"))}, r)
+	})
+}
+
+// recoverPanics turns a panic in next into a 500 JSON error, logging it with its stack, instead of dropping the connection
+// http.ErrAbortHandler is let through, it is how a handler deliberately aborts a response
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			slog.ErrorContext(r.Context(), "handler panicked", "path", r.URL.Path, "error", err, "stack", string(debug.Stack()))
+			writeError(w, http.StatusInternalServerError, "internal server error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiToken returns the token required by mutating requests, read from APP_API_TOKEN
+// an empty token disables authentication
+func apiToken() string {
+	token := os.Getenv(API_TOKEN_ENV_VAR)
+	if token == "" {
+		slog.Warn("environment variable " + API_TOKEN_ENV_VAR + " not set, mutating endpoints are unauthenticated and /export is disabled")
+	}
+	return token
+}
+
+// requestToken reads the token sent in the X-API-Token header, or as an Authorization bearer token
+func requestToken(r *http.Request) string {
+	if token := r.Header.Get(API_TOKEN_HEADER); token != "" {
+		return token
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, BEARER_PREFIX) {
+		return strings.TrimPrefix(auth, BEARER_PREFIX)
+	}
+	return ""
+}
+
+// requireToken rejects POST, PUT and DELETE requests that don't carry token, with a 401 if none was sent and a 403 if it is wrong
+// other methods, and every request when token is empty, go straight to next
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != POST && r.Method != PUT && r.Method != DELETE {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if checkToken(w, r, token) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// requireTokenAlways is requireToken for every method, guarding endpoints that read out or overwrite everyone's data
+// unlike requireToken it fails closed, responding 503 to every request while token is empty
+func requireTokenAlways(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeError(w, http.StatusServiceUnavailable, "disabled until "+API_TOKEN_ENV_VAR+" is configured")
+			return
+		}
+		if checkToken(w, r, token) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// checkToken responds 401 or 403 unless the request carries token, or token is empty, reporting whether the handler can go on
+func checkToken(w http.ResponseWriter, r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	got := requestToken(r)
+	if got == "" {
+		writeError(w, http.StatusUnauthorized, "need an API token in the "+API_TOKEN_HEADER+" header")
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		writeError(w, http.StatusForbidden, "invalid API token")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogRequests(t *testing.T) {
+	logs := captureLogs(t)
+	handler := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		// no explicit WriteHeader means a 200
+		w.Write([]byte("ok"))
+	}))
+	for _, path := range []string{"/found", "/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(GET, path, nil))
+	}
+
+	records := logs.withMessage(t, "request")
+	if len(records) != 2 {
+		t.Fatalf("got %d request records, want 2", len(records))
+	}
+	for n, want := range []struct {
+		path   string
+		status float64
+	}{{"/found", 200}, {"/missing", 404}} {
+		record := records[n]
+		if record["method"] != GET || record["path"] != want.path || record["status"] != want.status {
+			t.Errorf("got record %v, want GET %s with status %v", record, want.path, want.status)
+		}
+		if _, ok := record["latency"].(float64); !ok {
+			t.Errorf("got record %v without a latency", record)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	s := newTestServer(t)
+	logs := captureLogs(t)
+
+	resp := s.get(t, "/health", REQUEST_ID_HEADER, "incoming-id")
+	if got := resp.Header.Get(REQUEST_ID_HEADER); got != "incoming-id" {
+		t.Errorf("got %s %q, want the incoming ID preserved", REQUEST_ID_HEADER, got)
+	}
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first := s.get(t, "/health").Header.Get(REQUEST_ID_HEADER)
+	second := s.get(t, "/health").Header.Get(REQUEST_ID_HEADER)
+	if !uuid.MatchString(first) || !uuid.MatchString(second) || first == second {
+		t.Errorf("got generated IDs %q and %q, want two distinct UUIDs", first, second)
+	}
+
+	records := logs.withMessage(t, "request")
+	if len(records) != 3 {
+		t.Fatalf("got %d request records, want 3", len(records))
+	}
+	for n, want := range []string{"incoming-id", first, second} {
+		if records[n]["request_id"] != want {
+			t.Errorf("got record %v, want request_id %q", records[n], want)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	for _, origin := range []string{"", "https://app.example.com"} {
+		s := newTestServer(t, CORS_ENV_VAR+"="+origin)
+		want := origin
+		if want == "" {
+			want = "*"
+		}
+
+		preflight := s.request(t, http.MethodOptions, "/rating", nil, "Origin", "https://app.example.com", "Access-Control-Request-Method", POST)
+		expectStatus(t, preflight, http.StatusNoContent)
+		if got := preflight.Header.Get("Access-Control-Allow-Methods"); got != CORS_METHODS {
+			t.Errorf("got Access-Control-Allow-Methods %q, want %q", got, CORS_METHODS)
+		}
+		if got := preflight.Header.Get("Access-Control-Allow-Headers"); got != CORS_HEADERS {
+			t.Errorf("got Access-Control-Allow-Headers %q, want %q", got, CORS_HEADERS)
+		}
+		if s.nasa.calls.Load() != 0 {
+			t.Errorf("a preflight reached NASA")
+		}
+
+		for _, path := range []string{"/image", "/user?" + EMAIL_PARAM + "=nobody@example.com", "/rating?" + EMAIL_PARAM + "=nobody@example.com"} {
+			resp := s.get(t, path, "Origin", "https://app.example.com")
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != want {
+				t.Errorf("%s=%q: GET %s got Access-Control-Allow-Origin %q, want %q", CORS_ENV_VAR, origin, path, got, want)
+			}
+		}
+	}
+}
+
+func TestAPIToken(t *testing.T) {
+	s := newTestServer(t, API_TOKEN_ENV_VAR+"=secret")
+	s.token = ""
+
+	for _, c := range []struct {
+		name    string
+		headers []string
+		status  int
+	}{
+		{"missing", nil, http.StatusUnauthorized},
+		{"wrong", []string{API_TOKEN_HEADER, "guess"}, http.StatusForbidden},
+		{"wrong bearer", []string{"Authorization", BEARER_PREFIX + "guess"}, http.StatusForbidden},
+		{"correct", []string{API_TOKEN_HEADER, "secret"}, http.StatusCreated},
+	} {
+		resp := s.request(t, POST, "/user", User{Email: "ada@example.com"}, c.headers...)
+		if resp.StatusCode != c.status {
+			t.Errorf("%s token: got status %d, want %d", c.name, resp.StatusCode, c.status)
+		}
+	}
+	resp := s.request(t, DELETE, "/user", User{Email: "ada@example.com"}, "Authorization", BEARER_PREFIX+"secret")
+	expectStatus(t, resp, http.StatusOK)
+
+	// reading stays open
+	expectStatus(t, s.get(t, "/image"), http.StatusOK)
+	expectStatus(t, s.get(t, "/health"), http.StatusOK)
+}
+
+func TestBodyLimit(t *testing.T) {
+	s := newTestServer(t, MAX_BODY_ENV_VAR+"=64")
+	padding := strings.Repeat(" ", 64)
+	for _, path := range []string{"/user", "/rating", "/ratings/bulk"} {
+		resp := s.request(t, POST, path, `{"email": "ada@example.com"`+padding+`}`)
+		expectStatus(t, resp, http.StatusRequestEntityTooLarge)
+		if code := resp.errorCode(t); code != "request_entity_too_large" {
+			t.Errorf("POST %s: got error code %q, want request_entity_too_large", path, code)
+		}
+	}
+	// up to the limit is fine
+	expectStatus(t, s.request(t, POST, "/user", `{"email": "ada@example.com"}`), http.StatusCreated)
+
+	t.Setenv(MAX_BODY_ENV_VAR, "0")
+	expectPanic(t, MAX_BODY_ENV_VAR+"=0", func() { maxBodyBytes() })
+}
+
+func TestCompress(t *testing.T) {
+	s := newTestServer(t)
+	large := "/image?" + COUNT_PARAM + "=20"
+
+	resp := s.get(t, large, "Accept-Encoding", "gzip")
+	expectStatus(t, resp, http.StatusOK)
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Vary") == "" {
+		t.Fatalf("got Content-Encoding %q and Vary %q, want gzip varying on Accept-Encoding", resp.Header.Get("Content-Encoding"), resp.Header.Get("Vary"))
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(resp.body))
+	if err != nil {
+		t.Fatalf("reading gzip body: %v", err)
+	}
+	var images []ImageResponse
+	if err := json.NewDecoder(reader).Decode(&images); err != nil || len(images) != 20 {
+		t.Errorf("got %d images, error %v, want the 20 decompressed", len(images), err)
+	}
+
+	for name, resp := range map[string]*testResponse{
+		"no gzip":    s.get(t, large, "Accept-Encoding", "identity"),
+		"small body": s.get(t, "/health", "Accept-Encoding", "gzip"),
+	} {
+		expectStatus(t, resp, http.StatusOK)
+		if resp.Header.Get("Content-Encoding") != "" || !json.Valid(resp.body) {
+			t.Errorf("%s: got Content-Encoding %q, want plain JSON", name, resp.Header.Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	slow := withTimeout(50*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+			w.Write([]byte("too late"))
+		}
+	}))
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	slow.ServeHTTP(rec, httptest.NewRequest(GET, "/image", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get(CONTENT_TYPE) != APPLICATION_JSON {
+		t.Errorf("got status %d with content-type %q, want a JSON 503", rec.Code, rec.Header().Get(CONTENT_TYPE))
+	}
+	var body errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error.Code != "request_timeout" {
+		t.Errorf("got body %q, want a request_timeout error", rec.Body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timed out after %v, want about 50ms", elapsed)
+	}
+
+	// through the whole server, the call to NASA is abandoned along with the request
+	s := newTestServer(t, REQUEST_TIMEOUT_ENV_VAR+"=1", DEADLINE_ENV_VAR+"=10")
+	aborted := make(chan struct{})
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(5 * time.Second):
+		}
+	})
+	expectStatus(t, s.get(t, "/image?"+COUNT_PARAM+"=1"), http.StatusServiceUnavailable)
+	select {
+	case <-aborted:
+	case <-time.After(2 * time.Second):
+		t.Errorf("the call to NASA outlived the timed out request")
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	logs := captureLogs(t)
+	server := httptest.NewServer(recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/boom" {
+			var image *Image
+			w.Write([]byte(image.Title))
+		}
+		w.Write([]byte("ok"))
+	})))
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL + "/boom")
+	if err != nil {
+		t.Fatalf("GET /boom: %v", err)
+	}
+	var body errorResponse
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || body.Error.Code != "internal_server_error" {
+		t.Errorf("got status %d and error %+v, want a JSON 500", resp.StatusCode, body.Error)
+	}
+	records := logs.withMessage(t, "handler panicked")
+	if len(records) != 1 || records[0]["path"] != "/boom" || !strings.Contains(records[0]["stack"].(string), "TestRecoverPanics") {
+		t.Errorf("got records %v, want the panic logged with its path and stack", records)
+	}
+
+	// the server survives
+	resp, err = server.Client().Get(server.URL + "/fine")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /fine after a panic: %v", err)
+	}
+	resp.Body.Close()
+
+	// http.ErrAbortHandler is passed on, for net/http to abort the response quietly
+	rec := httptest.NewRecorder()
+	expectPanic(t, "http.ErrAbortHandler", func() {
+		recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		})).ServeHTTP(rec, httptest.NewRequest(GET, "/", nil))
+	})
+}
+
+func TestPrettyJSON(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "ada@example.com")
+	s.saveRating(t, "ada@example.com", stubImage("2024-01-01").Url, 4)
+
+	for _, path := range []string{"/image?" + DATE_PARAM + "=2024-01-01", "/rating?" + EMAIL_PARAM + "=ada@example.com", "/user?" + EMAIL_PARAM + "=nobody@example.com"} {
+		compact := s.get(t, path)
+		pretty := s.get(t, path+"&"+PRETTY_PARAM+"=true")
+		if pretty.StatusCode != compact.StatusCode {
+			t.Errorf("%s: got status %d pretty, %d compact, want the same", path, pretty.StatusCode, compact.StatusCode)
+		}
+		if !bytes.Contains(pretty.body, []byte("\n  ")) {
+			t.Errorf("%s: got %q, want it indented", path, pretty.body)
+		}
+		if bytes.Contains(bytes.TrimSpace(compact.body), []byte("\n")) {
+			t.Errorf("%s: got %q by default, want it compact", path, compact.body)
+		}
+		var indented, plain interface{}
+		pretty.decode(t, &indented)
+		compact.decode(t, &plain)
+		if !reflect.DeepEqual(indented, plain) {
+			t.Errorf("%s: got %v pretty, %v compact, want the same document", path, indented, plain)
+		}
+	}
+	if body := s.get(t, "/image?"+DATE_PARAM+"=2024-01-01&"+PRETTY_PARAM+"=false").body; bytes.Contains(bytes.TrimSpace(body), []byte("\n")) {
+		t.Errorf("got %q with %s=false, want it compact", body, PRETTY_PARAM)
+	}
+	expectStatus(t, s.get(t, "/image?"+PRETTY_PARAM+"=very"), http.StatusBadRequest)
+}
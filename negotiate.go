@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+)
+
+const (
+	TEXT_HTML  = "text/html"
+	TEXT_PLAIN = "text/plain"
+)
+
+// imageMediaTypes are what image responses can be rendered as, JSON first since it's the default
+var imageMediaTypes = []string{APPLICATION_JSON, TEXT_HTML, TEXT_PLAIN}
+
+// imagePage renders images as a bare HTML page, a card per image with its title, the image itself and the explanation
+// html/template escapes everything and drops URLs which aren't http(s), images created by clients included
+var imagePage = template.Must(template.New("images").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{if eq (len .Images) 1}}{{(index .Images 0).Title}}{{else}}Astronomy Picture of the Day{{end}}</title>
+</head>
+<body>
+{{range .Images}}<article>
+<h1>{{.Title}}</h1>
+<p>{{.Date}}{{with .Copyright}} &middot; &copy; {{.}}{{end}}</p>
+{{if .IsVideo}}<p><a href="{{.Url}}">{{if .ThumbnailURL}}<img src="{{.ThumbnailURL}}" alt="{{.Title}}">{{else}}Watch the video{{end}}</a></p>
+{{else}}<p><a href="{{or .HDUrl .Url}}"><img src="{{.Url}}" alt="{{.Title}}"></a></p>
+{{end}}<p>{{.Explanation}}</p>
+</article>
+{{end}}{{range .Errors}}<p>{{.Date}}: {{.Error}}</p>
+{{end}}</body>
+</html>
+`))
+
+// negotiate returns which of imageMediaTypes the Accept header weighs highest, ties going to the earlier one
+// a missing header, or one accepting none of them, gets JSON rather than a 406
+func negotiate(accept string) string {
+	best, bestWeight := APPLICATION_JSON, 0.0
+	for _, offer := range imageMediaTypes {
+		if weight := acceptWeight(accept, offer); weight > bestWeight {
+			best, bestWeight = offer, weight
+		}
+	}
+	return best
+}
+
+// acceptWeight returns the q-value the Accept header gives mediaType, the most specific matching range counting
+// so "text/*;q=0.5, text/html" weighs text/html 1 and text/plain 0.5
+func acceptWeight(accept, mediaType string) float64 {
+	weight, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		var match int
+		switch {
+		case name == mediaType:
+			match = 2
+		case name == "*/*":
+			match = 0
+		case strings.HasSuffix(name, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(name, "*")):
+			match = 1
+		default:
+			continue
+		}
+		if match < specificity {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		weight, specificity = q, match
+	}
+	return weight
+}
+
+// renderedImages is what writeImages responds with, as HTML or plain text, the images and any dates that failed
+type renderedImages struct {
+	Images []ImageResponse
+	Errors []DateError
+}
+
+// imagesOf unpacks what writeImages is given into renderedImages
+func imagesOf(v interface{}) renderedImages {
+	switch v := v.(type) {
+	case ImageResponse:
+		return renderedImages{Images: []ImageResponse{v}}
+	case []ImageResponse:
+		return renderedImages{Images: v}
+	case []Image:
+		return renderedImages{Images: enrichAll(v)}
+	case DatesResult:
+		return renderedImages{Images: v.Images, Errors: v.Errors}
+	}
+	return renderedImages{}
+}
+
+// renderImages renders v as mediaType, an HTML page or a plain text summary, leaving out no fields
+func renderImages(v interface{}, mediaType string) ([]byte, error) {
+	images := imagesOf(v)
+	var buf bytes.Buffer
+	if mediaType == TEXT_HTML {
+		if err := imagePage.Execute(&buf, images); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	for n, image := range images.Images {
+		if n > 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "%s (%s)\n%s\n", image.Title, image.Date, image.Url)
+		if image.Copyright != "" {
+			fmt.Fprintf(&buf, "Copyright: %s\n", image.Copyright)
+		}
+		fmt.Fprintf(&buf, "\n%s\n", image.Explanation)
+	}
+	for _, dateErr := range images.Errors {
+		fmt.Fprintf(&buf, "\n%s: %s\n", dateErr.Date, dateErr.Error)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// openAPISpec is the hand-written OpenAPI 3 description of every endpoint, to be kept in sync with the handlers
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+type Endpoint struct {
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	Summary string `json:"summary"`
+}
+
+type Index struct {
+	Name      string     `json:"name"`
+	Docs      string     `json:"docs"`
+	Endpoints []Endpoint `json:"endpoints"`
+}
+
+// endpoints lists every operation of openAPISpec, sorted by path then method
+func endpoints() []Endpoint {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		panic("invalid openapi.json: " + err.Error())
+	}
+	var result []Endpoint
+	for path, item := range spec.Paths {
+		// besides its operations a path item can hold fields shared by all of them, such as parameters
+		for _, method := range []string{GET, POST, PUT, DELETE} {
+			raw, ok := item[strings.ToLower(method)]
+			if !ok {
+				continue
+			}
+			var operation struct {
+				Summary string `json:"summary"`
+			}
+			if err := json.Unmarshal(raw, &operation); err != nil {
+				panic("invalid openapi.json: " + err.Error())
+			}
+			result = append(result, Endpoint{Method: method, Path: path, Summary: operation.Summary})
+		}
+	}
+	sort.Slice(result, func(a, b int) bool {
+		if result[a].Path != result[b].Path {
+			return result[a].Path < result[b].Path
+		}
+		return result[a].Method < result[b].Method
+	})
+	return result
+}
+
+// openAPIHandler serves openapi.json at /openapi.json
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != GET {
+		methodNotAllowed(w, GET)
+		return
+	}
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpec)
+}
+
+// indexHandler returns a handler for /, listing the endpoints described in openapi.json
+// the mux sends every unknown path here too, those get a JSON 404
+func indexHandler() http.HandlerFunc {
+	index := Index{Name: "nasa-apod-api-go", Docs: "/openapi.json", Endpoints: endpoints()}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			writeError(w, http.StatusNotFound, "no endpoint at "+r.URL.Path+", see / for the list")
+			return
+		}
+		if r.Method != GET {
+			methodNotAllowed(w, GET)
+			return
+		}
+		w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(index)
+	}
+}
+
+// faviconHandler answers browsers asking for /favicon.ico with an empty 204, there is no icon
+func faviconHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPISpec(t *testing.T) {
+	s := newTestServer(t)
+	resp := s.get(t, "/openapi.json")
+	expectStatus(t, resp, http.StatusOK)
+	var spec struct {
+		OpenAPI string                            `json:"openapi"`
+		Paths   map[string]map[string]interface{} `json:"paths"`
+	}
+	resp.decode(t, &spec)
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("got openapi %q, want 3.x", spec.OpenAPI)
+	}
+	for path, methods := range map[string][]string{
+		"/image":  {"get"},
+		"/user":   {"get", "post", "put", "delete"},
+		"/rating": {"get", "post", "put", "delete"},
+	} {
+		for _, method := range methods {
+			if spec.Paths[path][method] == nil {
+				t.Errorf("%s %s is not described", strings.ToUpper(method), path)
+			}
+		}
+	}
+
+	// every operation described is served, with that method
+	params := regexp.MustCompile(`\{[^}]+\}`)
+	for _, endpoint := range endpoints() {
+		path := params.ReplaceAllString(endpoint.Path, "x")
+		resp := s.request(t, endpoint.Method, path, nil)
+		var body errorResponse
+		if resp.StatusCode == http.StatusMethodNotAllowed || (resp.StatusCode == http.StatusNotFound && json.Unmarshal(resp.body, &body) == nil && strings.HasPrefix(body.Error.Message, "no endpoint at")) {
+			t.Errorf("%s %s is described but not served, got %d %q", endpoint.Method, endpoint.Path, resp.StatusCode, resp.body)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	s := newTestServer(t)
+	resp := s.get(t, "/")
+	expectStatus(t, resp, http.StatusOK)
+	var index Index
+	resp.decode(t, &index)
+	if index.Docs != "/openapi.json" || len(index.Endpoints) != len(endpoints()) {
+		t.Fatalf("got %+v, want every endpoint of openapi.json listed", index)
+	}
+	listed := map[string]bool{}
+	for _, endpoint := range index.Endpoints {
+		listed[endpoint.Method+" "+endpoint.Path] = endpoint.Summary != ""
+	}
+	for _, endpoint := range []string{"GET /image", "POST /user", "DELETE /rating", "GET /health"} {
+		if !listed[endpoint] {
+			t.Errorf("%s is not listed with a summary", endpoint)
+		}
+	}
+
+	resp = s.get(t, "/favicon.ico")
+	expectStatus(t, resp, http.StatusNoContent)
+	if len(resp.body) != 0 {
+		t.Errorf("got favicon body %q, want none", resp.body)
+	}
+	resp = s.get(t, "/nowhere")
+	expectStatus(t, resp, http.StatusNotFound)
+	if code := resp.errorCode(t); code != "not_found" {
+		t.Errorf("got error code %q for an unknown path, want not_found", code)
+	}
+}
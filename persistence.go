@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+const (
+	DATA_DIR_ENV_VAR = "DATA_DIR"
+	IMAGES_FILE      = "images.json"
+	USERS_FILE       = "users.json"
+)
+
+// dataFile returns the path of the named file inside DATA_DIR, or "" if persistence is disabled
+func dataFile(name string) string {
+	dir := os.Getenv(DATA_DIR_ENV_VAR)
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, name)
+}
+
+// loadJSON decodes the file at path into v
+// a missing file is not an error, a corrupt one is logged and v is left untouched
+func loadJSON(path string, v interface{}) {
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		slog.Error("reading data file", "path", path, "error", err)
+		return
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		slog.Error("decoding data file, starting empty", "path", path, "error", err)
+	}
+}
+
+// saveJSON encodes v to the file at path
+// it writes to a temporary file first so a failed save never truncates the previous one
+func saveJSON(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// load populates the image and user maps from their data files, if any
+func (m *memoryStorage) load() {
+	images := map[imageURL]Image{}
+	loadJSON(m.imagesFile, &images)
+	ratings := map[userEmail]map[imageURL]json.RawMessage{}
+	loadJSON(m.usersFile, &ratings)
+
+	m.imagesLock.Lock()
+	for _, image := range images {
+		m.images.put(image)
+	}
+	m.imagesLock.Unlock()
+
+	m.usersLock.Lock()
+	defer m.usersLock.Unlock()
+	m.users = map[userEmail]*user{}
+	for email, userRatings := range ratings {
+		usr := newUser()
+		for url, raw := range userRatings {
+			// files written before ratings had timestamps hold bare values, those count as saved now
+			var value rating
+			if err := json.Unmarshal(raw, &value); err == nil {
+				usr.store[url] = newStoredRating(value)
+				continue
+			}
+			var stored storedRating
+			if err := json.Unmarshal(raw, &stored); err != nil {
+				slog.Error("decoding rating, skipping it", "path", m.usersFile, "email", email, "image_url", url, "error", err)
+				continue
+			}
+			usr.store[url] = stored
+		}
+		m.users[email] = usr
+	}
+}
+
+// Snapshot copies the images and every user with their ratings
+// the images lock, then the users lock, are held throughout, so no change lands halfway through
+func (m *memoryStorage) Snapshot() (Snapshot, error) {
+	m.imagesLock.Lock()
+	defer m.imagesLock.Unlock()
+	m.usersLock.Lock()
+	defer m.usersLock.Unlock()
+
+	snapshot := Snapshot{Images: map[imageURL]Image{}, Users: map[userEmail]map[imageURL]storedRating{}}
+	for _, image := range m.images.all() {
+		snapshot.Images[imageURL(image.Url)] = image
+	}
+	for email, existingUser := range m.users {
+		existingUser.Lock()
+		userRatings := map[imageURL]storedRating{}
+		for url, stored := range existingUser.store {
+			userRatings[url] = stored
+		}
+		existingUser.Unlock()
+		snapshot.Users[email] = userRatings
+	}
+	return snapshot, nil
+}
+
+// Restore loads snapshot while holding the same locks as Snapshot
+func (m *memoryStorage) Restore(snapshot Snapshot, replace bool) error {
+	m.imagesLock.Lock()
+	defer m.imagesLock.Unlock()
+	m.usersLock.Lock()
+	defer m.usersLock.Unlock()
+
+	if replace {
+		m.images = newImageLRU(m.images.max)
+		m.users = map[userEmail]*user{}
+	}
+	for _, image := range snapshot.Images {
+		m.images.put(image)
+	}
+	for email, userRatings := range snapshot.Users {
+		existingUser, ok := m.users[email]
+		if !ok {
+			existingUser = newUser()
+			m.users[email] = existingUser
+		}
+		existingUser.Lock()
+		for url, stored := range userRatings {
+			existingUser.store[url] = stored
+		}
+		existingUser.Unlock()
+	}
+	return nil
+}
+
+// save writes the images, and every user with their ratings, to their data files, if any
+func (m *memoryStorage) save() error {
+	snapshot, err := m.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err := saveJSON(m.imagesFile, snapshot.Images); err != nil {
+		return err
+	}
+	return saveJSON(m.usersFile, snapshot.Users)
+}
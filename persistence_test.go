@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryStoragePersistence(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(DATA_DIR_ENV_VAR, dir)
+	image := stubImage("2024-01-01")
+
+	m := newMemoryStorage()
+	if err := m.SaveImage(image); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CreateUser("ada@example.com", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CreateUser("grace@example.com", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveRating("ada@example.com", imageURL(image.Url), 4, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := newMemoryStorage()
+	ratings, err := reloaded.GetRatings("ada@example.com")
+	if err != nil || len(ratings) != 1 || ratings[imageURL(image.Url)].Value != 4 || ratings[imageURL(image.Url)].CreatedAt.IsZero() {
+		t.Errorf("got ratings %+v (%v) after reloading, want the one saved", ratings, err)
+	}
+	if ratings, err := reloaded.GetRatings("grace@example.com"); err != nil || len(ratings) != 0 {
+		t.Errorf("got %+v (%v) for the user without ratings, want them kept with none", ratings, err)
+	}
+	if stored, err := reloaded.GetImage(imageURL(image.Url)); err != nil || stored.Title != image.Title {
+		t.Errorf("got image %+v (%v) after reloading, want the one saved", stored, err)
+	}
+}
+
+func TestMemoryStorageMissingOrCorruptFiles(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(DATA_DIR_ENV_VAR, dir)
+
+	// a missing file starts empty
+	if images, _ := newMemoryStorage().ListImages(); len(images) != 0 {
+		t.Errorf("got %d images without data files", len(images))
+	}
+
+	// and so does a corrupt one
+	for _, name := range []string{IMAGES_FILE, USERS_FILE} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(`{"truncated": `), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := newMemoryStorage()
+	if images, _ := m.ListImages(); len(images) != 0 {
+		t.Errorf("got %d images from a corrupt file", len(images))
+	}
+	if err := m.CreateUser("ada@example.com", 0); err != nil {
+		t.Errorf("creating a user after starting from a corrupt file: %v", err)
+	}
+}
+
+func TestMemoryStorageLegacyRatings(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(DATA_DIR_ENV_VAR, dir)
+	// files written before ratings had timestamps hold bare values
+	legacy := `{"ada@example.com": {"https://apod.nasa.gov/apod/image/a.jpg": 5}}`
+	if err := os.WriteFile(filepath.Join(dir, USERS_FILE), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ratings, err := newMemoryStorage().GetRatings("ada@example.com")
+	stored := ratings["https://apod.nasa.gov/apod/image/a.jpg"]
+	if err != nil || stored.Value != 5 || stored.CreatedAt.IsZero() {
+		t.Errorf("got %+v (%v), want the bare rating loaded with a timestamp", ratings, err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MAX_PROXY_BYTES caps the size of a proxied image, APOD's largest being a few MB
+const MAX_PROXY_BYTES = 32 << 20
+
+// proxyHosts are the only hosts /image/proxy fetches from, where APOD serves its images
+// anything else is refused so the endpoint can't be pointed at arbitrary, possibly internal, URLs
+var proxyHosts = []string{"apod.nasa.gov"}
+
+// errProxyHost is returned when a proxied URL, or a redirect it leads to, isn't on one of proxyHosts
+var errProxyHost = errors.New("host not allowed")
+
+// parseProxyURL parses the url to proxy, which must be an absolute http(s) URL
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("query param '%s' must be an absolute http(s) URL, got '%s'", URL_PARAM, raw)
+	}
+	return u, nil
+}
+
+// allowProxyHost checks that u is on one of proxyHosts, on the default port
+func allowProxyHost(u *url.URL) error {
+	if !slices.Contains(proxyHosts, strings.ToLower(u.Hostname())) || (u.Port() != "" && u.Port() != "80" && u.Port() != "443") {
+		return errProxyHost
+	}
+	return nil
+}
+
+// newProxyClient returns the client /image/proxy fetches with, which stays on proxyHosts through redirects
+// and, whatever they resolve to, never connects to an internal address
+func newProxyClient(timeout time.Duration) *http.Client {
+	return newGuardedClient(timeout, allowProxyHost)
+}
+
+// proxyImage is responsible for requests sent to the /image/proxy endpoint
+// it fetches the image at the 'url' query param, which must be hosted by APOD, and streams it back with its content-type
+// so clients that can't reach NASA's hosts themselves can still display it
+// images over MAX_PROXY_BYTES get a 502, or, when the host didn't say how large they are, have their connection cut once past it
+func (i *imageStore) proxyImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != GET {
+		methodNotAllowed(w, GET)
+		return
+	}
+	raw := r.URL.Query().Get(URL_PARAM)
+	if raw == "" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("need query param '%s' with the URL of an APOD image", URL_PARAM))
+		return
+	}
+	u, err := parseProxyURL(raw)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if allowProxyHost(u) != nil {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("only images hosted on %s can be proxied, not on '%s'", strings.Join(proxyHosts, ", "), u.Host))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), i.deadline)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, GET, u.String(), nil)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp, err := i.proxyClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errProxyHost) || errors.Is(err, errBlockedAddress) {
+			slog.WarnContext(r.Context(), "refusing to proxy image", "url", u.String(), "error", err)
+			writeError(w, http.StatusBadGateway, "image host redirected or resolved to an address that can't be proxied")
+			return
+		}
+		writeUpstreamError(w, r, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no image at %s", u))
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("image host responded %s", resp.Status))
+		return
+	}
+	ct := resp.Header.Get(CONTENT_TYPE)
+	if !strings.HasPrefix(ct, "image/") {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("image host responded with content-type '%s' instead of an image", ct))
+		return
+	}
+	if resp.ContentLength > MAX_PROXY_BYTES {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("image is larger than %d bytes", MAX_PROXY_BYTES))
+		return
+	}
+
+	w.Header().Set(CONTENT_TYPE, ct)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	copied, err := io.Copy(w, io.LimitReader(resp.Body, MAX_PROXY_BYTES+1))
+	if err != nil {
+		slog.WarnContext(r.Context(), "streaming proxied image", "url", u.String(), "error", err)
+		return
+	}
+	if copied > MAX_PROXY_BYTES {
+		// the status is long gone, cutting the connection is the only way left to tell the client the image is incomplete
+		slog.WarnContext(r.Context(), "proxied image too large, aborting", "url", u.String(), "max_bytes", MAX_PROXY_BYTES)
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// imageHost answers the proxy's requests in place of APOD's image host, with handler
+type imageHost struct {
+	handler http.HandlerFunc
+}
+
+func (host imageHost) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	host.handler(rec, req)
+	return rec.Result(), nil
+}
+
+// proxyPath is the /image/proxy path for the image at raw
+func proxyPath(raw string) string {
+	return "/image/proxy?" + URL_PARAM + "=" + url.QueryEscape(raw)
+}
+
+func TestProxyImage(t *testing.T) {
+	picture := bytes.Repeat([]byte{0xff, 0xd8, 0xff}, 1000)
+	s := newTestServer(t)
+	var requested string
+	s.images.proxyClient = &http.Client{Transport: imageHost{func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+		switch r.URL.Path {
+		case "/apod/image/2401/moon.jpg":
+			w.Header().Set(CONTENT_TYPE, "image/jpeg")
+			w.Header().Set("Content-Length", strconv.Itoa(len(picture)))
+			w.Write(picture)
+		case "/apod/image/2401/page.html":
+			w.Header().Set(CONTENT_TYPE, "text/html")
+			w.Write([]byte("<html></html>"))
+		case "/apod/image/2401/huge.jpg":
+			w.Header().Set(CONTENT_TYPE, "image/jpeg")
+			w.Header().Set("Content-Length", strconv.Itoa(MAX_PROXY_BYTES+1))
+		default:
+			http.NotFound(w, r)
+		}
+	}}}
+
+	image := "https://apod.nasa.gov/apod/image/2401/moon.jpg"
+	resp := s.get(t, proxyPath(image), "Accept-Encoding", "gzip")
+	expectStatus(t, resp, http.StatusOK)
+	if requested != image {
+		t.Errorf("proxy fetched %q, want %q", requested, image)
+	}
+	if ct := resp.Header.Get(CONTENT_TYPE); ct != "image/jpeg" {
+		t.Errorf("got content-type %q, want the host's image/jpeg", ct)
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+		t.Errorf("got content-encoding %q, want the image streamed as is", enc)
+	}
+	if !bytes.Equal(resp.body, picture) {
+		t.Errorf("got %d bytes, want the %d of the image", len(resp.body), len(picture))
+	}
+
+	for _, tc := range []struct {
+		url    string
+		status int
+	}{
+		{"https://apod.nasa.gov/apod/image/2401/missing.jpg", http.StatusNotFound},
+		{"https://apod.nasa.gov/apod/image/2401/page.html", http.StatusBadGateway},
+		{"https://apod.nasa.gov/apod/image/2401/huge.jpg", http.StatusBadGateway},
+		{"https://example.com/moon.jpg", http.StatusForbidden},
+		{"http://169.254.169.254/latest/meta-data/", http.StatusForbidden},
+		{"https://apod.nasa.gov:8443/apod/image/2401/moon.jpg", http.StatusForbidden},
+		{"ftp://apod.nasa.gov/apod/image/2401/moon.jpg", http.StatusBadRequest},
+		{"/apod/image/2401/moon.jpg", http.StatusBadRequest},
+	} {
+		requested = ""
+		resp := s.get(t, proxyPath(tc.url))
+		expectStatus(t, resp, tc.status)
+		if tc.status == http.StatusForbidden && requested != "" {
+			t.Errorf("%s: proxy fetched %q from a host it must refuse", tc.url, requested)
+		}
+	}
+	expectStatus(t, s.get(t, "/image/proxy"), http.StatusBadRequest)
+}
+
+func TestProxyRedirectRefused(t *testing.T) {
+	s := newTestServer(t)
+	// the proxy's own client, whose redirect check must refuse the internal address before following it
+	calls := 0
+	host := imageHost{func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	}}
+	client := newProxyClient(s.images.deadline)
+	client.Transport = host
+	s.images.proxyClient = client
+
+	resp := s.get(t, proxyPath("https://apod.nasa.gov/apod/image/2401/moon.jpg"))
+	expectStatus(t, resp, http.StatusBadGateway)
+	if calls != 1 {
+		t.Errorf("image host got %d requests, want only the one redirected", calls)
+	}
+}
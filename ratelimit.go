@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RATE_LIMIT_ENV_VAR = "IMAGE_RATE_LIMIT_PER_MINUTE"
+	DEFAULT_RATE_LIMIT = 30
+	MAX_BUCKETS        = 10000
+	TRUSTED_ENV_VAR    = "TRUSTED_PROXIES"
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a per-key token bucket, refilling perMinute tokens a minute up to a burst of perMinute
+// X-Forwarded-For is only believed when the request comes from one of the trusted proxies
+type rateLimiter struct {
+	sync.Mutex
+	perMinute float64
+	buckets   map[string]*bucket
+	trusted   []netip.Prefix
+}
+
+// newRateLimiter instantiates rateLimiter from IMAGE_RATE_LIMIT_PER_MINUTE and returns a pointer to it
+// it returns nil, disabling rate limiting, when the limit is set to 0
+func newRateLimiter() *rateLimiter {
+	perMinute := DEFAULT_RATE_LIMIT
+	if limit := os.Getenv(RATE_LIMIT_ENV_VAR); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			panic(fmt.Sprintf("environment variable %s must be a non-negative integer, got '%s'", RATE_LIMIT_ENV_VAR, limit))
+		}
+		perMinute = n
+	}
+	if perMinute == 0 {
+		return nil
+	}
+	return &rateLimiter{
+		perMinute: float64(perMinute),
+		buckets:   map[string]*bucket{},
+		trusted:   trustedProxies(),
+	}
+}
+
+// trustedProxies returns the proxies whose X-Forwarded-For is believed, read from TRUSTED_PROXIES
+// as comma separated IPs or CIDR prefixes, none by default
+func trustedProxies() []netip.Prefix {
+	var trusted []netip.Prefix
+	for _, entry := range strings.Split(os.Getenv(TRUSTED_ENV_VAR), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				panic(fmt.Sprintf("environment variable %s must be comma separated IPs or CIDR prefixes, got '%s'", TRUSTED_ENV_VAR, entry))
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		trusted = append(trusted, prefix.Masked())
+	}
+	return trusted
+}
+
+// allow takes a token from key's bucket, or reports how long until one is available
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	perSecond := l.perMinute / 60
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= MAX_BUCKETS {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.perMinute, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.perMinute, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune drops the buckets that have refilled completely, since they behave like new ones, the caller must hold the lock
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.perMinute/60 >= l.perMinute {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// isTrusted reports whether ip is one of the trusted proxies
+func (l *rateLimiter) isTrusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range l.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the originating client of a request, its RemoteAddr unless that is a trusted proxy
+// in which case X-Forwarded-For is walked from the right, each hop having been appended by the one after it,
+// and the first entry that isn't a trusted proxy is the client, anything left of it may have been forged
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !l.isTrusted(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for n := len(hops) - 1; n >= 0; n-- {
+		hop := strings.TrimSpace(hops[n])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !l.isTrusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// limitRate rejects requests with a 429 and a Retry-After header once their client IP runs out of tokens
+// a nil limiter lets every request through
+func limitRate(l *rateLimiter, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.allow(l.clientIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "rate limit exceeded, retry later")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestRateLimit(t *testing.T) {
+	s := newTestServer(t, RATE_LIMIT_ENV_VAR+"=3")
+	for n := 1; n <= 3; n++ {
+		expectStatus(t, s.get(t, "/image"), http.StatusOK)
+	}
+	resp := s.get(t, "/image")
+	expectStatus(t, resp, http.StatusTooManyRequests)
+	if wait, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || wait < 1 || wait > 20 {
+		t.Errorf("got Retry-After %q, want the ~20s until a token is back", resp.Header.Get("Retry-After"))
+	}
+	if calls := s.nasa.calls.Load(); calls != 3 {
+		t.Errorf("got %d upstream calls, want the 3 allowed", calls)
+	}
+
+	// a forged X-Forwarded-For doesn't buy an untrusted client a fresh bucket
+	expectStatus(t, s.get(t, "/image", "X-Forwarded-For", "203.0.113.9"), http.StatusTooManyRequests)
+	// only /image is limited
+	expectStatus(t, s.get(t, "/health"), http.StatusOK)
+	expectStatus(t, s.request(t, POST, "/user", User{Email: "ada@example.com"}), http.StatusCreated)
+
+	t.Setenv(RATE_LIMIT_ENV_VAR, "-1")
+	expectPanic(t, RATE_LIMIT_ENV_VAR+"=-1", func() { newRateLimiter() })
+}
+
+func TestClientIP(t *testing.T) {
+	t.Setenv(RATE_LIMIT_ENV_VAR, "")
+	t.Setenv(TRUSTED_ENV_VAR, "10.0.0.0/8, 192.168.1.1")
+	l := newRateLimiter()
+
+	for _, c := range []struct {
+		remote, forwarded, want string
+	}{
+		{"198.51.100.7:1234", "", "198.51.100.7"},
+		// untrusted peers can't speak for anyone else
+		{"198.51.100.7:1234", "203.0.113.9", "198.51.100.7"},
+		{"10.1.2.3:1234", "203.0.113.9", "203.0.113.9"},
+		// the right-most hop that isn't a trusted proxy is the client, what it was sent is forgeable
+		{"10.1.2.3:1234", "1.1.1.1, 203.0.113.9, 192.168.1.1", "203.0.113.9"},
+		{"192.168.1.1:1234", "10.0.0.2", "10.0.0.2"},
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+	} {
+		r := httptest.NewRequest(GET, "/image", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if got := l.clientIP(r); got != c.want {
+			t.Errorf("from %s forwarded for %q: got client %s, want %s", c.remote, c.forwarded, got, c.want)
+		}
+	}
+
+	t.Setenv(TRUSTED_ENV_VAR, "10.0.0.0/33")
+	expectPanic(t, TRUSTED_ENV_VAR+"=10.0.0.0/33", func() { trustedProxies() })
+}
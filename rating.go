@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	RATING_MIN_ENV_VAR = "RATING_MIN"
+	RATING_MAX_ENV_VAR = "RATING_MAX"
+	DEFAULT_RATING_MIN = 1
+	DEFAULT_RATING_MAX = 5
+)
+
+// ratingBound reads an integer bound from envVar, falling back to def if unset
+func ratingBound(envVar string, def rating) rating {
+	value := os.Getenv(envVar)
+	if value == "" {
+		return def
+	}
+	bound, err := strconv.Atoi(value)
+	if err != nil {
+		panic(fmt.Sprintf("environment variable %s must be an integer, got '%s'", envVar, value))
+	}
+	return rating(bound)
+}
+
+// ratingScale is the accepted range of ratings, both ends included
+type ratingScale struct {
+	min, max rating
+}
+
+// ratingRange returns the accepted rating scale, read from RATING_MIN and RATING_MAX
+func ratingRange() ratingScale {
+	min := ratingBound(RATING_MIN_ENV_VAR, DEFAULT_RATING_MIN)
+	max := ratingBound(RATING_MAX_ENV_VAR, DEFAULT_RATING_MAX)
+	if min > max {
+		panic(fmt.Sprintf("environment variable %s (%d) must not be greater than %s (%d)", RATING_MIN_ENV_VAR, min, RATING_MAX_ENV_VAR, max))
+	}
+	return ratingScale{min: min, max: max}
+}
+
+// contains reports whether value is on the scale
+func (s ratingScale) contains(value rating) bool {
+	return value >= s.min && value <= s.max
+}
+
+// fieldError is a validation failure of a single field of a request payload
+type fieldError struct {
+	field   string
+	message string
+}
+
+func (e *fieldError) Error() string {
+	return e.message
+}
+
+// fieldErrors are all the validation failures of a request payload, so clients can fix them in one go
+type fieldErrors []*fieldError
+
+func (errs fieldErrors) Error() string {
+	messages := make([]string, len(errs))
+	for n, err := range errs {
+		messages[n] = err.message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Validate checks the fields of a User payload, the email is always required, imageURL and rating only when asked for,
+// the rating having to be on scale, every field that fails is reported, as fieldErrors
+func (usr User) Validate(scale ratingScale, requireImageURL, requireRating bool) error {
+	var errs fieldErrors
+	if usr.Email == "" {
+		errs = append(errs, &fieldError{"email", "need field 'email' populated with a valid email as JSON in body request"})
+	} else if !validEmail(usr.Email) {
+		errs = append(errs, &fieldError{"email", "invalid email address"})
+	}
+	if requireImageURL {
+		if usr.ImageURL == "" {
+			errs = append(errs, &fieldError{"imageURL", "need field 'imageURL' populated with a valid image URL as JSON in body request"})
+		} else if _, err := normalizeImageURL(usr.ImageURL); err != nil {
+			errs = append(errs, &fieldError{"imageURL", err.Error()})
+		}
+	}
+	if requireRating && !scale.contains(rating(usr.Rating)) {
+		errs = append(errs, &fieldError{"rating", fmt.Sprintf("need field 'rating' populated with a valid integer rating %d-%d as JSON in body request", scale.min, scale.max)})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Validate checks both emails of a RenamedUser payload, reporting every field that fails as fieldErrors
+func (rename RenamedUser) Validate() error {
+	var errs fieldErrors
+	for _, field := range []struct{ name, email string }{{"email", rename.Email}, {"newEmail", rename.NewEmail}} {
+		if field.email == "" {
+			errs = append(errs, &fieldError{field.name, fmt.Sprintf("need field '%s' populated with a valid email as JSON in body request", field.name)})
+		} else if !validEmail(field.email) {
+			errs = append(errs, &fieldError{field.name, "invalid email address"})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// normalizeImageURL returns the canonical form of an image URL, used as the key of its ratings
+// http and https, the case of the host, default ports, fragments and trailing slashes don't tell images apart
+func normalizeImageURL(raw string) (imageURL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("field 'imageURL' must be an absolute http(s) URL, got '%s'", raw)
+	}
+	host := strings.ToLower(u.Hostname())
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+	u.Scheme = "https"
+	u.Host = host
+	u.User = nil
+	u.Fragment, u.RawFragment = "", ""
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return imageURL(u.String()), nil
+}
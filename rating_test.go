@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRatingScale(t *testing.T) {
+	s := newTestServer(t, RATING_MIN_ENV_VAR+"=1", RATING_MAX_ENV_VAR+"=10")
+	imageURL := stubImage("2024-01-01").Url
+	s.createUser(t, "ada@example.com")
+
+	if saved := s.saveRating(t, "ada@example.com", imageURL, 8); saved.Rating != 8 {
+		t.Errorf("got rating %d saved, want 8", saved.Rating)
+	}
+	for method, value := range map[string]int{POST: 11, PUT: 0} {
+		resp := s.request(t, method, "/rating", User{Email: "ada@example.com", ImageURL: imageURL, Rating: value})
+		expectStatus(t, resp, http.StatusBadRequest)
+		var body errorResponse
+		resp.decode(t, &body)
+		if len(body.Error.Fields) != 1 || body.Error.Fields[0].Field != "rating" || !strings.Contains(body.Error.Message, "1-10") {
+			t.Errorf("%s rating %d: got error %+v, want the rating field at fault, with the range", method, value, body.Error)
+		}
+	}
+	expectStatus(t, s.request(t, PUT, "/rating", User{Email: "ada@example.com", ImageURL: imageURL, Rating: 10}), http.StatusOK)
+	if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 1 || ratings[0].Rating != 10 {
+		t.Errorf("got ratings %+v, want the one rating updated to 10", ratings)
+	}
+}
+
+func TestRatingScaleDefault(t *testing.T) {
+	s := newTestServer(t, RATING_MIN_ENV_VAR+"=", RATING_MAX_ENV_VAR+"=")
+	s.createUser(t, "ada@example.com")
+	s.saveRating(t, "ada@example.com", stubImage("2024-01-01").Url, 5)
+	expectStatus(t, s.request(t, POST, "/rating", User{Email: "ada@example.com", ImageURL: stubImage("2024-01-02").Url, Rating: 6}), http.StatusBadRequest)
+
+	t.Setenv(RATING_MAX_ENV_VAR, "ten")
+	expectPanic(t, RATING_MAX_ENV_VAR+"=ten", func() { ratingRange() })
+	t.Setenv(RATING_MIN_ENV_VAR, "6")
+	t.Setenv(RATING_MAX_ENV_VAR, "5")
+	expectPanic(t, RATING_MIN_ENV_VAR+" above "+RATING_MAX_ENV_VAR, func() { ratingRange() })
+}
+
+func TestNormalizeImageURL(t *testing.T) {
+	const canonical = "https://apod.nasa.gov/apod/image/a.jpg"
+	for _, raw := range []string{
+		canonical,
+		"http://apod.nasa.gov/apod/image/a.jpg",
+		"https://APOD.NASA.gov/apod/image/a.jpg",
+		"https://apod.nasa.gov:443/apod/image/a.jpg",
+		"http://apod.nasa.gov:80/apod/image/a.jpg/",
+		" https://apod.nasa.gov/apod/image/a.jpg#top ",
+	} {
+		if got, err := normalizeImageURL(raw); err != nil || got != canonical {
+			t.Errorf("normalizing %q: got %q (%v), want %q", raw, got, err, canonical)
+		}
+	}
+	if got, _ := normalizeImageURL("https://apod.nasa.gov:8443/a.jpg?size=large"); got != "https://apod.nasa.gov:8443/a.jpg?size=large" {
+		t.Errorf("got %q, want other ports and the query kept", got)
+	}
+	for _, raw := range []string{"", "apod.nasa.gov/a.jpg", "/apod/image/a.jpg", "ftp://apod.nasa.gov/a.jpg", "https://"} {
+		if _, err := normalizeImageURL(raw); err == nil {
+			t.Errorf("normalizing %q: want an error", raw)
+		}
+	}
+}
+
+func TestEquivalentImageURLs(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "ada@example.com")
+	s.saveRating(t, "ada@example.com", "http://APOD.nasa.gov:80/apod/image/a.jpg/", 2)
+
+	expectStatus(t, s.request(t, POST, "/rating", User{Email: "ada@example.com", ImageURL: "https://apod.nasa.gov/apod/image/a.jpg", Rating: 4}), http.StatusConflict)
+	expectStatus(t, s.request(t, PUT, "/rating", User{Email: "ada@example.com", ImageURL: "https://apod.nasa.gov/apod/image/a.jpg#x", Rating: 4}), http.StatusOK)
+	ratings := s.ratingsOf(t, "ada@example.com")
+	if len(ratings) != 1 || ratings[0].ImageURL != "https://apod.nasa.gov/apod/image/a.jpg" || ratings[0].Rating != 4 {
+		t.Errorf("got ratings %+v, want a single rating of 4 under the canonical URL", ratings)
+	}
+	expectStatus(t, s.request(t, DELETE, "/rating", User{Email: "ada@example.com", ImageURL: "https://apod.NASA.gov:443/apod/image/a.jpg"}), http.StatusNoContent)
+	if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 0 {
+		t.Errorf("got ratings %+v after deleting, want none", ratings)
+	}
+
+	resp := s.request(t, POST, "/rating", User{Email: "ada@example.com", ImageURL: "apod.nasa.gov/a.jpg", Rating: 4})
+	expectStatus(t, resp, http.StatusBadRequest)
+}
+
+func TestUserValidate(t *testing.T) {
+	scale := ratingScale{min: 1, max: 5}
+	const email, imageURL = "ada@example.com", "https://apod.nasa.gov/apod/image/a.jpg"
+	for _, c := range []struct {
+		usr                            User
+		requireImageURL, requireRating bool
+		want                           []string
+	}{
+		{User{Email: email}, false, false, nil},
+		{User{}, false, false, []string{"email"}},
+		{User{Email: "ada"}, false, false, []string{"email"}},
+		// fields that aren't asked for aren't checked
+		{User{Email: email, ImageURL: "nope", Rating: 9}, false, false, nil},
+		{User{Email: email, ImageURL: imageURL}, true, false, nil},
+		{User{Email: email}, true, false, []string{"imageURL"}},
+		{User{Email: email, ImageURL: "nope"}, true, false, []string{"imageURL"}},
+		{User{Email: email, ImageURL: imageURL, Rating: 5}, true, true, nil},
+		{User{Email: email, ImageURL: imageURL, Rating: 0}, true, true, []string{"rating"}},
+		{User{Email: email, ImageURL: imageURL, Rating: 6}, true, true, []string{"rating"}},
+		{User{Email: "ada", Rating: 6}, true, true, []string{"email", "imageURL", "rating"}},
+	} {
+		err := c.usr.Validate(scale, c.requireImageURL, c.requireRating)
+		var got []string
+		if err != nil {
+			errs, ok := err.(fieldErrors)
+			if !ok {
+				t.Fatalf("%+v: got %T, want fieldErrors", c.usr, err)
+			}
+			for _, fieldErr := range errs {
+				got = append(got, fieldErr.field)
+			}
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%+v requiring imageURL %v and rating %v: got errors on %v, want %v", c.usr, c.requireImageURL, c.requireRating, got, c.want)
+		}
+	}
+}
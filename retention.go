@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	RATING_TTL_ENV_VAR = "RATING_TTL_SECONDS"
+	SWEEP_ENV_VAR      = "RATING_SWEEP_SECONDS"
+	DEFAULT_SWEEP      = time.Hour
+)
+
+// secondsEnv reads a positive number of seconds from the environment variable name, or returns fallback if unset
+func secondsEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		panic(fmt.Sprintf("environment variable %s must be a positive integer, got '%s'", name, value))
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// ratingTTL returns how long a rating is kept after it was last saved or updated, read from RATING_TTL_SECONDS
+// zero, the default, keeps ratings forever
+func ratingTTL() time.Duration {
+	return secondsEnv(RATING_TTL_ENV_VAR, 0)
+}
+
+// sweepInterval returns how often expired ratings are deleted, read from RATING_SWEEP_SECONDS
+func sweepInterval() time.Duration {
+	return secondsEnv(SWEEP_ENV_VAR, DEFAULT_SWEEP)
+}
+
+// startSweeper deletes the ratings of storage older than ttl every interval, in the background
+// it returns a function stopping the sweeper, which waits for a sweep in progress to finish
+func startSweeper(storage Storage, ttl, interval time.Duration) func() {
+	if ttl == 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				swept, err := storage.SweepRatings(time.Now().Add(-ttl))
+				if err != nil {
+					slog.Error("sweeping expired ratings", "error", err)
+					continue
+				}
+				if swept > 0 {
+					slog.Info("swept expired ratings", "count", swept, "ttl", ttl)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
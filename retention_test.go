@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSweepRatings(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		old, fresh := stubImage("2024-01-01").Url, stubImage("2024-01-02").Url
+		s.createUser(t, "ada@example.com")
+		s.saveRating(t, "ada@example.com", old, 4)
+		time.Sleep(10 * time.Millisecond)
+		cutoff := time.Now()
+		time.Sleep(10 * time.Millisecond)
+		s.saveRating(t, "ada@example.com", fresh, 4)
+
+		swept, err := s.storage.SweepRatings(cutoff)
+		if err != nil || swept != 1 {
+			t.Fatalf("got %d ratings swept (%v), want 1", swept, err)
+		}
+		if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 1 || ratings[0].ImageURL != fresh {
+			t.Errorf("got ratings %+v, want only the one saved after the cutoff", ratings)
+		}
+	})
+}
+
+func TestSweeper(t *testing.T) {
+	s := newTestServer(t)
+	old, fresh := stubImage("2024-01-01").Url, stubImage("2024-01-02").Url
+	s.createUser(t, "ada@example.com")
+	s.saveRating(t, "ada@example.com", old, 4)
+	time.Sleep(250 * time.Millisecond)
+	s.saveRating(t, "ada@example.com", fresh, 4)
+
+	stop := startSweeper(s.storage, 200*time.Millisecond, 20*time.Millisecond)
+	deadline := time.Now().Add(150 * time.Millisecond)
+	for len(s.ratingsOf(t, "ada@example.com")) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 1 || ratings[0].ImageURL != fresh {
+		t.Errorf("got ratings %+v, want only the one younger than the TTL", ratings)
+	}
+
+	// once stopped, nothing more is swept
+	time.Sleep(250 * time.Millisecond)
+	if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 1 {
+		t.Errorf("got ratings %+v, want the stopped sweeper to leave them alone", ratings)
+	}
+	// without a TTL no sweeper is started, stopping it returns right away
+	startSweeper(s.storage, 0, time.Millisecond)()
+	t.Setenv(RATING_TTL_ENV_VAR, "-5")
+	expectPanic(t, RATING_TTL_ENV_VAR+"=-5", func() { ratingTTL() })
+}
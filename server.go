@@ -1,23 +1,87 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
 const (
-	BASE_URL         = "https://api.nasa.gov/planetary/apod?api_key="
-	COUNT_PARAM      = "count=1"
+	BASE_URL         = "https://api.nasa.gov/planetary/apod"
+	BASE_URL_ENV_VAR = "NASA_API_BASE_URL"
+	API_KEY_PARAM    = "api_key"
+	COUNT_PARAM      = "count"
+	MAX_COUNT        = 50
+	START_DATE_PARAM = "start_date"
+	END_DATE_PARAM   = "end_date"
+	MAX_RANGE_DAYS   = 100
+	THUMBS_PARAM     = "thumbs=true"
+	DATE_PARAM       = "date"
+	DATES_PARAM      = "dates"
+	DATES_WORKERS    = 4
+	CONCEPT_TAGS     = "concept_tags"
+	URL_PARAM        = "url"
+	EMAIL_PARAM      = "email"
+	LIMIT_PARAM      = "limit"
+	OFFSET_PARAM     = "offset"
+	UPSERT_PARAM     = "upsert"
+	OVERWRITE_PARAM  = "overwrite"
+	CASCADE_PARAM    = "cascade"
+	SORT_PARAM       = "sort"
+	SORT_BY_RATING   = "rating"
+	SORT_BY_RECENT   = "recent"
+	DEFAULT_TOP      = 10
+	MIN_PARAM        = "min"
+	DEFAULT_FAVORITE = 4
+	DATE_LAYOUT      = "2006-01-02"
+	FIRST_APOD_DATE  = "1995-06-16"
 	API_KEY_ENV_VAR  = "NASA_API_KEY"
+	DEMO_KEY         = "DEMO_KEY"
+	DEMO_KEY_ENV_VAR = "ALLOW_DEMO_KEY"
+	MODE_ENV_VAR     = "IMAGE_DEFAULT_MODE"
+	STRICT_ENV_VAR   = "STRICT_GET_CONTENT_TYPE"
+	MODE_RANDOM      = "random"
+	MODE_TODAY       = "today"
+	USERS_ENV_VAR    = "MAX_USERS"
+	RATINGS_ENV_VAR  = "MAX_RATINGS_PER_USER"
+	TIMEOUT_ENV_VAR  = "NASA_HTTP_TIMEOUT_SECONDS"
+	DEFAULT_TIMEOUT  = 10 * time.Second
+	SHUTDOWN_TIMEOUT = 15 * time.Second
+	READ_ENV_VAR     = "SERVER_READ_TIMEOUT_SECONDS"
+	WRITE_ENV_VAR    = "SERVER_WRITE_TIMEOUT_SECONDS"
+	IDLE_ENV_VAR     = "SERVER_IDLE_TIMEOUT_SECONDS"
+	DEFAULT_READ     = 15 * time.Second
+	DEFAULT_WRITE    = 30 * time.Second
+	DEFAULT_IDLE     = 120 * time.Second
+	ADDR_ENV_VAR     = "LISTEN_ADDR"
+	DEFAULT_ADDR     = ":8080"
 	GET              = "GET"
 	POST             = "POST"
 	PUT              = "PUT"
 	DELETE           = "DELETE"
 	CONTENT_TYPE     = "content-type"
 	APPLICATION_JSON = "application/json"
+	RATELIMIT_HEADER = "X-RateLimit-Remaining"
 )
 
 type rating int
@@ -25,35 +89,155 @@ type userEmail string
 type imageURL string
 
 type imageStore struct {
-	sync.Mutex
-	url   string
-	store map[imageURL]Image
-}
+	baseURL     string
+	keys        *apiKeys
+	client      *http.Client
+	proxyClient *http.Client
+	slots       chan struct{}
+	maxAttempts int
+	deadline    time.Duration
+	defaultMode string
+	cache       *dailyCache
+	webhook     *webhook
+	zone        *time.Location
+	inflight    singleflight.Group
+	storage     Storage
+
+	randomLock sync.Mutex
+	random     *rand.Rand
 
-type user struct {
-	sync.Mutex
-	store map[imageURL]rating
+	probeEvery time.Duration
+	probeLock  sync.Mutex
+	probe      *UpstreamHealth
+	// probing is closed once the probe under way, if any, is done
+	probing chan struct{}
 }
 
 type users struct {
-	sync.Mutex
-	store map[userEmail]user
+	storage    Storage
+	maxUsers   int
+	maxRatings int
+	scale      ratingScale
+	strictGets bool
 }
 
-
 // for JSON marshal/unmarshal
 type Image struct {
-	Date        string `json:"date"`
-	Explanation string `json:"explanation"`
-	Title       string `json:"title"`
-	Url         string `json:"url"`
+	Date         string   `json:"date"`
+	Explanation  string   `json:"explanation"`
+	Title        string   `json:"title"`
+	Url          string   `json:"url"`
+	MediaType    string   `json:"media_type"`
+	ThumbnailURL string   `json:"thumbnail_url"`
+	Copyright    string   `json:"copyright,omitempty"`
+	HDUrl        string   `json:"hdurl,omitempty"`
+	ConceptTags  []string `json:"concept_tags,omitempty"`
 }
 
 type Images []struct {
-	Date        string `json:"date"`
-	Explanation string `json:"explanation"`
-	Title       string `json:"title"`
-	Url         string `json:"url"`
+	Date         string   `json:"date"`
+	Explanation  string   `json:"explanation"`
+	Title        string   `json:"title"`
+	Url          string   `json:"url"`
+	MediaType    string   `json:"media_type"`
+	ThumbnailURL string   `json:"thumbnail_url"`
+	Copyright    string   `json:"copyright,omitempty"`
+	HDUrl        string   `json:"hdurl,omitempty"`
+	ConceptTags  []string `json:"concept_tags,omitempty"`
+}
+
+// an Image as returned by /image, along with fields derived from it
+type ImageResponse struct {
+	Image
+	IsVideo bool `json:"isVideo"`
+	Year    int  `json:"year,omitempty"`
+	Month   int  `json:"month,omitempty"`
+	Day     int  `json:"day,omitempty"`
+}
+
+// DeletedUser is returned by DELETE /user, with how many ratings were deleted along with the user
+type DeletedUser struct {
+	Email          string `json:"email"`
+	RatingsDeleted int    `json:"ratingsDeleted"`
+}
+
+// RenamedUser is the body of PUT /user, and what it returns, the email the user had and the one they have now
+type RenamedUser struct {
+	Email    string `json:"email"`
+	NewEmail string `json:"newEmail"`
+}
+
+// DateError reports why the image of one of several requested dates couldn't be fetched
+type DateError struct {
+	Date  string `json:"date"`
+	Error string `json:"error"`
+}
+
+type DatesResult struct {
+	Images []ImageResponse `json:"images"`
+	Errors []DateError     `json:"errors,omitempty"`
+}
+
+type Health struct {
+	Status string `json:"status"`
+	Uptime string `json:"uptime"`
+}
+
+type UserProfile struct {
+	Email       string `json:"email"`
+	RatingCount int    `json:"ratingCount"`
+}
+
+type RatingStats struct {
+	Count   int      `json:"count"`
+	Average *float64 `json:"average"`
+	Min     *int     `json:"min"`
+	Max     *int     `json:"max"`
+}
+
+type ImageRating struct {
+	ImageURL string `json:"imageURL"`
+	Rating   int    `json:"rating"`
+}
+
+// RatingEntry is a rating listed by GET /rating, along with when it was first saved and last updated
+type RatingEntry struct {
+	ImageURL  string    `json:"imageURL"`
+	Rating    int       `json:"rating"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type ImageRaters struct {
+	ImageURL string   `json:"imageURL"`
+	Raters   int      `json:"raters"`
+	Average  *float64 `json:"average"`
+}
+
+type BulkRatings struct {
+	Email   string        `json:"email"`
+	Ratings []ImageRating `json:"ratings"`
+}
+
+type BulkResult struct {
+	ImageURL string `json:"imageURL"`
+	Rating   int    `json:"rating"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+type TopImage struct {
+	ImageURL string  `json:"imageURL"`
+	Average  float64 `json:"average"`
+	Count    int     `json:"count"`
+	Image    *Image  `json:"image,omitempty"`
+}
+
+// Favorite is a rating listed by GET /rating/favorites, along with the stored image when it was fetched before
+type Favorite struct {
+	ImageURL string `json:"imageURL"`
+	Rating   int    `json:"rating"`
+	Image    *Image `json:"image,omitempty"`
 }
 
 type User struct {
@@ -62,150 +246,1049 @@ type User struct {
 	Rating   int    `json:"rating"`
 }
 
-// newImageStore instantiates imageStore and returns a pointer to it
-func newImageStore() *imageStore {
-	apiKey := os.Getenv(API_KEY_ENV_VAR)
-	if apiKey == "" {
-		panic("required environment variable NASA_API_KEY not set")
+// errorBody describes an error, code being a stable machine readable identifier and message meant for humans
+type errorBody struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError is a field of a request payload that failed validation, listed in the 'fields' of a 400 error
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// errorResponse is the JSON body returned alongside non-2xx statuses
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+// writeJSONError responds with the given status and a {"error": {"code": ..., "message": ...}} body
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: errorBody{Code: code, Message: message}})
+}
+
+// errorCode derives an error code from status, e.g. "not_found" for a 404
+func errorCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// writeError is writeJSONError with the code derived from status
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSONError(w, status, errorCode(status), msg)
+}
+
+// strictGetContentType reports whether STRICT_GET_CONTENT_TYPE is set, false by default
+// since many HTTP clients send no content-type on a GET, even with a body
+func strictGetContentType() bool {
+	strict := os.Getenv(STRICT_ENV_VAR)
+	if strict == "" {
+		return false
+	}
+	on, err := strconv.ParseBool(strict)
+	if err != nil {
+		panic(fmt.Sprintf("environment variable %s must be a boolean, got '%s'", STRICT_ENV_VAR, strict))
+	}
+	return on
+}
+
+// writeValidationError responds 400 to a payload that failed validation, listing each field at fault in 'fields'
+// along with a message joining them all
+func writeValidationError(w http.ResponseWriter, err error) {
+	var fields []FieldError
+	var errs fieldErrors
+	var single *fieldError
+	switch {
+	case errors.As(err, &errs):
+		for _, e := range errs {
+			fields = append(fields, FieldError{Field: e.field, Message: e.message})
+		}
+	case errors.As(err, &single):
+		fields = []FieldError{{Field: single.field, Message: single.message}}
+	}
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(errorResponse{Error: errorBody{Code: errorCode(http.StatusBadRequest), Message: err.Error(), Fields: fields}})
+}
+
+// requireJSON responds 415 unless the request declares a JSON body, reporting whether the handler can go on
+func requireJSON(w http.ResponseWriter, r *http.Request) bool {
+	if ct := r.Header.Get(CONTENT_TYPE); ct != APPLICATION_JSON {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("need content-type 'application/json', but got '%s' instead", ct))
+		return false
+	}
+	return true
+}
+
+// writeImages responds 200 with v as JSON, tagged with an ETag derived from the body
+// if the request's If-None-Match already carries that ETag, it responds 304 with no body instead
+// the images are narrowed down to the 'fields' query param, which the handler must already have validated
+// an Accept header preferring text/html or text/plain gets v rendered as an HTML page or a plain text summary instead, with every field
+func writeImages(w http.ResponseWriter, r *http.Request, v interface{}) {
+	mediaType := negotiate(r.Header.Get("Accept"))
+	var body []byte
+	var err error
+	if mediaType == APPLICATION_JSON {
+		fields, _ := parseFields(r)
+		body, err = json.Marshal(projectImages(v, fields))
+		body = append(body, '\n')
+	} else {
+		body, err = renderImages(v, mediaType)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to encode image")
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if mediaType == APPLICATION_JSON {
+		w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
 	} else {
-		url := BASE_URL + apiKey + "&" + COUNT_PARAM
-		return &imageStore{
-			url:   url,
-			store: map[imageURL]Image{},
+		w.Header().Set(CONTENT_TYPE, mediaType+"; charset=utf-8")
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// enrich wraps image with its derived fields, the date ones are left out if the date doesn't parse
+func enrich(image Image) ImageResponse {
+	resp := ImageResponse{Image: image, IsVideo: image.MediaType == "video"}
+	if date, err := time.Parse(DATE_LAYOUT, image.Date); err == nil {
+		resp.Year, resp.Month, resp.Day = date.Year(), int(date.Month()), date.Day()
+	}
+	return resp
+}
+
+// enrichAll is enrich for a list of images
+func enrichAll(images []Image) []ImageResponse {
+	resps := make([]ImageResponse, 0, len(images))
+	for _, image := range images {
+		resps = append(resps, enrich(image))
+	}
+	return resps
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, comparing weakly as RFC 9110 requires
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
 		}
 	}
+	return false
+}
+
+// validEmail reports whether email is a bare address such as "user@mail.com"
+// surrounding whitespace is ignored, display names are rejected
+func validEmail(email string) bool {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// normalizeEmail returns the key a user is stored under, so "User@Mail.com " and "user@mail.com" are the same user
+// it is also the email returned in responses
+func normalizeEmail(email string) userEmail {
+	return userEmail(strings.ToLower(strings.TrimSpace(email)))
+}
+
+// storageErrorStatus maps the typed errors returned by Storage to HTTP status codes
+func storageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrImageNotFound), errors.Is(err, ErrRatingNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrUserExists), errors.Is(err, ErrRatingExists), errors.Is(err, ErrImageExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrUserLimit), errors.Is(err, ErrRatingLimit):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// methodNotAllowed responds with a 405, listing the methods the endpoint supports in the Allow header
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// writeStorageError responds with the status matching an error returned by Storage
+// unexpected errors are logged and hidden behind a generic 500
+func writeStorageError(w http.ResponseWriter, err error) {
+	status := storageErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		slog.Error("storage", "error", err)
+		writeError(w, status, "internal storage error")
+		return
+	}
+	writeError(w, status, err.Error())
+}
+
+// decodeBody decodes the JSON body of r into v, rejecting fields v doesn't have
+func decodeBody(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// writeBodyError reports a request body that failed to decode, with a 413 if it was over MAX_BODY_BYTES
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must not be larger than %d bytes", tooLarge.Limit))
+		return
+	}
+	// encoding/json has no typed error for unknown fields, only this message
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown field %s in JSON body", field))
+		return
+	}
+	writeError(w, http.StatusBadRequest, "invalid JSON body")
 }
 
-// newUser instantiates and returns a new user
-func newUser() user {
-	return user{
-		store: map[imageURL]rating{},
+// decodeUser decodes the request body into a User and checks its fields with Validate
+// on failure it writes a 400 (or 413) response and returns false
+func (u *users) decodeUser(w http.ResponseWriter, r *http.Request, requireImageURL, requireRating bool) (User, bool) {
+	var usr User
+	if err := decodeBody(r, &usr); err != nil {
+		writeBodyError(w, err)
+		return usr, false
+	}
+	if err := usr.Validate(u.scale, requireImageURL, requireRating); err != nil {
+		writeValidationError(w, err)
+		return usr, false
 	}
+	return usr, true
 }
 
-// newUsers instantiates users and returns a pointer to it
-func newUsers() *users {
+// requestEmail reads the user's email from the 'email' query param, falling back to the JSON body
+// a GET's body is read whatever its content-type, unless STRICT_GET_CONTENT_TYPE is set, any other method's must be JSON
+// on failure it writes a 400 (or 415) response and returns false
+func (u *users) requestEmail(w http.ResponseWriter, r *http.Request) (userEmail, bool) {
+	if email := r.URL.Query().Get(EMAIL_PARAM); email != "" {
+		if !validEmail(email) {
+			writeError(w, http.StatusBadRequest, "invalid email address")
+			return "", false
+		}
+		return normalizeEmail(email), true
+	}
+
+	if (r.Method != GET || u.strictGets) && !requireJSON(w, r) {
+		return "", false
+	}
+	var usr User
+	err := decodeBody(r, &usr)
+	if err == io.EOF || (err == nil && usr.Email == "") {
+		writeError(w, http.StatusBadRequest, "need query param 'email', or field 'email' populated with a valid email as JSON in body request")
+		return "", false
+	}
+	if err != nil {
+		writeBodyError(w, err)
+		return "", false
+	}
+	if !validEmail(usr.Email) {
+		writeError(w, http.StatusBadRequest, "invalid email address")
+		return "", false
+	}
+	return normalizeEmail(usr.Email), true
+}
+
+// newImageStore instantiates imageStore, backed by storage, and returns a pointer to it
+// calls to NASA rotate among the keys in NASA_API_KEYS, or else use NASA_API_KEY alone
+// without either it falls back to NASA's shared DEMO_KEY if ALLOW_DEMO_KEY is set,
+// or else leaves keys nil, so calls to NASA fail with a 503
+func newImageStore(storage Storage) *imageStore {
+	baseURL := os.Getenv(BASE_URL_ENV_VAR)
+	if baseURL == "" {
+		baseURL = BASE_URL
+	}
+	// checks the base URL even when there is no key to use it with
+	upstreamURL(baseURL, "")
+	// without a key the server still starts, but every call to NASA fails with a 503
+	keys := configuredKeys()
+	if len(keys) == 0 && allowDemoKey() {
+		slog.Warn("environment variable " + API_KEY_ENV_VAR + " not set, falling back to " + DEMO_KEY + ", which NASA limits to 30 requests per hour and 50 per day per IP")
+		keys = []string{DEMO_KEY}
+	}
+	if len(keys) == 0 {
+		slog.Warn("environment variable " + API_KEY_ENV_VAR + " not set, fetching images from NASA is disabled")
+	}
+	timeout := upstreamTimeout()
+	zone := apodTimezone()
+	return &imageStore{
+		baseURL:     baseURL,
+		keys:        newAPIKeys(baseURL, keys),
+		client:      &http.Client{Timeout: timeout},
+		proxyClient: newProxyClient(timeout),
+		slots:       make(chan struct{}, upstreamConcurrency()),
+		maxAttempts: maxAttempts(),
+		deadline:    upstreamDeadline(),
+		defaultMode: imageDefaultMode(),
+		cache:       newDailyCache(zone),
+		webhook:     newWebhook(),
+		zone:        zone,
+		probeEvery:  probeInterval(),
+		storage:     storage,
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// imageDefaultMode returns what GET /image returns without query params, read from IMAGE_DEFAULT_MODE
+// "random" (the default) picks a random image, "today" returns the current APOD
+func imageDefaultMode() string {
+	switch mode := os.Getenv(MODE_ENV_VAR); mode {
+	case "":
+		return MODE_RANDOM
+	case MODE_RANDOM, MODE_TODAY:
+		return mode
+	default:
+		panic(fmt.Sprintf("environment variable %s must be '%s' or '%s', got '%s'", MODE_ENV_VAR, MODE_RANDOM, MODE_TODAY, mode))
+	}
+}
+
+// allowDemoKey reports whether ALLOW_DEMO_KEY permits falling back to NASA's DEMO_KEY
+func allowDemoKey() bool {
+	allow := os.Getenv(DEMO_KEY_ENV_VAR)
+	if allow == "" {
+		return false
+	}
+	on, err := strconv.ParseBool(allow)
+	if err != nil {
+		panic(fmt.Sprintf("environment variable %s must be a boolean, got '%s'", DEMO_KEY_ENV_VAR, allow))
+	}
+	return on
+}
+
+// upstreamURL composes the APOD URL for the given base and API key, to which further params are appended with '&'
+func upstreamURL(baseURL, apiKey string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		panic(fmt.Sprintf("environment variable %s must be an absolute URL, got '%s'", BASE_URL_ENV_VAR, baseURL))
+	}
+	query := u.Query()
+	query.Set(API_KEY_PARAM, apiKey)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// upstreamTimeout returns the timeout for NASA API calls, read from NASA_HTTP_TIMEOUT_SECONDS if set
+func upstreamTimeout() time.Duration {
+	timeout := os.Getenv(TIMEOUT_ENV_VAR)
+	if timeout == "" {
+		return DEFAULT_TIMEOUT
+	}
+	seconds, err := strconv.Atoi(timeout)
+	if err != nil || seconds <= 0 {
+		panic(fmt.Sprintf("environment variable %s must be a positive integer, got '%s'", TIMEOUT_ENV_VAR, timeout))
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// limitEnv reads a limit from the environment variable name, 0 meaning no limit (the default)
+func limitEnv(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		panic(fmt.Sprintf("environment variable %s must be a non-negative integer, got '%s'", name, value))
+	}
+	return n
+}
+
+// maxUsers returns how many users can be created, read from MAX_USERS
+func maxUsers() int {
+	return limitEnv(USERS_ENV_VAR)
+}
+
+// maxRatingsPerUser returns how many images each user can rate, read from MAX_RATINGS_PER_USER
+func maxRatingsPerUser() int {
+	return limitEnv(RATINGS_ENV_VAR)
+}
+
+// newUsers instantiates users, backed by storage, and returns a pointer to it
+func newUsers(storage Storage) *users {
 	return &users{
-		store: map[userEmail]user{},
+		storage:    storage,
+		maxUsers:   maxUsers(),
+		maxRatings: maxRatingsPerUser(),
+		scale:      ratingRange(),
+		strictGets: strictGetContentType(),
+	}
+}
+
+// today returns today's APOD date, in APOD_TIMEZONE
+func (i *imageStore) today() string {
+	return apodDate(time.Now(), i.zone)
+}
+
+// parseAPODDate parses a YYYY-MM-DD date and checks that it falls between the first APOD and today, a YYYY-MM-DD date too
+func parseAPODDate(s, today string) (time.Time, error) {
+	date, err := time.Parse(DATE_LAYOUT, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("date '%s' must be formatted as YYYY-MM-DD", s)
+	}
+	first, _ := time.Parse(DATE_LAYOUT, FIRST_APOD_DATE)
+	last, _ := time.Parse(DATE_LAYOUT, today)
+	if date.Before(first) || date.After(last) {
+		return time.Time{}, fmt.Errorf("date '%s' must be between %s and today", s, FIRST_APOD_DATE)
+	}
+	return date, nil
+}
+
+// parseCount parses the 'count' query param, a number of random images between 1 and MAX_COUNT
+func parseCount(s string) (int, error) {
+	count, err := strconv.Atoi(s)
+	if err != nil || count < 1 || count > MAX_COUNT {
+		return 0, fmt.Errorf("query param '%s' must be an integer between 1 and %d, got '%s'", COUNT_PARAM, MAX_COUNT, s)
+	}
+	return count, nil
+}
+
+// parseDateRange parses the 'start_date' and 'end_date' query params into upstream params
+// the range must be in order and span at most MAX_RANGE_DAYS days
+func parseDateRange(startDate, endDate, today string) (string, error) {
+	if startDate == "" || endDate == "" {
+		return "", fmt.Errorf("query params '%s' and '%s' must be used together", START_DATE_PARAM, END_DATE_PARAM)
+	}
+	start, err := parseAPODDate(startDate, today)
+	if err != nil {
+		return "", err
 	}
+	end, err := parseAPODDate(endDate, today)
+	if err != nil {
+		return "", err
+	}
+	if end.Before(start) {
+		return "", fmt.Errorf("'%s' %s must not be after '%s' %s", START_DATE_PARAM, startDate, END_DATE_PARAM, endDate)
+	}
+	if days := int(end.Sub(start).Hours()/24) + 1; days > MAX_RANGE_DAYS {
+		return "", fmt.Errorf("date range spans %d days, but at most %d are allowed", days, MAX_RANGE_DAYS)
+	}
+	return START_DATE_PARAM + "=" + startDate + "&" + END_DATE_PARAM + "=" + endDate, nil
+}
+
+// parseDates parses the comma separated 'dates' query param, dropping duplicates, into at most MAX_COUNT dates
+func parseDates(s, today string) ([]string, error) {
+	var dates []string
+	seen := map[string]bool{}
+	for _, date := range strings.Split(s, ",") {
+		date = strings.TrimSpace(date)
+		if seen[date] {
+			continue
+		}
+		if _, err := parseAPODDate(date, today); err != nil {
+			return nil, err
+		}
+		seen[date] = true
+		dates = append(dates, date)
+	}
+	if len(dates) > MAX_COUNT {
+		return nil, fmt.Errorf("query param '%s' can hold at most %d dates, got %d", DATES_PARAM, MAX_COUNT, len(dates))
+	}
+	return dates, nil
 }
 
 // imageHandler is responsible for requests sent to the /image endpoint
-// it fetches an image from NASA's APOD API, stores it locally, and returns it via response
+// it fetches an image from NASA's APOD API, random or today's depending on IMAGE_DEFAULT_MODE, stores it locally, and returns it via response
+// an optional 'date' query param selects that day's image instead
+// an optional 'count' query param fetches that many random images, returned as an array
+// optional 'start_date' and 'end_date' query params fetch every image in that range, returned as an array
+// an optional 'dates' query param fetches the images of several comma separated dates, returned with any per-date errors
+// a 'url' query param returns a previously stored image instead of calling NASA
+// a POST stores the image in its body instead, see createImage, and a DELETE removes a stored one, see deleteImage
 func (i *imageStore) imageHandler(w http.ResponseWriter, r *http.Request) {
-	resp, err := http.Get(i.url)
+	switch r.Method {
+	case GET:
+	case POST:
+		i.createImage(w, r)
+		return
+	case DELETE:
+		i.deleteImage(w, r)
+		return
+	default:
+		methodNotAllowed(w, GET, POST, DELETE)
+		return
+	}
+	if _, err := parseFields(r); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get(URL_PARAM) != "" {
+		i.getImage(w, r)
+		return
+	}
+
+	params := COUNT_PARAM + "=1"
+	date, count := query.Get(DATE_PARAM), query.Get(COUNT_PARAM)
+	startDate, endDate := query.Get(START_DATE_PARAM), query.Get(END_DATE_PARAM)
+	dates := query.Get(DATES_PARAM)
+	isRange := startDate != "" || endDate != ""
+	modes := 0
+	for _, set := range []bool{date != "", count != "", isRange, dates != ""} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("only one of query params '%s', '%s', '%s' or '%s'/'%s' can be used", DATE_PARAM, DATES_PARAM, COUNT_PARAM, START_DATE_PARAM, END_DATE_PARAM))
+		return
+	}
+	tags := false
+	if t := query.Get(CONCEPT_TAGS); t != "" {
+		var err error
+		if tags, err = strconv.ParseBool(t); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("query param '%s' must be a boolean, got '%s'", CONCEPT_TAGS, t))
+			return
+		}
+	}
+	if dates != "" {
+		i.imagesByDates(w, r, dates, tags)
+		return
+	}
+	// today is reckoned in APOD_TIMEZONE, which lets the current APOD be cached and shared like any other date
+	if modes == 0 && i.defaultMode == MODE_TODAY {
+		date = i.today()
+	}
+	if date != "" {
+		if _, err := parseAPODDate(date, i.today()); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		params = DATE_PARAM + "=" + date
+
+		// cached images may have been fetched without their tags
+		if i.cache != nil && !tags {
+			if image, ok := i.cache.get(date); ok {
+				writeImages(w, r, enrich(image))
+				return
+			}
+		}
+	}
+	if count != "" {
+		n, err := parseCount(count)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		params = COUNT_PARAM + "=" + strconv.Itoa(n)
+	}
+	if isRange {
+		rangeParams, err := parseDateRange(startDate, endDate, i.today())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		params = rangeParams
+	}
+	if tags {
+		params = withConceptTags(params)
+	}
+
+	// random images differ on every call, only dated queries can share a fetch
+	fetch := i.fetchImages
+	if date != "" || isRange {
+		fetch = i.fetchShared
+	}
+	// the deadline spans every attempt, while canceling the request still aborts the call right away
+	ctx, cancel := context.WithTimeout(r.Context(), i.deadline)
+	defer cancel()
+	images, err := fetch(ctx, params)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "fetching NASA image: %v\n", err)
-		os.Exit(1)
+		writeUpstreamError(w, r, err)
+		return
 	}
-	defer resp.Body.Close()
 
-	var images Images
-	// API returns a JSON array, even though we're only querying for 1 image
-	if err := json.NewDecoder(resp.Body).Decode(&images); err != nil {
-		panic(err)
+	// store images in "db"
+	for _, image := range images {
+		if err := i.saveFetched(image); err != nil {
+			slog.ErrorContext(r.Context(), "storing NASA image", "image_url", image.Url, "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to store image")
+			return
+		}
+	}
+	if date != "" && i.cache != nil {
+		i.cache.put(date, images[0])
+	}
+
+	if count != "" || isRange {
+		writeImages(w, r, enrichAll(images))
+	} else {
+		writeImages(w, r, enrich(images[0]))
+	}
+}
+
+// saveFetched stores an image fetched from NASA, replacing any stored copy
+// an image that wasn't stored yet is posted to IMAGE_WEBHOOK_URL
+func (i *imageStore) saveFetched(image Image) error {
+	err := i.storage.CreateImage(image)
+	if errors.Is(err, ErrImageExists) {
+		return i.storage.SaveImage(image)
+	}
+	if err == nil {
+		i.webhook.notify(image)
+	}
+	return err
+}
+
+// withConceptTags adds the upstream param asking NASA for the concept tags of each image to params
+// only older versions of the APOD API return them, images from the others simply come without
+func withConceptTags(params string) string {
+	return params + "&" + CONCEPT_TAGS + "=true"
+}
+
+// imageByDate returns the image of date, from the cache if possible, otherwise fetched from NASA and stored
+// if tags is set, the concept tags are asked for and the cache is skipped
+func (i *imageStore) imageByDate(ctx context.Context, date string, tags bool) (Image, error) {
+	params := DATE_PARAM + "=" + date
+	if tags {
+		params = withConceptTags(params)
+	} else if i.cache != nil {
+		if image, ok := i.cache.get(date); ok {
+			return image, nil
+		}
+	}
+	images, err := i.fetchShared(ctx, params)
+	if err != nil {
+		return Image{}, err
+	}
+	if err := i.saveFetched(images[0]); err != nil {
+		return Image{}, fmt.Errorf("storing image %s: %w", images[0].Url, err)
+	}
+	if i.cache != nil {
+		i.cache.put(date, images[0])
+	}
+	return images[0], nil
+}
+
+// imagesByDates fetches the image of each of the comma separated dates, at most DATES_WORKERS at a time
+// images that were fetched are returned in the order of dates, along with an error for each date that failed
+// the request only fails if every date did
+func (i *imageStore) imagesByDates(w http.ResponseWriter, r *http.Request, param string, tags bool) {
+	dates, err := parseDates(param, i.today())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the deadline covers the whole batch
+	ctx, cancel := context.WithTimeout(r.Context(), i.deadline)
+	defer cancel()
+	images := make([]Image, len(dates))
+	errs := make([]error, len(dates))
+	sem := make(chan struct{}, DATES_WORKERS)
+	var wg sync.WaitGroup
+	for n, date := range dates {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(n int, date string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			images[n], errs[n] = i.imageByDate(ctx, date, tags)
+		}(n, date)
+	}
+	wg.Wait()
+
+	result := DatesResult{Images: []ImageResponse{}}
+	for n, date := range dates {
+		if errs[n] == nil {
+			result.Images = append(result.Images, enrich(images[n]))
+			continue
+		}
+		message := "failed to fetch image from NASA APOD"
+		var upstreamErr *upstreamError
+		if errors.As(errs[n], &upstreamErr) {
+			message = upstreamErr.message
+		} else if errors.Is(errs[n], context.DeadlineExceeded) {
+			message = "NASA APOD didn't respond in time"
+		}
+		slog.WarnContext(r.Context(), "fetching NASA image", "date", date, "error", errs[n])
+		result.Errors = append(result.Errors, DateError{Date: date, Error: message})
+	}
+	if len(result.Images) == 0 {
+		writeUpstreamError(w, r, errs[0])
+		return
+	}
+	writeImages(w, r, result)
+}
+
+// validateImage checks that an image sent by a client has a valid date and an absolute http(s) url
+// a missing media_type defaults to "image"
+func validateImage(image *Image, today string) error {
+	if image.Date == "" {
+		return &fieldError{"date", "need field 'date' populated with a YYYY-MM-DD date as JSON in body request"}
+	}
+	if _, err := parseAPODDate(image.Date, today); err != nil {
+		return &fieldError{"date", err.Error()}
 	}
-	image := images[0]
+	if image.Url == "" {
+		return &fieldError{"url", "need field 'url' populated with the image URL as JSON in body request"}
+	}
+	if u, err := url.Parse(image.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &fieldError{"url", fmt.Sprintf("field 'url' must be an absolute http(s) URL, got '%s'", image.Url)}
+	}
+	switch image.MediaType {
+	case "":
+		image.MediaType = "image"
+	case "image", "video":
+	default:
+		return &fieldError{"media_type", fmt.Sprintf("field 'media_type' must be 'image' or 'video', got '%s'", image.MediaType)}
+	}
+	return nil
+}
 
-	// store image in "db"
-	i.Lock()
-	defer i.Unlock()
-	url := imageURL(image.Url)
-	i.store[url] = image
+// createImage stores the image sent as JSON in the body, without calling NASA, e.g. to import historical images
+// it responds 201 with the image, or 409 if one with the same url is stored, unless 'overwrite=true' replaces it (then 200)
+func (i *imageStore) createImage(w http.ResponseWriter, r *http.Request) {
+	if !requireJSON(w, r) {
+		return
+	}
+	overwrite := false
+	if o := r.URL.Query().Get(OVERWRITE_PARAM); o != "" {
+		var err error
+		if overwrite, err = strconv.ParseBool(o); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("query param '%s' must be a boolean, got '%s'", OVERWRITE_PARAM, o))
+			return
+		}
+	}
+
+	var image Image
+	if err := decodeBody(r, &image); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := validateImage(&image, i.today()); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	status := http.StatusCreated
+	if overwrite {
+		if _, err := i.storage.GetImage(imageURL(image.Url)); err == nil {
+			status = http.StatusOK
+		}
+		if err := i.storage.SaveImage(image); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+	} else if err := i.storage.CreateImage(image); err != nil {
+		writeStorageError(w, fmt.Errorf("image with url %s: %w", image.Url, err))
+		return
+	}
+	slog.InfoContext(r.Context(), "image stored", "image_url", image.Url, "date", image.Date, "overwrite", overwrite)
 
 	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(image)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(enrich(image))
+}
+
+// deleteImage removes the stored image matching the 'url' query param, responding 204, or 404 if it isn't stored
+// with 'cascade=true' every user's rating of the image is deleted as well, otherwise ratings are kept
+func (i *imageStore) deleteImage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	iURL := imageURL(query.Get(URL_PARAM))
+	if iURL == "" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("need query param '%s' with the url of a stored image", URL_PARAM))
+		return
+	}
+	cascade := false
+	if c := query.Get(CASCADE_PARAM); c != "" {
+		var err error
+		if cascade, err = strconv.ParseBool(c); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("query param '%s' must be a boolean, got '%s'", CASCADE_PARAM, c))
+			return
+		}
+	}
+
+	if err := i.storage.DeleteImage(iURL); err != nil {
+		writeStorageError(w, fmt.Errorf("image with url %s: %w", iURL, err))
+		return
+	}
+	if i.cache != nil {
+		i.cache.evict(iURL)
+	}
+	deleted := 0
+	if cascade {
+		// ratings are keyed by the normalized url, which NASA's urls already are
+		ratingURL := iURL
+		if normalized, err := normalizeImageURL(string(iURL)); err == nil {
+			ratingURL = normalized
+		}
+		var err error
+		if deleted, err = i.storage.DeleteImageRatings(ratingURL); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+	}
+	slog.InfoContext(r.Context(), "image deleted", "image_url", iURL, "ratings_deleted", deleted)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getImage returns a previously stored image matching the 'url' query param
+func (i *imageStore) getImage(w http.ResponseWriter, r *http.Request) {
+	iURL := imageURL(r.URL.Query().Get(URL_PARAM))
+
+	image, err := i.storage.GetImage(iURL)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("image with url %s: %w", iURL, err))
+		return
+	}
+
+	writeImages(w, r, enrich(image))
+}
+
+// randomImage is responsible for requests sent to the /image/random endpoint
+// it returns one of the stored images picked at random, without calling NASA, or 404 if none are stored
+func (i *imageStore) randomImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != GET {
+		methodNotAllowed(w, GET)
+		return
+	}
+	if _, err := parseFields(r); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	images, err := i.storage.ListImages()
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if len(images) == 0 {
+		writeError(w, http.StatusNotFound, "no images stored yet")
+		return
+	}
+
+	// a fixed order makes the pick depend on the random source alone
+	sort.Slice(images, func(a, b int) bool {
+		return images[a].Url < images[b].Url
+	})
+	i.randomLock.Lock()
+	n := i.random.Intn(len(images))
+	i.randomLock.Unlock()
+
+	writeImages(w, r, enrich(images[n]))
+}
+
+// parsePagination reads the optional 'limit' and 'offset' query params
+// a limit of -1 means no limit was requested
+func parsePagination(r *http.Request) (int, int, error) {
+	limit, offset := -1, 0
+	if l := r.URL.Query().Get(LIMIT_PARAM); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("query param '%s' must be a non-negative integer, got '%s'", LIMIT_PARAM, l)
+		}
+		limit = n
+	}
+	if o := r.URL.Query().Get(OFFSET_PARAM); o != "" {
+		n, err := strconv.Atoi(o)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("query param '%s' must be a non-negative integer, got '%s'", OFFSET_PARAM, o)
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
+
+// paginate returns the [start, end) bounds of the requested page within a list of the given length
+func paginate(length, limit, offset int) (int, int) {
+	if offset > length {
+		offset = length
+	}
+	end := length
+	if limit >= 0 && offset+limit < length {
+		end = offset + limit
+	}
+	return offset, end
+}
+
+// listImages is responsible for requests sent to the /images endpoint
+// it returns all stored images sorted by date, most recent first
+func (i *imageStore) listImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != GET {
+		methodNotAllowed(w, GET)
+		return
+	}
+
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := parseFields(r); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	images, err := i.storage.ListImages()
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	sort.Slice(images, func(a, b int) bool {
+		if images[a].Date != images[b].Date {
+			return images[a].Date > images[b].Date
+		}
+		return images[a].Url < images[b].Url
+	})
+	start, end := paginate(len(images), limit, offset)
+	writeImages(w, r, images[start:end])
+}
+
+// healthHandler returns a handler for the /health endpoint
+// it reports the server is up, and for how long, without calling NASA's APOD API
+func healthHandler(start time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(Health{
+			Status: "ok",
+			Uptime: time.Since(start).Round(time.Second).String(),
+		})
+	}
 }
 
 // userHandlers is responsible for routing requests from the /user endpoint
 func (u *users) userHandlers(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
+	case GET:
+		u.getUser(w, r)
+		return
 	case POST:
 		u.createUser(w, r)
 		return
+	case PUT:
+		u.updateUser(w, r)
+		return
 	case DELETE:
 		u.deleteUser(w, r)
 		return
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("METHOD NOT ALLOWED"))
+		methodNotAllowed(w, GET, POST, PUT, DELETE)
 		return
 	}
 }
 
-// createUser creates a new user in the user store
-func (u *users) createUser(w http.ResponseWriter, r *http.Request) {
-	if ct := r.Header.Get(CONTENT_TYPE); ct != APPLICATION_JSON {
-		w.WriteHeader(http.StatusUnsupportedMediaType)
-		w.Write([]byte(fmt.Sprintf("need content-type 'application/json', but got '%s' instead", ct)))
+// getUser returns the profile of a user, read from the 'email' query param or the JSON body
+func (u *users) getUser(w http.ResponseWriter, r *http.Request) {
+	usrEmail, ok := u.requestEmail(w, r)
+	if !ok {
 		return
 	}
 
-	var usr User
-	if err := json.NewDecoder(r.Body).Decode(&usr); err != nil {
-		panic(err)
+	ratings, err := u.storage.GetRatings(usrEmail)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("user with email %s: %w", usrEmail, err))
+		return
+	}
+	profile := UserProfile{
+		Email:       string(usrEmail),
+		RatingCount: len(ratings),
+	}
+
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(profile)
+}
+
+// createUser creates a new user in the user store
+func (u *users) createUser(w http.ResponseWriter, r *http.Request) {
+	if !requireJSON(w, r) {
+		return
 	}
 
-	usrEmail := userEmail(usr.Email)
-	if usrEmail == "" || len(usrEmail) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("need field 'email' populated with a valid email as JSON in body request")))
+	// check for email in body response
+	usr, ok := u.decodeUser(w, r, false, false)
+	if !ok {
 		return
 	}
+	usrEmail := normalizeEmail(usr.Email)
 
-	u.Lock()
-	defer u.Unlock()
-	if _, ok := u.store[usrEmail]; ok {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("user with email %s already exists", usrEmail)))
+	if err := u.storage.CreateUser(usrEmail, u.maxUsers); err != nil {
+		writeStorageError(w, fmt.Errorf("user with email %s: %w", usrEmail, err))
 		return
-	} else {
-		u.store[usrEmail] = newUser()
 	}
 
-	w.Header().Add(CONTENT_TYPE, APPLICATION_JSON)
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
 	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(fmt.Sprintf("user with email %v, successfully created", usrEmail)))
+	json.NewEncoder(w).Encode(UserProfile{Email: string(usrEmail)})
 }
 
-// deleteUser deletes a user from the user store
-func (u *users) deleteUser(w http.ResponseWriter, r *http.Request) {
-	if ct := r.Header.Get(CONTENT_TYPE); ct != APPLICATION_JSON {
-		w.WriteHeader(http.StatusUnsupportedMediaType)
-		w.Write([]byte(fmt.Sprintf("need content-type 'application/json', but got '%s' instead", ct)))
+// updateUser changes the email of an existing user, keeping all of their ratings
+func (u *users) updateUser(w http.ResponseWriter, r *http.Request) {
+	if !requireJSON(w, r) {
 		return
 	}
 
-	var usr User
-	if err := json.NewDecoder(r.Body).Decode(&usr); err != nil {
-		panic(err)
+	// both emails come in the body, decoded on their own so 'newEmail' isn't accepted by the other endpoints
+	var rename RenamedUser
+	if err := decodeBody(r, &rename); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := rename.Validate(); err != nil {
+		writeValidationError(w, err)
+		return
 	}
+	usrEmail := normalizeEmail(rename.Email)
+	newEmail := normalizeEmail(rename.NewEmail)
 
-	usrEmail := userEmail(usr.Email)
-	if usrEmail == "" || len(usrEmail) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("need field 'email' populated with a valid email as JSON in body request")))
+	if err := u.storage.RenameUser(usrEmail, newEmail); err != nil {
+		writeStorageError(w, fmt.Errorf("renaming user with email %s to %s: %w", usrEmail, newEmail, err))
 		return
 	}
 
-	u.Lock()
-	defer u.Unlock()
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(RenamedUser{Email: string(usrEmail), NewEmail: string(newEmail)})
+}
+
+// deleteUser deletes a user from the user store along with their ratings, reporting how many there were, or 404 if the user doesn't exist
+func (u *users) deleteUser(w http.ResponseWriter, r *http.Request) {
+	if !requireJSON(w, r) {
+		return
+	}
 
-	if _, ok := u.store[usrEmail]; ok {
-		delete(u.store, usrEmail)
+	// check for email in body response
+	usr, ok := u.decodeUser(w, r, false, false)
+	if !ok {
+		return
 	}
+	usrEmail := normalizeEmail(usr.Email)
 
-	w.Header().Add(CONTENT_TYPE, APPLICATION_JSON)
-	w.WriteHeader(http.StatusNoContent)
-	w.Write([]byte(fmt.Sprintf("user with email %v, successfully deleted", usrEmail)))
+	deleted, err := u.storage.DeleteUser(usrEmail)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("user with email %s: %w", usrEmail, err))
+		return
+	}
+	slog.InfoContext(r.Context(), "user deleted", "email", usrEmail, "ratings_deleted", deleted)
+
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(DeletedUser{Email: string(usrEmail), RatingsDeleted: deleted})
 }
 
 // ratingHandlers is responsible for routing the requests from the /rating endpoint
 func (u *users) ratingHandlers(w http.ResponseWriter, r *http.Request) {
-	if ct := r.Header.Get(CONTENT_TYPE); ct != APPLICATION_JSON {
-		w.WriteHeader(http.StatusUnsupportedMediaType)
-		w.Write([]byte(fmt.Sprintf("need content-type 'application/json', but got '%s' instead", ct)))
+	// a GET's content-type is checked by requestEmail, like on the other endpoints reading the email
+	if r.Method != GET && !requireJSON(w, r) {
 		return
 	}
 
@@ -224,204 +1307,636 @@ func (u *users) ratingHandlers(w http.ResponseWriter, r *http.Request) {
 		u.deleteRating(w, r)
 		return
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("METHOD NOT ALLOWED"))
+		methodNotAllowed(w, GET, POST, PUT, DELETE)
 		return
 	}
 }
 
 // saveRating stores a rating associated with an image, for the specified user
 func (u *users) saveRating(w http.ResponseWriter, r *http.Request) {
-	// check for email in body response
-	var usr User
-	if err := json.NewDecoder(r.Body).Decode(&usr); err != nil {
-		panic(err)
+	// check for email, image URL and rating in body response
+	usr, ok := u.decodeUser(w, r, true, true)
+	if !ok {
+		return
+	}
+	usrEmail := normalizeEmail(usr.Email)
+	iURL, _ := normalizeImageURL(usr.ImageURL)
+	iRating := rating(usr.Rating)
+
+	upsert := false
+	if value := r.URL.Query().Get(UPSERT_PARAM); value != "" {
+		var err error
+		if upsert, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("query param '%s' must be a boolean, got '%s'", UPSERT_PARAM, value))
+			return
+		}
 	}
-	usrEmail := userEmail(usr.Email)
-	if usrEmail == "" || len(usrEmail) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("need field 'email' populated with a valid email as JSON in body request")))
+
+	// save rating, unless image already exists with a rating, in which case 'upsert=true' updates it instead
+	status := http.StatusCreated
+	if upsert {
+		created, err := u.storage.UpsertRating(usrEmail, iURL, iRating, u.maxRatings)
+		if err != nil {
+			writeStorageError(w, fmt.Errorf("rating of image %s by user with email %s: %w", iURL, usrEmail, err))
+			return
+		}
+		if !created {
+			status = http.StatusOK
+		}
+	} else if err := u.storage.SaveRating(usrEmail, iURL, iRating, u.maxRatings); err != nil {
+		writeStorageError(w, fmt.Errorf("rating of image %s by user with email %s: %w", iURL, usrEmail, err))
 		return
 	}
-	iURL := imageURL(usr.ImageURL)
-	if iURL == "" || len(usrEmail) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("need field 'imageURL' populated with a valid image URL as JSON in body request")))
+	slog.InfoContext(r.Context(), "rating saved", "email", usrEmail, "image_url", iURL, "rating", iRating)
+
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(User{Email: string(usrEmail), ImageURL: string(iURL), Rating: int(iRating)})
+}
+
+// bulkRatings is responsible for requests sent to the /ratings/bulk endpoint
+// it saves several ratings of a user in one go, reporting whether each was saved, a duplicate or invalid
+func (u *users) bulkRatings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != POST {
+		methodNotAllowed(w, POST)
 		return
 	}
-	iRating := rating(usr.Rating)
-	if iRating < 1 || iRating > 5 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("need field 'rating' populated with a valid integer rating 1-5 as JSON in body request")))
+	if !requireJSON(w, r) {
 		return
 	}
 
-	// read user from store list
-	u.Lock()
-	existingUser, ok := u.store[usrEmail]
-	u.Unlock()
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("user with email %s does not exist", usrEmail)))
+	var bulk BulkRatings
+	if err := decodeBody(r, &bulk); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if !validEmail(bulk.Email) {
+		writeError(w, http.StatusBadRequest, "invalid email address")
 		return
 	}
+	usrEmail := normalizeEmail(bulk.Email)
+
+	// invalid ratings are reported without reaching the store
+	results := make([]BulkResult, len(bulk.Ratings))
+	valid := make([]ImageRating, 0, len(bulk.Ratings))
+	validIdx := make([]int, 0, len(bulk.Ratings))
+	for n, item := range bulk.Ratings {
+		results[n] = BulkResult{ImageURL: item.ImageURL, Rating: item.Rating}
+		if err := (User{Email: bulk.Email, ImageURL: item.ImageURL, Rating: item.Rating}).Validate(u.scale, true, true); err != nil {
+			results[n].Status, results[n].Error = "invalid", err.Error()
+		} else {
+			url, _ := normalizeImageURL(item.ImageURL)
+			item.ImageURL = string(url)
+			results[n].ImageURL = item.ImageURL
+			valid = append(valid, item)
+			validIdx = append(validIdx, n)
+		}
+	}
 
-	// check if image already exists with a rating
-	existingUser.Lock()
-	if _, ok := existingUser.store[iURL]; ok {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("image with url %s already exists - send PUT request to update rating", iURL)))
+	saved, err := u.storage.SaveRatings(usrEmail, valid, u.maxRatings)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("user with email %s: %w", usrEmail, err))
 		return
-	} else {
-		existingUser.store[iURL] = iRating
 	}
-	existingUser.Unlock()
+	for k, err := range saved {
+		n := validIdx[k]
+		switch {
+		case err == nil:
+			results[n].Status = "saved"
+		case errors.Is(err, ErrRatingExists):
+			results[n].Status, results[n].Error = "duplicate", err.Error()
+		case errors.Is(err, ErrRatingLimit):
+			results[n].Status, results[n].Error = "limit", err.Error()
+		default:
+			results[n].Status, results[n].Error = "invalid", err.Error()
+		}
+	}
+	slog.InfoContext(r.Context(), "ratings saved in bulk", "email", usrEmail, "submitted", len(bulk.Ratings), "valid", len(valid))
 
-	w.Header().Add(CONTENT_TYPE, APPLICATION_JSON)
-	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(fmt.Sprintf("rating successfully saved")))
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(results)
 }
 
-// getRatings returns all image ratings associated with a user
+// getRatings returns all image ratings associated with a user, as a list sorted by image URL
+// the email is read from the 'email' query param, falling back to the JSON body
+// 'sort=rating' orders the list by rating instead, highest first, 'sort=recent' by last update, newest first, and 'limit' and 'offset' paginate it
 func (u *users) getRatings(w http.ResponseWriter, r *http.Request) {
-	// check for email in body response
-	var usr User
-	if err := json.NewDecoder(r.Body).Decode(&usr); err != nil {
-		panic(err)
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	usrEmail := userEmail(usr.Email)
-	if usrEmail == "" || len(usrEmail) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("need field 'email' populated with a valid email as JSON in body request")))
+	order := r.URL.Query().Get(SORT_PARAM)
+	switch order {
+	case "", URL_PARAM, SORT_BY_RATING, SORT_BY_RECENT:
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("query param '%s' must be '%s', '%s' or '%s', got '%s'", SORT_PARAM, URL_PARAM, SORT_BY_RATING, SORT_BY_RECENT, order))
 		return
 	}
 
-	// read user from store list
-	u.Lock()
-	existingUser, ok := u.store[usrEmail]
-	u.Unlock()
+	usrEmail, ok := u.requestEmail(w, r)
 	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("user with email %s does not exist", usrEmail)))
 		return
 	}
 
-	existingUser.Lock()
+	// read user's ratings from store
+	ratings, err := u.storage.GetRatings(usrEmail)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("user with email %s: %w", usrEmail, err))
+		return
+	}
+
+	list := make([]RatingEntry, 0, len(ratings))
+	for url, stored := range ratings {
+		list = append(list, RatingEntry{ImageURL: string(url), Rating: int(stored.Value), CreatedAt: stored.CreatedAt, UpdatedAt: stored.UpdatedAt})
+	}
+	// ties, and the default order, fall back to the image URL so pages are stable
+	sort.Slice(list, func(a, b int) bool {
+		if order == SORT_BY_RATING && list[a].Rating != list[b].Rating {
+			return list[a].Rating > list[b].Rating
+		}
+		if order == SORT_BY_RECENT && !list[a].UpdatedAt.Equal(list[b].UpdatedAt) {
+			return list[a].UpdatedAt.After(list[b].UpdatedAt)
+		}
+		return list[a].ImageURL < list[b].ImageURL
+	})
+	start, end := paginate(len(list), limit, offset)
+
 	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(existingUser.store)
-	existingUser.Unlock()
+	json.NewEncoder(w).Encode(list[start:end])
 }
 
-// updateRating updates the rating of an image associated with a user
-func (u *users) updateRating(w http.ResponseWriter, r *http.Request) {
-	// check for email in body response
-	var usr User
-	if err := json.NewDecoder(r.Body).Decode(&usr); err != nil {
-		panic(err)
+// ratingStats is responsible for requests sent to the /rating/stats endpoint
+// it returns the count, average, min and max of the ratings a user has given
+// average, min and max are null when the user has no ratings
+func (u *users) ratingStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != GET {
+		methodNotAllowed(w, GET)
+		return
 	}
-	usrEmail := userEmail(usr.Email)
-	if usrEmail == "" || len(usrEmail) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("need field 'email' populated with a valid email as JSON in body request")))
+
+	usrEmail, ok := u.requestEmail(w, r)
+	if !ok {
 		return
 	}
-	iURL := imageURL(usr.ImageURL)
-	if iURL == "" || len(usrEmail) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("need field 'imageURL' populated with a valid image URL as JSON in body request")))
+
+	// read user's ratings from store
+	ratings, err := u.storage.GetRatings(usrEmail)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("user with email %s: %w", usrEmail, err))
 		return
 	}
-	iRating := rating(usr.Rating)
-	if iRating < 1 || iRating > 5 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("need field 'rating' populated with a valid integer rating 1-5 as JSON in body request")))
+
+	var stats RatingStats
+	sum, min, max := 0, 0, 0
+	for _, stored := range ratings {
+		value := int(stored.Value)
+		if stats.Count == 0 || value < min {
+			min = value
+		}
+		if stats.Count == 0 || value > max {
+			max = value
+		}
+		sum += value
+		stats.Count++
+	}
+	if stats.Count > 0 {
+		average := float64(sum) / float64(stats.Count)
+		stats.Average, stats.Min, stats.Max = &average, &min, &max
+	}
+
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stats)
+}
+
+// favoriteRatings is responsible for requests sent to the /rating/favorites endpoint
+// it returns the user's ratings of at least the 'min' query param (4 by default), highest first, ties sorted by image URL
+// along with the stored metadata of each image, when it was fetched before
+func (u *users) favoriteRatings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != GET {
+		methodNotAllowed(w, GET)
 		return
 	}
 
-	// read user from store list
-	u.Lock()
-	existingUser, ok := u.store[usrEmail]
-	u.Unlock()
+	threshold := DEFAULT_FAVORITE
+	if m := r.URL.Query().Get(MIN_PARAM); m != "" {
+		n, err := strconv.Atoi(m)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("query param '%s' must be an integer, got '%s'", MIN_PARAM, m))
+			return
+		}
+		threshold = n
+	}
+
+	usrEmail, ok := u.requestEmail(w, r)
 	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("user with email %s does not exist", usrEmail)))
 		return
 	}
 
-	// check if image already exists with a rating
-	existingUser.Lock()
-	if _, ok := existingUser.store[iURL]; !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("image with url %s doesn't exist - send POST request to save rating", iURL)))
+	// read user's ratings from store
+	ratings, err := u.storage.GetRatings(usrEmail)
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("user with email %s: %w", usrEmail, err))
 		return
-	} else {
-		// update rating
-		existingUser.store[iURL] = iRating
 	}
-	existingUser.Unlock()
 
-	w.Header().Add(CONTENT_TYPE, APPLICATION_JSON)
-	w.WriteHeader(http.StatusNoContent)
-	w.Write([]byte(fmt.Sprintf("rating successfully updated")))
+	favorites := make([]Favorite, 0, len(ratings))
+	for url, stored := range ratings {
+		if int(stored.Value) >= threshold {
+			favorites = append(favorites, Favorite{ImageURL: string(url), Rating: int(stored.Value)})
+		}
+	}
+	sort.Slice(favorites, func(a, b int) bool {
+		if favorites[a].Rating != favorites[b].Rating {
+			return favorites[a].Rating > favorites[b].Rating
+		}
+		return favorites[a].ImageURL < favorites[b].ImageURL
+	})
+
+	// attach the stored metadata of each image, when it was fetched before
+	for n := range favorites {
+		image, err := u.storage.GetImage(imageURL(favorites[n].ImageURL))
+		if err == nil {
+			favorites[n].Image = &image
+		} else if !errors.Is(err, ErrImageNotFound) {
+			writeStorageError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(favorites)
+}
+
+// updateRating updates the rating of an image associated with a user
+func (u *users) updateRating(w http.ResponseWriter, r *http.Request) {
+	// check for email, image URL and rating in body response
+	usr, ok := u.decodeUser(w, r, true, true)
+	if !ok {
+		return
+	}
+	usrEmail := normalizeEmail(usr.Email)
+	iURL, _ := normalizeImageURL(usr.ImageURL)
+	iRating := rating(usr.Rating)
+
+	// update rating, if image already exists with a rating
+	if err := u.storage.UpdateRating(usrEmail, iURL, iRating); err != nil {
+		writeStorageError(w, fmt.Errorf("rating of image %s by user with email %s: %w", iURL, usrEmail, err))
+		return
+	}
+	slog.InfoContext(r.Context(), "rating updated", "email", usrEmail, "image_url", iURL, "rating", iRating)
+
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(User{Email: string(usrEmail), ImageURL: string(iURL), Rating: int(iRating)})
 }
 
 // deleteRating deletes a rating associated with an image for a specified user
 func (u *users) deleteRating(w http.ResponseWriter, r *http.Request) {
-	// check for email in body response
-	var usr User
-	if err := json.NewDecoder(r.Body).Decode(&usr); err != nil {
-		panic(err)
+	// check for email and image URL in body response
+	usr, ok := u.decodeUser(w, r, true, false)
+	if !ok {
+		return
+	}
+	usrEmail := normalizeEmail(usr.Email)
+	iURL, _ := normalizeImageURL(usr.ImageURL)
+
+	// delete rating, if image already exists with a rating
+	if err := u.storage.DeleteRating(usrEmail, iURL); err != nil {
+		writeStorageError(w, fmt.Errorf("rating of image %s by user with email %s: %w", iURL, usrEmail, err))
+		return
+	}
+	slog.InfoContext(r.Context(), "rating deleted", "email", usrEmail, "image_url", iURL)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ratingByPath is responsible for the /rating/{email}/{imageURL} endpoint, a path based alternative to /rating
+// the image URL must be URL-encoded into a single path segment, PUT takes the new rating as {"rating": N}
+func (u *users) ratingByPath(w http.ResponseWriter, r *http.Request) {
+	usr := User{Email: r.PathValue("email"), ImageURL: r.PathValue("imageURL")}
+	if r.Method != GET && r.Method != PUT && r.Method != DELETE {
+		methodNotAllowed(w, GET, PUT, DELETE)
+		return
+	}
+	if err := usr.Validate(u.scale, true, false); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	usrEmail := normalizeEmail(usr.Email)
+	iURL, _ := normalizeImageURL(usr.ImageURL)
+	storageError := func(err error) {
+		writeStorageError(w, fmt.Errorf("rating of image %s by user with email %s: %w", iURL, usrEmail, err))
+	}
+
+	switch r.Method {
+	case GET:
+		ratings, err := u.storage.GetRatings(usrEmail)
+		if err != nil {
+			storageError(err)
+			return
+		}
+		stored, ok := ratings[iURL]
+		if !ok {
+			storageError(ErrRatingNotFound)
+			return
+		}
+		usr.Rating = int(stored.Value)
+	case PUT:
+		if !requireJSON(w, r) {
+			return
+		}
+		var body struct {
+			Rating int `json:"rating"`
+		}
+		if err := decodeBody(r, &body); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		usr.Rating = body.Rating
+		if err := usr.Validate(u.scale, true, true); err != nil {
+			writeValidationError(w, err)
+			return
+		}
+		if err := u.storage.UpdateRating(usrEmail, iURL, rating(usr.Rating)); err != nil {
+			storageError(err)
+			return
+		}
+		slog.InfoContext(r.Context(), "rating updated", "email", usrEmail, "image_url", iURL, "rating", usr.Rating)
+	case DELETE:
+		if err := u.storage.DeleteRating(usrEmail, iURL); err != nil {
+			storageError(err)
+			return
+		}
+		slog.InfoContext(r.Context(), "rating deleted", "email", usrEmail, "image_url", iURL)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(User{Email: string(usrEmail), ImageURL: string(iURL), Rating: usr.Rating})
+}
+
+// topRatings returns the images with the highest average rating across all users
+// ties are broken by the number of raters, the 'limit' query param caps the list (10 by default)
+func (u *users) topRatings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != GET {
+		methodNotAllowed(w, GET)
+		return
+	}
+
+	limit := DEFAULT_TOP
+	if l := r.URL.Query().Get(LIMIT_PARAM); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("query param '%s' must be a non-negative integer, got '%s'", LIMIT_PARAM, l))
+			return
+		}
+		limit = n
+	}
+
+	all, err := u.storage.AllRatings()
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	sums := map[imageURL]int{}
+	counts := map[imageURL]int{}
+	for _, ratings := range all {
+		for url, value := range ratings {
+			sums[url] += int(value)
+			counts[url]++
+		}
+	}
+	top := make([]TopImage, 0, len(counts))
+	for url, count := range counts {
+		top = append(top, TopImage{
+			ImageURL: string(url),
+			Average:  float64(sums[url]) / float64(count),
+			Count:    count,
+		})
+	}
+	sort.Slice(top, func(a, b int) bool {
+		if top[a].Average != top[b].Average {
+			return top[a].Average > top[b].Average
+		}
+		if top[a].Count != top[b].Count {
+			return top[a].Count > top[b].Count
+		}
+		return top[a].ImageURL < top[b].ImageURL
+	})
+	if limit < len(top) {
+		top = top[:limit]
+	}
+
+	// attach the stored metadata of each image, when it was fetched before
+	for n := range top {
+		image, err := u.storage.GetImage(imageURL(top[n].ImageURL))
+		if err == nil {
+			top[n].Image = &image
+		} else if !errors.Is(err, ErrImageNotFound) {
+			writeStorageError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(top)
+}
+
+// imageRaters is responsible for requests sent to the /image/raters endpoint
+// it returns how many users rated the image with the 'url' query param, and their average rating (null if nobody did)
+func (u *users) imageRaters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != GET {
+		methodNotAllowed(w, GET)
+		return
+	}
+
+	raw := r.URL.Query().Get(URL_PARAM)
+	if raw == "" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("need query param '%s'", URL_PARAM))
+		return
+	}
+	iURL, err := normalizeImageURL(raw)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	usrEmail := userEmail(usr.Email)
-	if usrEmail == "" || len(usrEmail) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("need field 'email' populated with a valid email as JSON in body request")))
+
+	all, err := u.storage.AllRatings()
+	if err != nil {
+		writeStorageError(w, err)
 		return
 	}
-	iURL := imageURL(usr.ImageURL)
-	if iURL == "" || len(usrEmail) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("need field 'imageURL' populated with a valid image URL as JSON in body request")))
+
+	raters := ImageRaters{ImageURL: string(iURL)}
+	sum := 0
+	for _, ratings := range all {
+		if value, ok := ratings[iURL]; ok {
+			sum += int(value)
+			raters.Raters++
+		}
+	}
+	if raters.Raters > 0 {
+		average := float64(sum) / float64(raters.Raters)
+		raters.Average = &average
+	}
+
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(raters)
+}
+
+// clearRatings deletes every rating of a user, leaving the user itself in place
+func (u *users) clearRatings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != DELETE {
+		methodNotAllowed(w, DELETE)
 		return
 	}
 
-	// read user from store list
-	u.Lock()
-	existingUser, ok := u.store[usrEmail]
-	u.Unlock()
+	usrEmail, ok := u.requestEmail(w, r)
 	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("user with email %s does not exist", usrEmail)))
 		return
 	}
 
-	// check if image already exists with a rating
-	existingUser.Lock()
-	if _, ok := existingUser.store[iURL]; !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("image with url %s doesn't exist", iURL)))
+	if err := u.storage.ClearRatings(usrEmail); err != nil {
+		writeStorageError(w, fmt.Errorf("user with email %s: %w", usrEmail, err))
 		return
-	} else {
-		// delete rating
-		delete(existingUser.store, iURL)
 	}
-	existingUser.Unlock()
+	slog.InfoContext(r.Context(), "ratings cleared", "email", usrEmail)
 
-	w.Header().Add(CONTENT_TYPE, APPLICATION_JSON)
 	w.WriteHeader(http.StatusNoContent)
-	w.Write([]byte(fmt.Sprintf("rating successfully deleted")))
+}
+
+// newServer returns the server for handler on addr, with the timeouts read from SERVER_READ_TIMEOUT_SECONDS,
+// SERVER_WRITE_TIMEOUT_SECONDS and SERVER_IDLE_TIMEOUT_SECONDS, so slow or idle clients can't hold connections open forever
+// reading the headers is bounded by the read timeout too
+func newServer(addr string, handler http.Handler) *http.Server {
+	read := secondsEnv(READ_ENV_VAR, DEFAULT_READ)
+	write := secondsEnv(WRITE_ENV_VAR, DEFAULT_WRITE)
+	idle := secondsEnv(IDLE_ENV_VAR, DEFAULT_IDLE)
+	if write <= requestTimeout() {
+		slog.Warn("environment variable " + WRITE_ENV_VAR + " is not above " + REQUEST_TIMEOUT_ENV_VAR + ", timed out requests may get no response at all")
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       read,
+		ReadHeaderTimeout: read,
+		WriteTimeout:      write,
+		IdleTimeout:       idle,
+	}
+}
+
+// listenAddr returns the address the server listens on, read from LISTEN_ADDR if set
+func listenAddr() string {
+	addr := os.Getenv(ADDR_ENV_VAR)
+	if addr == "" {
+		return DEFAULT_ADDR
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		panic(fmt.Sprintf("environment variable %s must be a host:port address, got '%s': %v", ADDR_ENV_VAR, addr, err))
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		panic(fmt.Sprintf("environment variable %s has an invalid port '%s'", ADDR_ENV_VAR, port))
+	}
+	return addr
+}
+
+// newRouter registers every endpoint on a dedicated ServeMux and wraps it in the middlewares shared by all requests
+func newRouter(i *imageStore, u *users) http.Handler {
+	start := time.Now()
+	token := apiToken()
+
+	mux := http.NewServeMux()
+	mux.Handle("/image", requireToken(token, limitRate(newRateLimiter(), http.HandlerFunc(i.imageHandler))))
+	mux.HandleFunc("/image/random", i.randomImage)
+	mux.HandleFunc("/image/proxy", i.proxyImage)
+	mux.HandleFunc("/image/raters", u.imageRaters)
+	mux.HandleFunc("/images", i.listImages)
+	mux.Handle("/user", requireToken(token, http.HandlerFunc(u.userHandlers)))
+	mux.Handle("/rating", requireToken(token, idempotent(newIdempotencyKeys(), http.HandlerFunc(u.ratingHandlers))))
+	mux.Handle("/rating/{email}/{imageURL}", requireToken(token, http.HandlerFunc(u.ratingByPath)))
+	mux.HandleFunc("/rating/stats", u.ratingStats)
+	mux.HandleFunc("/rating/favorites", u.favoriteRatings)
+	mux.HandleFunc("/ratings/top", u.topRatings)
+	mux.Handle("/ratings/bulk", requireToken(token, http.HandlerFunc(u.bulkRatings)))
+	mux.Handle("/rating/all", requireToken(token, http.HandlerFunc(u.clearRatings)))
+	mux.Handle("/export", requireTokenAlways(token, exportHandler(u.storage)))
+	mux.Handle("/import", requireTokenAlways(token, importHandler(u.storage, u.scale, i.zone)))
+	mux.HandleFunc("/health", healthHandler(start))
+	mux.HandleFunc("/health/upstream", i.upstreamHealth)
+	mux.HandleFunc("/metrics", appMetrics.handler)
+	mux.HandleFunc("/openapi.json", openAPIHandler)
+	mux.HandleFunc("/favicon.ico", faviconHandler)
+	mux.HandleFunc("/", indexHandler())
+
+	// /image/proxy bypasses the request timeout and compression, http.TimeoutHandler holding the whole response in memory
+	// and images being compressed already, so that images are streamed as they arrive; its own deadline bounds it instead
+	// /import has a body limit of its own, every other route sharing MAX_BODY_BYTES
+	timeout := requestTimeout()
+	chain := func(maxBody int64) http.Handler {
+		return compress(prettyJSON(limitBody(maxBody, instrument(mux, withTimeout(timeout, recoverPanics(mux))))))
+	}
+	routes := http.NewServeMux()
+	routes.Handle("/image/proxy", instrument(mux, recoverPanics(http.HandlerFunc(i.proxyImage))))
+	routes.Handle("/import", chain(maxImportBytes()))
+	routes.Handle("/", chain(maxBodyBytes()))
+
+	return withRequestID(logRequests(withCORS(corsOrigin(), routes)))
+}
+
+// serve handles requests on ln until a signal arrives on stop, then gives in-flight requests SHUTDOWN_TIMEOUT to finish
+func serve(server *http.Server, ln net.Listener, stop <-chan os.Signal) error {
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	return server.Shutdown(ctx)
 }
 
 func main() {
+	setupLogging()
 
-	i := newImageStore()
-	u := newUsers()
+	addr := listenAddr()
+	storage, err := newStorage()
+	if err != nil {
+		panic(err)
+	}
+	i := newImageStore(storage)
+	u := newUsers(storage)
+	stopSweeper := startSweeper(storage, ratingTTL(), sweepInterval())
+	if prefetchEnabled() {
+		i.prefetchToday()
+	}
 
-	http.HandleFunc("/image", i.imageHandler)
-	http.HandleFunc("/user", u.userHandlers)
-	http.HandleFunc("/rating", u.ratingHandlers)
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	server := newServer(addr, newRouter(i, u))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
 		panic(err)
 	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	if err := serve(server, ln, stop); err != nil {
+		slog.Error("shutting down server", "error", err)
+	}
+	stopSweeper()
+	i.webhook.wait()
+	if err := storage.Close(); err != nil {
+		slog.Error("closing storage", "error", err)
+	}
 }
@@ -0,0 +1,1820 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// failingTransport fails every request, as if NASA couldn't be reached at all
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestRateFetchedImage(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		s.createUser(t, "Ada@Example.com")
+
+		image := s.fetchImage(t, "2024-01-01")
+		if image.Url != stubImage("2024-01-01").Url {
+			t.Fatalf("got image %s, want %s", image.Url, stubImage("2024-01-01").Url)
+		}
+		saved := s.saveRating(t, "ada@example.com", image.Url, 4)
+		if saved.Email != "ada@example.com" || saved.ImageURL != image.Url || saved.Rating != 4 {
+			t.Fatalf("saved %+v", saved)
+		}
+
+		ratings := s.ratingsOf(t, "ada@example.com")
+		if len(ratings) != 1 || ratings[0].ImageURL != image.Url || ratings[0].Rating != 4 {
+			t.Fatalf("got ratings %+v, want the one saved", ratings)
+		}
+		if ratings[0].CreatedAt.IsZero() {
+			t.Errorf("rating has no createdAt")
+		}
+
+		// the image was stored when it was fetched, so it can be looked up without calling NASA again
+		calls := s.nasa.calls.Load()
+		expectStatus(t, s.get(t, "/image?"+URL_PARAM+"="+image.Url), http.StatusOK)
+		if s.nasa.calls.Load() != calls {
+			t.Errorf("looking up a stored image called NASA")
+		}
+	})
+}
+
+func TestRouter(t *testing.T) {
+	s := newTestServer(t)
+	router := newRouter(s.images, s.users)
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set(CONTENT_TYPE, APPLICATION_JSON)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{POST, "/user", `{"email": "ada@example.com"}`, http.StatusCreated},
+		{GET, "/image?" + DATE_PARAM + "=2024-01-01", "", http.StatusOK},
+		{POST, "/rating", `{"email": "ada@example.com", "imageURL": "` + stubImage("2024-01-01").Url + `", "rating": 5}`, http.StatusCreated},
+		{GET, "/rating?" + EMAIL_PARAM + "=ada@example.com", "", http.StatusOK},
+		{GET, "/health", "", http.StatusOK},
+		{GET, "/nowhere", "", http.StatusNotFound},
+	} {
+		rec := serve(c.method, c.path, c.body)
+		if rec.Code != c.status {
+			t.Errorf("%s %s: got status %d, want %d, body %q", c.method, c.path, rec.Code, c.status, rec.Body)
+		}
+		if rec.Header().Get(REQUEST_ID_HEADER) == "" {
+			t.Errorf("%s %s: went around the shared middlewares", c.method, c.path)
+		}
+	}
+}
+
+func TestImageUpstreamFailure(t *testing.T) {
+	s := newTestServer(t, ATTEMPTS_ENV_VAR+"=1")
+	s.images.client = &http.Client{Transport: failingTransport{}}
+
+	resp := s.get(t, "/image?"+DATE_PARAM+"=2024-01-01")
+	expectStatus(t, resp, http.StatusBadGateway)
+	var body errorResponse
+	resp.decode(t, &body)
+	if body.Error.Code != "bad_gateway" || body.Error.Message != "failed to fetch image from NASA APOD" {
+		t.Errorf("got error %+v", body.Error)
+	}
+
+	// the server keeps serving everything else
+	s.createUser(t, "ada@example.com")
+	s.saveRating(t, "ada@example.com", stubImage("2024-01-01").Url, 5)
+	if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 1 {
+		t.Errorf("got %d ratings, want 1", len(ratings))
+	}
+}
+
+func TestMalformedJSONBody(t *testing.T) {
+	s := newTestServer(t)
+	for _, endpoint := range []struct{ method, path string }{
+		{POST, "/user"},
+		{PUT, "/user"},
+		{DELETE, "/user"},
+		{GET, "/rating"},
+		{POST, "/rating"},
+		{PUT, "/rating"},
+		{DELETE, "/rating"},
+	} {
+		for _, body := range []string{`{`, `{"email": "ada@example.com"`, `[]`} {
+			resp := s.request(t, endpoint.method, endpoint.path, body)
+			expectStatus(t, resp, http.StatusBadRequest)
+			var got errorResponse
+			resp.decode(t, &got)
+			if got.Error.Message != "invalid JSON body" {
+				t.Errorf("%s %s with body %s: got message %q", endpoint.method, endpoint.path, body, got.Error.Message)
+			}
+		}
+		// an empty body is as much a bad request, if not an invalid one
+		expectStatus(t, s.request(t, endpoint.method, endpoint.path, ""), http.StatusBadRequest)
+	}
+}
+
+func TestImageByDate(t *testing.T) {
+	s := newTestServer(t)
+
+	image := s.fetchImage(t, "2023-01-15")
+	if image.Date != "2023-01-15" || image.Title != stubImage("2023-01-15").Title {
+		t.Errorf("got image %+v, want that of 2023-01-15", image)
+	}
+	query := s.nasa.lastQuery()
+	if query.Get(DATE_PARAM) != "2023-01-15" || query.Has(COUNT_PARAM) {
+		t.Errorf("NASA was queried with %v, want date=2023-01-15 and no count", query)
+	}
+	expectStatus(t, s.get(t, "/image?"+DATE_PARAM+"="+FIRST_APOD_DATE), http.StatusOK)
+
+	calls := s.nasa.calls.Load()
+	for _, date := range []string{"15-01-2023", "2023-1-15", "2023-02-30", "yesterday", "1995-06-15", "2999-01-01", s.images.today() + "x"} {
+		resp := s.get(t, "/image?"+DATE_PARAM+"="+date)
+		expectStatus(t, resp, http.StatusBadRequest)
+	}
+	if s.nasa.calls.Load() != calls {
+		t.Errorf("invalid dates were sent to NASA")
+	}
+}
+
+func TestImageCount(t *testing.T) {
+	s := newTestServer(t)
+
+	resp := s.get(t, "/image?"+COUNT_PARAM+"=3")
+	expectStatus(t, resp, http.StatusOK)
+	var images []ImageResponse
+	resp.decode(t, &images)
+	if len(images) != 3 {
+		t.Fatalf("got %d images, want 3", len(images))
+	}
+	if query := s.nasa.lastQuery(); query.Get(COUNT_PARAM) != "3" {
+		t.Errorf("NASA was queried with %v, want count=3", query)
+	}
+	for _, image := range images {
+		expectStatus(t, s.get(t, "/image?"+URL_PARAM+"="+url.QueryEscape(image.Url)), http.StatusOK)
+	}
+
+	calls := s.nasa.calls.Load()
+	for _, count := range []string{"0", "-2", "51", "three", "2.5"} {
+		resp := s.get(t, "/image?"+COUNT_PARAM+"="+count)
+		expectStatus(t, resp, http.StatusBadRequest)
+	}
+	if s.nasa.calls.Load() != calls {
+		t.Errorf("invalid counts were sent to NASA")
+	}
+}
+
+func TestImageDateRange(t *testing.T) {
+	s := newTestServer(t)
+
+	resp := s.get(t, "/image?"+START_DATE_PARAM+"=2023-01-01&"+END_DATE_PARAM+"=2023-01-07")
+	expectStatus(t, resp, http.StatusOK)
+	var images []ImageResponse
+	resp.decode(t, &images)
+	if len(images) != 7 || images[0].Date != "2023-01-01" || images[6].Date != "2023-01-07" {
+		t.Fatalf("got %d images, want the 7 from 2023-01-01 to 2023-01-07", len(images))
+	}
+	if query := s.nasa.lastQuery(); query.Get(START_DATE_PARAM) != "2023-01-01" || query.Get(END_DATE_PARAM) != "2023-01-07" {
+		t.Errorf("NASA was queried with %v, want the range", query)
+	}
+	for _, image := range images {
+		expectStatus(t, s.get(t, "/image?"+URL_PARAM+"="+url.QueryEscape(image.Url)), http.StatusOK)
+	}
+
+	calls := s.nasa.calls.Load()
+	for name, query := range map[string]string{
+		"inverted":  START_DATE_PARAM + "=2023-01-07&" + END_DATE_PARAM + "=2023-01-01",
+		"over-long": START_DATE_PARAM + "=2023-01-01&" + END_DATE_PARAM + "=2023-04-11",
+		"open":      START_DATE_PARAM + "=2023-01-01",
+		"invalid":   START_DATE_PARAM + "=2023-01-01&" + END_DATE_PARAM + "=2023-13-01",
+	} {
+		resp := s.get(t, "/image?"+query)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s range: got status %d, want 400", name, resp.StatusCode)
+		}
+	}
+	// the longest range allowed is MAX_RANGE_DAYS days, both ends included
+	expectStatus(t, s.get(t, "/image?"+START_DATE_PARAM+"=2023-01-01&"+END_DATE_PARAM+"=2023-04-10"), http.StatusOK)
+	if s.nasa.calls.Load() != calls+1 {
+		t.Errorf("invalid ranges were sent to NASA")
+	}
+}
+
+func TestImagesByDates(t *testing.T) {
+	s := newTestServer(t, ATTEMPTS_ENV_VAR+"=1")
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get(DATE_PARAM) == "2023-02-14" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		apodImages(w, r)
+	})
+
+	resp := s.get(t, "/image?"+DATES_PARAM+"=2023-01-01,2023-02-14,2023-12-25")
+	expectStatus(t, resp, http.StatusOK)
+	var result DatesResult
+	resp.decode(t, &result)
+	if len(result.Images) != 2 || result.Images[0].Date != "2023-01-01" || result.Images[1].Date != "2023-12-25" {
+		t.Errorf("got images %+v, want those of 2023-01-01 and 2023-12-25 in order", result.Images)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Date != "2023-02-14" || result.Errors[0].Error != "NASA APOD responded 500 Internal Server Error" {
+		t.Errorf("got errors %+v, want 2023-02-14 alone", result.Errors)
+	}
+	if calls := s.nasa.calls.Load(); calls != 3 {
+		t.Errorf("got %d upstream calls, want one per date", calls)
+	}
+	for _, date := range []string{"2023-01-01", "2023-12-25"} {
+		expectStatus(t, s.get(t, "/image?"+URL_PARAM+"="+url.QueryEscape(stubImage(date).Url)), http.StatusOK)
+	}
+
+	// when every date fails so does the request
+	expectStatus(t, s.get(t, "/image?"+DATES_PARAM+"=2023-02-14"), http.StatusBadGateway)
+	expectStatus(t, s.get(t, "/image?"+DATES_PARAM+"=2023-01-01,bogus"), http.StatusBadRequest)
+}
+
+func TestImageDefaultMode(t *testing.T) {
+	for mode, want := range map[string]url.Values{
+		"":          {COUNT_PARAM: {"1"}},
+		MODE_RANDOM: {COUNT_PARAM: {"1"}},
+		MODE_TODAY:  nil,
+	} {
+		s := newTestServer(t, MODE_ENV_VAR+"="+mode)
+		if mode == MODE_TODAY {
+			want = url.Values{DATE_PARAM: {s.images.today()}}
+		}
+		expectStatus(t, s.get(t, "/image"), http.StatusOK)
+		if query := s.nasa.lastQuery(); query.Get(COUNT_PARAM) != want.Get(COUNT_PARAM) || query.Get(DATE_PARAM) != want.Get(DATE_PARAM) {
+			t.Errorf("%s=%q: NASA was queried with %v, want %v", MODE_ENV_VAR, mode, query, want)
+		}
+
+		// query params still override the default
+		s.fetchImage(t, "2023-01-15")
+		if query := s.nasa.lastQuery(); query.Get(DATE_PARAM) != "2023-01-15" || query.Has(COUNT_PARAM) {
+			t.Errorf("%s=%q: NASA was queried with %v for a date", MODE_ENV_VAR, mode, query)
+		}
+		expectStatus(t, s.get(t, "/image?"+COUNT_PARAM+"=2"), http.StatusOK)
+		if query := s.nasa.lastQuery(); query.Get(COUNT_PARAM) != "2" || query.Has(DATE_PARAM) {
+			t.Errorf("%s=%q: NASA was queried with %v for a count", MODE_ENV_VAR, mode, query)
+		}
+	}
+
+	t.Setenv(MODE_ENV_VAR, "latest")
+	expectPanic(t, MODE_ENV_VAR+"=latest", func() { imageDefaultMode() })
+}
+
+func TestGetStoredImage(t *testing.T) {
+	s := newTestServer(t)
+	image := s.fetchImage(t, "2024-01-01")
+	calls := s.nasa.calls.Load()
+
+	resp := s.get(t, "/image?"+URL_PARAM+"="+url.QueryEscape(image.Url))
+	expectStatus(t, resp, http.StatusOK)
+	var stored ImageResponse
+	resp.decode(t, &stored)
+	if !reflect.DeepEqual(stored.Image, image.Image) {
+		t.Errorf("got %+v, want the image fetched before, %+v", stored.Image, image.Image)
+	}
+
+	resp = s.get(t, "/image?"+URL_PARAM+"="+url.QueryEscape("https://apod.nasa.gov/apod/image/unknown.jpg"))
+	expectStatus(t, resp, http.StatusNotFound)
+	if code := resp.errorCode(t); code != "not_found" {
+		t.Errorf("got error code %q, want not_found", code)
+	}
+	if s.nasa.calls.Load() != calls {
+		t.Errorf("looking up stored images called NASA")
+	}
+}
+
+func TestImageETag(t *testing.T) {
+	s := newTestServer(t)
+	s.fetchImage(t, "2024-01-01")
+	s.fetchImage(t, "2024-01-02")
+	path := "/image?" + URL_PARAM + "=" + url.QueryEscape(stubImage("2024-01-01").Url)
+
+	first := s.get(t, path)
+	expectStatus(t, first, http.StatusOK)
+	etag := first.Header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("got no ETag")
+	}
+	other := s.get(t, "/image?"+URL_PARAM+"="+url.QueryEscape(stubImage("2024-01-02").Url)).Header.Get("ETag")
+	if other == etag {
+		t.Errorf("got ETag %s for two different images", etag)
+	}
+
+	for _, match := range []string{etag, "W/" + etag, other + ", " + etag, "*"} {
+		resp := s.get(t, path, "If-None-Match", match)
+		expectStatus(t, resp, http.StatusNotModified)
+		if len(resp.body) != 0 || resp.Header.Get("ETag") != etag {
+			t.Errorf("If-None-Match %s: got a 304 with body %q and ETag %q, want no body and the ETag", match, resp.body, resp.Header.Get("ETag"))
+		}
+	}
+	resp := s.get(t, path, "If-None-Match", other)
+	expectStatus(t, resp, http.StatusOK)
+	if string(resp.body) != string(first.body) {
+		t.Errorf("got body %q on a stale ETag, want the image again", resp.body)
+	}
+}
+
+func TestListImages(t *testing.T) {
+	s := newTestServer(t)
+	list := func(query string) []Image {
+		t.Helper()
+		resp := s.get(t, "/images"+query)
+		expectStatus(t, resp, http.StatusOK)
+		var images []Image
+		resp.decode(t, &images)
+		return images
+	}
+	dates := func(images []Image) []string {
+		var dates []string
+		for _, image := range images {
+			dates = append(dates, image.Date)
+		}
+		return dates
+	}
+
+	if images := list(""); len(images) != 0 {
+		t.Errorf("got %d images from an empty store", len(images))
+	}
+
+	for _, date := range []string{"2024-01-02", "2023-06-30", "2024-01-03"} {
+		if err := s.storage.SaveImage(stubImage(date)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"2024-01-03", "2024-01-02", "2023-06-30"}
+	if got := dates(list("")); !reflect.DeepEqual(got, want) {
+		t.Errorf("got dates %v, want most recent first %v", got, want)
+	}
+	for query, want := range map[string][]string{
+		"?limit=2":          {"2024-01-03", "2024-01-02"},
+		"?offset=1":         {"2024-01-02", "2023-06-30"},
+		"?limit=1&offset=2": {"2023-06-30"},
+		"?limit=10":         want,
+		"?limit=0":          nil,
+		"?offset=3":         nil,
+		"?offset=99":        nil,
+	} {
+		if got := dates(list(query)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got dates %v, want %v", query, got, want)
+		}
+	}
+	for _, query := range []string{"?limit=-1", "?offset=-1", "?limit=a"} {
+		expectStatus(t, s.get(t, "/images"+query), http.StatusBadRequest)
+	}
+}
+
+func TestRandomStoredImage(t *testing.T) {
+	s := newTestServer(t)
+	expectStatus(t, s.get(t, "/image/random"), http.StatusNotFound)
+
+	stored := map[string]bool{}
+	for _, date := range []string{"2024-01-01", "2024-01-02", "2024-01-03"} {
+		stored[s.fetchImage(t, date).Url] = true
+	}
+	calls := s.nasa.calls.Load()
+	picks := func(seed int64) []string {
+		t.Helper()
+		s.images.random = rand.New(rand.NewSource(seed))
+		var picked []string
+		for n := 0; n < 10; n++ {
+			resp := s.get(t, "/image/random")
+			expectStatus(t, resp, http.StatusOK)
+			var image ImageResponse
+			resp.decode(t, &image)
+			if !stored[image.Url] {
+				t.Errorf("got %s, which was never stored", image.Url)
+			}
+			picked = append(picked, image.Url)
+		}
+		return picked
+	}
+	// the same seed picks the same images
+	if first, again := picks(1), picks(1); !reflect.DeepEqual(first, again) {
+		t.Errorf("got picks %v then %v from the same seed", first, again)
+	}
+	if s.nasa.calls.Load() != calls {
+		t.Errorf("picking a stored image called NASA")
+	}
+}
+
+func TestVideoThumbnail(t *testing.T) {
+	s := newTestServer(t)
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+		w.Write([]byte(`{"date": "2024-02-01", "title": "A video", "explanation": "It moves",
+			"media_type": "video", "url": "https://www.youtube.com/embed/abc",
+			"thumbnail_url": "https://img.youtube.com/vi/abc/0.jpg", "service_version": "v1"}`))
+	})
+
+	image := s.fetchImage(t, "2024-02-01")
+	if image.MediaType != "video" || !image.IsVideo || image.ThumbnailURL != "https://img.youtube.com/vi/abc/0.jpg" {
+		t.Errorf("got %+v, want the video with its thumbnail", image)
+	}
+	if s.nasa.lastQuery().Get("thumbs") != "true" {
+		t.Errorf("NASA was queried with %v, without %s", s.nasa.lastQuery(), THUMBS_PARAM)
+	}
+
+	stored, err := s.storage.GetImage("https://www.youtube.com/embed/abc")
+	if err != nil || stored.ThumbnailURL != image.ThumbnailURL {
+		t.Errorf("got stored image %+v (%v), want it with its thumbnail", stored, err)
+	}
+}
+
+func TestImageEnrichment(t *testing.T) {
+	s := newTestServer(t)
+	image := s.fetchImage(t, "2023-07-04")
+	if image.Year != 2023 || image.Month != 7 || image.Day != 4 || image.IsVideo {
+		t.Errorf("got %+v, want 2023, 7, 4 and not a video", image)
+	}
+	// the image retrieval endpoint enriches the stored image alike
+	resp := s.get(t, "/image?"+URL_PARAM+"="+url.QueryEscape(image.Url))
+	expectStatus(t, resp, http.StatusOK)
+	var stored map[string]interface{}
+	resp.decode(t, &stored)
+	if stored["year"] != 2023.0 || stored["month"] != 7.0 || stored["day"] != 4.0 || stored["isVideo"] != false {
+		t.Errorf("got %v, want the computed fields", stored)
+	}
+
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+		w.Write([]byte(`{"date": "2023-07-05", "title": "A video", "media_type": "video", "url": "https://www.youtube.com/embed/xyz"}`))
+	})
+	if video := s.fetchImage(t, "2023-07-05"); !video.IsVideo || video.Day != 5 {
+		t.Errorf("got %+v, want a video on day 5", video)
+	}
+}
+
+func TestImageCopyrightAndHDUrl(t *testing.T) {
+	s := newTestServer(t)
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+		w.Write([]byte(`{"date": "2024-03-01", "title": "Nebula", "explanation": "Gas", "media_type": "image",
+			"url": "https://apod.nasa.gov/apod/image/2403/nebula.jpg",
+			"hdurl": "https://apod.nasa.gov/apod/image/2403/nebula_big.jpg", "copyright": "Jane Doe"}`))
+	})
+
+	resp := s.get(t, "/image?"+DATE_PARAM+"=2024-03-01")
+	expectStatus(t, resp, http.StatusOK)
+	var fields map[string]interface{}
+	resp.decode(t, &fields)
+	if fields["copyright"] != "Jane Doe" || fields["hdurl"] != "https://apod.nasa.gov/apod/image/2403/nebula_big.jpg" {
+		t.Errorf("got %v, want copyright and hdurl passed on", fields)
+	}
+
+	// images without them leave the fields out
+	image := stubImage("2024-03-02")
+	image.HDUrl = ""
+	if err := s.storage.SaveImage(image); err != nil {
+		t.Fatal(err)
+	}
+	resp = s.get(t, "/image?"+URL_PARAM+"="+url.QueryEscape(image.Url))
+	expectStatus(t, resp, http.StatusOK)
+	fields = nil
+	resp.decode(t, &fields)
+	if _, ok := fields["copyright"]; ok {
+		t.Errorf("got copyright in %v, want it left out", fields)
+	}
+	if _, ok := fields["hdurl"]; ok {
+		t.Errorf("got hdurl in %v, want it left out", fields)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	s := newTestServer(t)
+	for path, allowed := range map[string]string{
+		"/image":        "GET, POST, DELETE",
+		"/image/random": "GET",
+		"/images":       "GET",
+		"/user":         "GET, POST, PUT, DELETE",
+		"/rating":       "GET, POST, PUT, DELETE",
+		"/ratings/bulk": "POST",
+	} {
+		resp := s.request(t, http.MethodPatch, path, User{Email: "ada@example.com"})
+		expectStatus(t, resp, http.StatusMethodNotAllowed)
+		if got := resp.Header.Get("Allow"); got != allowed {
+			t.Errorf("PATCH %s: got Allow %q, want %q", path, got, allowed)
+		}
+		if code := resp.errorCode(t); code != "method_not_allowed" {
+			t.Errorf("PATCH %s: got error code %q, want method_not_allowed", path, code)
+		}
+	}
+	if s.nasa.calls.Load() != 0 {
+		t.Errorf("a request with a method not allowed reached NASA")
+	}
+}
+
+func TestHealth(t *testing.T) {
+	s := newTestServer(t)
+	resp := s.get(t, "/health")
+	expectStatus(t, resp, http.StatusOK)
+	var health Health
+	resp.decode(t, &health)
+	if health.Status != "ok" {
+		t.Errorf("got status %q, want ok", health.Status)
+	}
+	if _, err := time.ParseDuration(health.Uptime); err != nil {
+		t.Errorf("got uptime %q, want a duration", health.Uptime)
+	}
+	if calls := s.nasa.calls.Load(); calls != 0 {
+		t.Errorf("/health called NASA %d times", calls)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() { served <- serve(newServer(ln.Addr().String(), handler), ln, stop) }()
+
+	type result struct {
+		body string
+		err  error
+	}
+	inflight := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			inflight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		inflight <- result{string(body), err}
+	}()
+	<-started
+	stop <- syscall.SIGTERM
+
+	if err := <-served; err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if res := <-inflight; res.err != nil || res.body != "done" {
+		t.Errorf("in-flight request got %q, %v, want it to finish", res.body, res.err)
+	}
+	if _, err := http.Get("http://" + ln.Addr().String()); err == nil {
+		t.Errorf("server still accepts requests after shutting down")
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	t.Setenv(ADDR_ENV_VAR, "")
+	if addr := listenAddr(); addr != DEFAULT_ADDR {
+		t.Errorf("got %q without %s, want %q", addr, ADDR_ENV_VAR, DEFAULT_ADDR)
+	}
+
+	t.Setenv(ADDR_ENV_VAR, "127.0.0.1:0")
+	ln, err := net.Listen("tcp", listenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if host, _, _ := net.SplitHostPort(ln.Addr().String()); host != "127.0.0.1" {
+		t.Errorf("bound to %s, want 127.0.0.1", ln.Addr())
+	}
+
+	for _, addr := range []string{"8080", "localhost", ":http-alt", ":99999", ":-1"} {
+		t.Setenv(ADDR_ENV_VAR, addr)
+		expectPanic(t, ADDR_ENV_VAR+"="+addr, func() { listenAddr() })
+	}
+}
+
+func TestValidEmail(t *testing.T) {
+	for email, want := range map[string]bool{
+		"ada@example.com":        true,
+		"ada.lovelace+apod@x.io": true,
+		"  ada@example.com\t":    true,
+		"adaexample.com":         false,
+		"ada@":                   false,
+		"@example.com":           false,
+		"":                       false,
+		"Ada <ada@example.com>":  false,
+		"ada@example.com, b@x.y": false,
+	} {
+		if got := validEmail(email); got != want {
+			t.Errorf("validEmail(%q) = %v, want %v", email, got, want)
+		}
+	}
+}
+
+func TestInvalidEmailRejected(t *testing.T) {
+	s := newTestServer(t)
+	imageURL := stubImage("2024-01-01").Url
+	for _, email := range []string{"notanemail", "ada.example.com", "ada@"} {
+		for _, req := range []struct {
+			method, path string
+			body         User
+		}{
+			{POST, "/user", User{Email: email}},
+			{DELETE, "/user", User{Email: email}},
+			{POST, "/rating", User{Email: email, ImageURL: imageURL, Rating: 3}},
+			{PUT, "/rating", User{Email: email, ImageURL: imageURL, Rating: 3}},
+			{DELETE, "/rating", User{Email: email, ImageURL: imageURL}},
+			{GET, "/rating", User{Email: email}},
+		} {
+			resp := s.request(t, req.method, req.path, req.body)
+			expectStatus(t, resp, http.StatusBadRequest)
+			var body errorResponse
+			resp.decode(t, &body)
+			if body.Error.Message != "invalid email address" {
+				t.Errorf("%s %s with %q: got message %q", req.method, req.path, email, body.Error.Message)
+			}
+		}
+		expectStatus(t, s.get(t, "/rating?"+EMAIL_PARAM+"="+url.QueryEscape(email)), http.StatusBadRequest)
+	}
+
+	// surrounding whitespace is trimmed rather than rejected
+	s.createUser(t, "  ada@example.com ")
+	s.saveRating(t, "\tada@example.com", imageURL, 3)
+	if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 1 {
+		t.Errorf("got %d ratings for the trimmed email, want 1", len(ratings))
+	}
+}
+
+func TestRenameUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		s.createUser(t, "ada@example.com")
+		s.createUser(t, "grace@example.com")
+		s.saveRating(t, "ada@example.com", stubImage("2024-01-01").Url, 5)
+
+		resp := s.request(t, PUT, "/user", RenamedUser{Email: "ada@example.com", NewEmail: "Lovelace@Example.com"})
+		expectStatus(t, resp, http.StatusOK)
+		var renamed RenamedUser
+		resp.decode(t, &renamed)
+		if renamed != (RenamedUser{Email: "ada@example.com", NewEmail: "lovelace@example.com"}) {
+			t.Errorf("got %+v", renamed)
+		}
+		if ratings := s.ratingsOf(t, "lovelace@example.com"); len(ratings) != 1 || ratings[0].Rating != 5 {
+			t.Errorf("got ratings %+v after the rename, want the one saved before", ratings)
+		}
+		expectStatus(t, s.get(t, "/user?"+EMAIL_PARAM+"=ada@example.com"), http.StatusNotFound)
+
+		resp = s.request(t, PUT, "/user", RenamedUser{Email: "nobody@example.com", NewEmail: "somebody@example.com"})
+		expectStatus(t, resp, http.StatusNotFound)
+		resp = s.request(t, PUT, "/user", RenamedUser{Email: "lovelace@example.com", NewEmail: "grace@example.com"})
+		expectStatus(t, resp, http.StatusConflict)
+		if ratings := s.ratingsOf(t, "lovelace@example.com"); len(ratings) != 1 {
+			t.Errorf("a failed rename lost the user's ratings")
+		}
+
+		resp = s.request(t, PUT, "/user", `{"email": "lovelace@example.com"}`)
+		expectStatus(t, resp, http.StatusBadRequest)
+	})
+}
+
+func TestGetUser(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "ada@example.com")
+	for _, date := range []string{"2024-01-01", "2024-01-02", "2024-01-03"} {
+		s.saveRating(t, "ada@example.com", stubImage(date).Url, 4)
+	}
+
+	for _, resp := range []*testResponse{
+		s.get(t, "/user?"+EMAIL_PARAM+"=Ada@Example.com"),
+		s.request(t, GET, "/user", User{Email: "ada@example.com"}),
+	} {
+		expectStatus(t, resp, http.StatusOK)
+		var profile UserProfile
+		resp.decode(t, &profile)
+		if profile != (UserProfile{Email: "ada@example.com", RatingCount: 3}) {
+			t.Errorf("got profile %+v", profile)
+		}
+	}
+
+	expectStatus(t, s.get(t, "/user?"+EMAIL_PARAM+"=nobody@example.com"), http.StatusNotFound)
+	expectStatus(t, s.get(t, "/user"), http.StatusBadRequest)
+}
+
+func TestRatingStats(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "ada@example.com")
+	s.createUser(t, "grace@example.com")
+	for n, value := range []int{1, 3, 5} {
+		s.saveRating(t, "ada@example.com", stubImage(fmt.Sprintf("2024-01-0%d", n+1)).Url, value)
+	}
+	stats := func(email string) RatingStats {
+		t.Helper()
+		resp := s.get(t, "/rating/stats?"+EMAIL_PARAM+"="+email)
+		expectStatus(t, resp, http.StatusOK)
+		var stats RatingStats
+		resp.decode(t, &stats)
+		return stats
+	}
+
+	got := stats("ada@example.com")
+	if got.Count != 3 || got.Average == nil || *got.Average != 3.0 || got.Min == nil || *got.Min != 1 || got.Max == nil || *got.Max != 5 {
+		t.Errorf("got stats %+v", got)
+	}
+
+	resp := s.get(t, "/rating/stats?"+EMAIL_PARAM+"=grace@example.com")
+	expectStatus(t, resp, http.StatusOK)
+	var raw map[string]interface{}
+	resp.decode(t, &raw)
+	want := map[string]interface{}{"count": 0.0, "average": nil, "min": nil, "max": nil}
+	if !reflect.DeepEqual(raw, want) {
+		t.Errorf("got %v for a user without ratings, want %v", raw, want)
+	}
+
+	expectStatus(t, s.get(t, "/rating/stats?"+EMAIL_PARAM+"=nobody@example.com"), http.StatusNotFound)
+}
+
+func TestUserAndRatingLifecycle(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		first, second := stubImage("2024-01-01").Url, stubImage("2024-01-02").Url
+
+		s.createUser(t, "ada@example.com")
+		expectStatus(t, s.request(t, POST, "/user", User{Email: "ada@example.com"}), http.StatusConflict)
+		expectStatus(t, s.request(t, POST, "/rating", User{Email: "nobody@example.com", ImageURL: first, Rating: 3}), http.StatusNotFound)
+
+		s.saveRating(t, "ada@example.com", first, 3)
+		s.saveRating(t, "ada@example.com", second, 1)
+		expectStatus(t, s.request(t, POST, "/rating", User{Email: "ada@example.com", ImageURL: first, Rating: 4}), http.StatusConflict)
+
+		resp := s.request(t, PUT, "/rating", User{Email: "ada@example.com", ImageURL: first, Rating: 5})
+		expectStatus(t, resp, http.StatusOK)
+		var updated User
+		resp.decode(t, &updated)
+		if updated != (User{Email: "ada@example.com", ImageURL: first, Rating: 5}) {
+			t.Errorf("got updated rating %+v", updated)
+		}
+		expectStatus(t, s.request(t, PUT, "/rating", User{Email: "ada@example.com", ImageURL: stubImage("2024-01-03").Url, Rating: 5}), http.StatusNotFound)
+
+		ratings := s.ratingsOf(t, "ada@example.com")
+		if len(ratings) != 2 || ratings[0].ImageURL != first || ratings[0].Rating != 5 || ratings[1].ImageURL != second || ratings[1].Rating != 1 {
+			t.Errorf("got ratings %+v", ratings)
+		}
+
+		resp = s.request(t, DELETE, "/rating", User{Email: "ada@example.com", ImageURL: second})
+		expectStatus(t, resp, http.StatusNoContent)
+		expectStatus(t, s.request(t, DELETE, "/rating", User{Email: "ada@example.com", ImageURL: second}), http.StatusNotFound)
+
+		resp = s.request(t, DELETE, "/user", User{Email: "ada@example.com"})
+		expectStatus(t, resp, http.StatusOK)
+		var deleted DeletedUser
+		resp.decode(t, &deleted)
+		if deleted != (DeletedUser{Email: "ada@example.com", RatingsDeleted: 1}) {
+			t.Errorf("got %+v", deleted)
+		}
+		expectStatus(t, s.get(t, "/rating?"+EMAIL_PARAM+"=ada@example.com"), http.StatusNotFound)
+		expectStatus(t, s.request(t, DELETE, "/user", User{Email: "ada@example.com"}), http.StatusNotFound)
+	})
+}
+
+func TestGetRatingsEmail(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "ada@example.com")
+	s.saveRating(t, "ada@example.com", stubImage("2024-01-01").Url, 4)
+
+	for name, resp := range map[string]*testResponse{
+		"query param": s.get(t, "/rating?"+EMAIL_PARAM+"=ada@example.com"),
+		"body":        s.request(t, GET, "/rating", User{Email: "ada@example.com"}),
+		// the query param wins over the body
+		"both": s.request(t, GET, "/rating?"+EMAIL_PARAM+"=ada@example.com", User{Email: "grace@example.com"}),
+	} {
+		expectStatus(t, resp, http.StatusOK)
+		var ratings []RatingEntry
+		resp.decode(t, &ratings)
+		if len(ratings) != 1 || ratings[0].Rating != 4 {
+			t.Errorf("email in the %s: got ratings %+v, want ada's one rating", name, ratings)
+		}
+	}
+
+	resp := s.get(t, "/rating")
+	expectStatus(t, resp, http.StatusBadRequest)
+	var body errorResponse
+	resp.decode(t, &body)
+	if !strings.Contains(body.Error.Message, "query param 'email'") {
+		t.Errorf("got message %q, want it to point at the query param", body.Error.Message)
+	}
+	expectStatus(t, s.get(t, "/rating?"+EMAIL_PARAM+"=not-an-email"), http.StatusBadRequest)
+}
+
+func TestClearRatings(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		s.createUser(t, "ada@example.com")
+		s.createUser(t, "grace@example.com")
+		for _, date := range []string{"2024-01-01", "2024-01-02", "2024-01-03"} {
+			s.saveRating(t, "ada@example.com", stubImage(date).Url, 3)
+		}
+		s.saveRating(t, "grace@example.com", stubImage("2024-01-01").Url, 5)
+
+		expectStatus(t, s.request(t, DELETE, "/rating/all", User{Email: "ada@example.com"}), http.StatusNoContent)
+		if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 0 {
+			t.Errorf("got ratings %+v after clearing them, want none", ratings)
+		}
+		if ratings := s.ratingsOf(t, "grace@example.com"); len(ratings) != 1 {
+			t.Errorf("clearing ada's ratings left grace with %+v, want the one rating of grace kept", ratings)
+		}
+		expectStatus(t, s.get(t, "/user?"+EMAIL_PARAM+"=ada@example.com"), http.StatusOK)
+
+		expectStatus(t, s.request(t, DELETE, "/rating/all", User{Email: "nobody@example.com"}), http.StatusNotFound)
+	})
+}
+
+func TestTopRatings(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		fetched := s.fetchImage(t, "2024-01-01")
+		other := stubImage("2024-01-02").Url
+		for email, values := range map[string][2]int{
+			"ada@example.com":   {5, 4},
+			"grace@example.com": {3, 4},
+			"alan@example.com":  {0, 4},
+		} {
+			s.createUser(t, email)
+			if values[0] != 0 {
+				s.saveRating(t, email, fetched.Url, values[0])
+			}
+			s.saveRating(t, email, other, values[1])
+		}
+
+		top := func(query string) []TopImage {
+			t.Helper()
+			resp := s.get(t, "/ratings/top"+query)
+			expectStatus(t, resp, http.StatusOK)
+			var top []TopImage
+			resp.decode(t, &top)
+			return top
+		}
+		// both average 4, the one with more raters comes first
+		got := top("")
+		if len(got) != 2 || got[0].ImageURL != other || got[0].Count != 3 || got[1].ImageURL != fetched.Url || got[1].Count != 2 || got[1].Average != 4 {
+			t.Fatalf("got %+v, want %s rated by 3 then %s rated by 2", got, other, fetched.Url)
+		}
+		if got[0].Image != nil || got[1].Image == nil || got[1].Image.Title != fetched.Title {
+			t.Errorf("got images %+v and %+v, want only the fetched one attached", got[0].Image, got[1].Image)
+		}
+
+		s.saveRating(t, "alan@example.com", fetched.Url, 5)
+		if got := top("?" + LIMIT_PARAM + "=1"); len(got) != 1 || got[0].ImageURL != fetched.Url || got[0].Average != 13.0/3 {
+			t.Errorf("got %+v, want only %s, now averaging 13/3", got, fetched.Url)
+		}
+		expectStatus(t, s.get(t, "/ratings/top?"+LIMIT_PARAM+"=-1"), http.StatusBadRequest)
+	})
+}
+
+func TestRatingResponses(t *testing.T) {
+	s := newTestServer(t)
+	imageURL := stubImage("2024-01-01").Url
+	s.createUser(t, "Ada@Example.com")
+
+	for _, c := range []struct {
+		method string
+		rating int
+		status int
+	}{{POST, 4, http.StatusCreated}, {PUT, 2, http.StatusOK}} {
+		resp := s.request(t, c.method, "/rating", User{Email: "Ada@Example.com", ImageURL: imageURL, Rating: c.rating})
+		expectStatus(t, resp, c.status)
+		if got := resp.Header.Get(CONTENT_TYPE); got != APPLICATION_JSON {
+			t.Errorf("%s /rating: got content-type %q, want %q", c.method, got, APPLICATION_JSON)
+		}
+		var body map[string]interface{}
+		resp.decode(t, &body)
+		want := map[string]interface{}{"email": "ada@example.com", "imageURL": imageURL, "rating": float64(c.rating)}
+		if !reflect.DeepEqual(body, want) {
+			t.Errorf("%s /rating: got %v, want %v", c.method, body, want)
+		}
+	}
+}
+
+func TestNoContentHasNoBody(t *testing.T) {
+	s := newTestServer(t)
+	imageURL := stubImage("2024-01-01").Url
+	s.createUser(t, "ada@example.com")
+	s.saveRating(t, "ada@example.com", imageURL, 4)
+	s.saveRating(t, "ada@example.com", stubImage("2024-01-02").Url, 4)
+	s.saveRating(t, "ada@example.com", stubImage("2024-01-03").Url, 4)
+
+	for _, resp := range []*testResponse{
+		s.request(t, DELETE, "/rating", User{Email: "ada@example.com", ImageURL: imageURL}),
+		s.request(t, DELETE, "/rating/ada@example.com/"+url.PathEscape(stubImage("2024-01-03").Url), nil),
+		s.request(t, DELETE, "/rating/all", User{Email: "ada@example.com"}),
+	} {
+		expectStatus(t, resp, http.StatusNoContent)
+		if len(resp.body) != 0 || resp.Header.Get(CONTENT_TYPE) != "" {
+			t.Errorf("%s %s: got a 204 with body %q and content-type %q, want neither", resp.Request.Method, resp.Request.URL.Path, resp.body, resp.Header.Get(CONTENT_TYPE))
+		}
+	}
+}
+
+func TestUnknownFieldsRejected(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "ada@example.com")
+	for _, c := range []struct {
+		method, path, body, field string
+	}{
+		{POST, "/user", `{"emial": "ada@example.com"}`, `"emial"`},
+		// newEmail only makes sense when renaming
+		{POST, "/user", `{"email": "grace@example.com", "newEmail": "alan@example.com"}`, `"newEmail"`},
+		{POST, "/rating", `{"email": "ada@example.com", "image_url": "https://apod.nasa.gov/apod/image/a.jpg", "rating": 4}`, `"image_url"`},
+		{PUT, "/user", `{"email": "ada@example.com", "newEmial": "grace@example.com"}`, `"newEmial"`},
+	} {
+		resp := s.request(t, c.method, c.path, c.body)
+		expectStatus(t, resp, http.StatusBadRequest)
+		var body errorResponse
+		resp.decode(t, &body)
+		if !strings.Contains(body.Error.Message, "unknown field "+c.field) {
+			t.Errorf("%s %s %s: got message %q, want it to name the field %s", c.method, c.path, c.body, body.Error.Message, c.field)
+		}
+	}
+	expectStatus(t, s.get(t, "/user?"+EMAIL_PARAM+"=grace@example.com"), http.StatusNotFound)
+	expectStatus(t, s.get(t, "/user?"+EMAIL_PARAM+"=ada@example.com"), http.StatusOK)
+}
+
+func TestRatingsPagination(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "ada@example.com")
+	values := map[string]int{"2024-01-01": 3, "2024-01-02": 5, "2024-01-03": 1, "2024-01-04": 5, "2024-01-05": 2}
+	for date, value := range values {
+		s.saveRating(t, "ada@example.com", stubImage(date).Url, value)
+	}
+	page := func(query string) []string {
+		t.Helper()
+		resp := s.get(t, "/rating?"+EMAIL_PARAM+"=ada@example.com"+query)
+		expectStatus(t, resp, http.StatusOK)
+		var ratings []RatingEntry
+		resp.decode(t, &ratings)
+		dates := []string{}
+		for _, entry := range ratings {
+			date := strings.TrimSuffix(path.Base(entry.ImageURL), ".jpg")
+			if entry.Rating != values[date] {
+				t.Errorf("got rating %d of %s, want %d", entry.Rating, date, values[date])
+			}
+			dates = append(dates, date)
+		}
+		return dates
+	}
+
+	for query, want := range map[string][]string{
+		"":                              {"2024-01-01", "2024-01-02", "2024-01-03", "2024-01-04", "2024-01-05"},
+		"&sort=url":                     {"2024-01-01", "2024-01-02", "2024-01-03", "2024-01-04", "2024-01-05"},
+		"&sort=rating":                  {"2024-01-02", "2024-01-04", "2024-01-01", "2024-01-05", "2024-01-03"},
+		"&limit=2":                      {"2024-01-01", "2024-01-02"},
+		"&limit=2&offset=4":             {"2024-01-05"},
+		"&sort=rating&limit=2&offset=1": {"2024-01-04", "2024-01-01"},
+		"&limit=0":                      {},
+		"&limit=10":                     {"2024-01-01", "2024-01-02", "2024-01-03", "2024-01-04", "2024-01-05"},
+		"&offset=5":                     {},
+		"&offset=50":                    {},
+	} {
+		if got := page(query); !reflect.DeepEqual(got, want) {
+			t.Errorf("GET /rating%s: got %v, want %v", query, got, want)
+		}
+	}
+	for _, query := range []string{"&limit=-1", "&offset=x", "&sort=title"} {
+		expectStatus(t, s.get(t, "/rating?"+EMAIL_PARAM+"=ada@example.com"+query), http.StatusBadRequest)
+	}
+}
+
+func TestBulkRatings(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		rated, fresh := stubImage("2024-01-01").Url, stubImage("2024-01-02").Url
+		s.createUser(t, "ada@example.com")
+		s.saveRating(t, "ada@example.com", rated, 4)
+
+		resp := s.request(t, POST, "/ratings/bulk", BulkRatings{Email: "ada@example.com", Ratings: []ImageRating{
+			{ImageURL: rated, Rating: 2},
+			{ImageURL: fresh, Rating: 5},
+			{ImageURL: stubImage("2024-01-03").Url, Rating: 9},
+			{ImageURL: fresh, Rating: 1},
+			{ImageURL: "not a url", Rating: 3},
+		}})
+		expectStatus(t, resp, http.StatusOK)
+		var results []BulkResult
+		resp.decode(t, &results)
+		want := []string{"duplicate", "saved", "invalid", "duplicate", "invalid"}
+		if len(results) != len(want) {
+			t.Fatalf("got %d results, want %d", len(results), len(want))
+		}
+		for n, status := range want {
+			if results[n].Status != status || (status == "saved") != (results[n].Error == "") {
+				t.Errorf("item %d: got %+v, want status %s", n, results[n], status)
+			}
+		}
+
+		ratings := s.ratingsOf(t, "ada@example.com")
+		if len(ratings) != 2 || ratings[0].ImageURL != rated || ratings[0].Rating != 4 || ratings[1].ImageURL != fresh || ratings[1].Rating != 5 {
+			t.Errorf("got ratings %+v, want only the new rating added, the existing one untouched", ratings)
+		}
+		resp = s.request(t, POST, "/ratings/bulk", BulkRatings{Email: "nobody@example.com", Ratings: []ImageRating{{ImageURL: fresh, Rating: 5}}})
+		expectStatus(t, resp, http.StatusNotFound)
+	})
+}
+
+func TestMissingAPIKey(t *testing.T) {
+	s := newTestServer(t, API_KEY_ENV_VAR+"=", DEMO_KEY_ENV_VAR+"=")
+
+	resp := s.get(t, "/image?"+DATE_PARAM+"=2024-01-01")
+	expectStatus(t, resp, http.StatusServiceUnavailable)
+	var body errorResponse
+	resp.decode(t, &body)
+	if body.Error.Message != "NASA API key not configured" {
+		t.Errorf("got message %q, want it to say the key is missing", body.Error.Message)
+	}
+	if s.nasa.calls.Load() != 0 {
+		t.Errorf("NASA was called without a key")
+	}
+
+	s.createUser(t, "ada@example.com")
+	s.saveRating(t, "ada@example.com", stubImage("2024-01-01").Url, 5)
+	if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 1 {
+		t.Errorf("got %d ratings, want 1", len(ratings))
+	}
+}
+
+func TestUpsertRating(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		imageURL := stubImage("2024-01-01").Url
+		s.createUser(t, "ada@example.com")
+		upsert := "/rating?" + UPSERT_PARAM + "=true"
+
+		resp := s.request(t, POST, upsert, User{Email: "ada@example.com", ImageURL: imageURL, Rating: 3})
+		expectStatus(t, resp, http.StatusCreated)
+		resp = s.request(t, POST, upsert, User{Email: "ada@example.com", ImageURL: imageURL, Rating: 5})
+		expectStatus(t, resp, http.StatusOK)
+		var saved User
+		resp.decode(t, &saved)
+		if saved.Rating != 5 {
+			t.Errorf("got rating %d echoed, want 5", saved.Rating)
+		}
+		if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 1 || ratings[0].Rating != 5 {
+			t.Errorf("got ratings %+v, want the one rating updated to 5", ratings)
+		}
+
+		// creating stays strict by default
+		expectStatus(t, s.request(t, POST, "/rating", User{Email: "ada@example.com", ImageURL: imageURL, Rating: 1}), http.StatusConflict)
+		expectStatus(t, s.request(t, POST, "/rating?"+UPSERT_PARAM+"=maybe", User{Email: "ada@example.com", ImageURL: imageURL, Rating: 1}), http.StatusBadRequest)
+	})
+}
+
+func TestImageRaters(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		popular, other := stubImage("2024-01-01").Url, stubImage("2024-01-02").Url
+		for email, value := range map[string]int{"ada@example.com": 5, "grace@example.com": 4, "alan@example.com": 2} {
+			s.createUser(t, email)
+			s.saveRating(t, email, popular, value)
+		}
+		s.saveRating(t, "ada@example.com", other, 1)
+
+		raters := func(raw string) ImageRaters {
+			t.Helper()
+			resp := s.get(t, "/image/raters?"+URL_PARAM+"="+url.QueryEscape(raw))
+			expectStatus(t, resp, http.StatusOK)
+			var raters ImageRaters
+			resp.decode(t, &raters)
+			return raters
+		}
+		// the URL is normalized like the ratings' own
+		if got := raters(strings.Replace(popular, "https", "http", 1)); got.ImageURL != popular || got.Raters != 3 || got.Average == nil || *got.Average != 11.0/3 {
+			t.Errorf("got %+v, want 3 raters averaging 11/3", got)
+		}
+		if got := raters(other); got.Raters != 1 || got.Average == nil || *got.Average != 1 {
+			t.Errorf("got %+v, want 1 rater averaging 1", got)
+		}
+		if got := raters(stubImage("2024-01-03").Url); got.Raters != 0 || got.Average != nil {
+			t.Errorf("got %+v, want no raters and a null average", got)
+		}
+		expectStatus(t, s.get(t, "/image/raters"), http.StatusBadRequest)
+	})
+}
+
+func TestEmptyImageURLRejected(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "ada@example.com")
+	for _, method := range []string{POST, PUT, DELETE} {
+		resp := s.request(t, method, "/rating", User{Email: "ada@example.com", Rating: 3})
+		expectStatus(t, resp, http.StatusBadRequest)
+		var body errorResponse
+		resp.decode(t, &body)
+		if len(body.Error.Fields) != 1 || body.Error.Fields[0].Field != "imageURL" {
+			t.Errorf("%s /rating: got fields %+v, want imageURL alone at fault", method, body.Error.Fields)
+		}
+	}
+	if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 0 {
+		t.Errorf("got ratings %+v, want none", ratings)
+	}
+}
+
+func TestRatingNotFound(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		rated, unrated := stubImage("2024-01-01").Url, stubImage("2024-01-02").Url
+		s.createUser(t, "ada@example.com")
+		s.saveRating(t, "ada@example.com", rated, 4)
+
+		for _, c := range []struct {
+			method string
+			path   string
+			body   interface{}
+			status int
+		}{
+			{GET, "/rating?" + EMAIL_PARAM + "=nobody@example.com", nil, http.StatusNotFound},
+			{POST, "/rating", User{Email: "nobody@example.com", ImageURL: rated, Rating: 3}, http.StatusNotFound},
+			{PUT, "/rating", User{Email: "nobody@example.com", ImageURL: rated, Rating: 3}, http.StatusNotFound},
+			{DELETE, "/rating", User{Email: "nobody@example.com", ImageURL: rated}, http.StatusNotFound},
+			{PUT, "/rating", User{Email: "ada@example.com", ImageURL: unrated, Rating: 3}, http.StatusNotFound},
+			{DELETE, "/rating", User{Email: "ada@example.com", ImageURL: unrated}, http.StatusNotFound},
+			// validation failures stay 400s
+			{GET, "/rating?" + EMAIL_PARAM + "=nobody", nil, http.StatusBadRequest},
+			{DELETE, "/rating", User{Email: "ada@example.com", ImageURL: "nope"}, http.StatusBadRequest},
+		} {
+			resp := s.request(t, c.method, c.path, c.body)
+			if resp.StatusCode != c.status {
+				t.Errorf("%s %s %+v: got status %d, want %d", c.method, c.path, c.body, resp.StatusCode, c.status)
+			} else if c.status == http.StatusNotFound && resp.errorCode(t) != "not_found" {
+				t.Errorf("%s %s %+v: got error code %q, want not_found", c.method, c.path, c.body, resp.errorCode(t))
+			}
+		}
+	})
+}
+
+func TestRatingByPath(t *testing.T) {
+	s := newTestServer(t)
+	imageURL := stubImage("2024-01-01").Url
+	s.createUser(t, "ada@example.com")
+	s.saveRating(t, "ada@example.com", imageURL, 4)
+	path := "/rating/ada@example.com/" + url.PathEscape(imageURL)
+
+	read := func() User {
+		t.Helper()
+		resp := s.get(t, path)
+		expectStatus(t, resp, http.StatusOK)
+		var usr User
+		resp.decode(t, &usr)
+		return usr
+	}
+	if got := read(); got != (User{Email: "ada@example.com", ImageURL: imageURL, Rating: 4}) {
+		t.Errorf("got %+v, want the rating of 4", got)
+	}
+	expectStatus(t, s.request(t, PUT, path, `{"rating": 2}`), http.StatusOK)
+	if got := read(); got.Rating != 2 {
+		t.Errorf("got %+v, want the rating updated to 2", got)
+	}
+	expectStatus(t, s.request(t, PUT, path, `{"rating": 9}`), http.StatusBadRequest)
+
+	expectStatus(t, s.request(t, DELETE, path, nil), http.StatusNoContent)
+	expectStatus(t, s.get(t, path), http.StatusNotFound)
+	if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 0 {
+		t.Errorf("got ratings %+v through the body based API, want none", ratings)
+	}
+	expectStatus(t, s.get(t, "/rating/nobody@example.com/"+url.PathEscape(imageURL)), http.StatusNotFound)
+	expectStatus(t, s.get(t, "/rating/ada@example.com/not-a-url"), http.StatusBadRequest)
+}
+
+func TestEmailCaseInsensitive(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		imageURL := stubImage("2024-01-01").Url
+		resp := s.request(t, POST, "/user", User{Email: " Ada@Example.COM"})
+		expectStatus(t, resp, http.StatusCreated)
+		var created UserProfile
+		resp.decode(t, &created)
+		if created.Email != "ada@example.com" {
+			t.Errorf("got user %q created, want the normalized email", created.Email)
+		}
+		expectStatus(t, s.request(t, POST, "/user", User{Email: "ada@example.com"}), http.StatusConflict)
+
+		if saved := s.saveRating(t, "ADA@example.com", imageURL, 4); saved.Email != "ada@example.com" {
+			t.Errorf("got rating saved for %q, want the normalized email", saved.Email)
+		}
+		resp = s.get(t, "/user?"+EMAIL_PARAM+"=aDa@eXample.com")
+		expectStatus(t, resp, http.StatusOK)
+		var profile UserProfile
+		resp.decode(t, &profile)
+		if profile != (UserProfile{Email: "ada@example.com", RatingCount: 1}) {
+			t.Errorf("got %+v, want the one user with a single rating", profile)
+		}
+		if ratings := s.ratingsOf(t, "Ada@Example.com"); len(ratings) != 1 {
+			t.Errorf("got ratings %+v, want the one rating", ratings)
+		}
+	})
+}
+
+func TestRatingTimestamps(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		imageURL := stubImage("2024-01-01").Url
+		s.createUser(t, "ada@example.com")
+		before := time.Now()
+		s.saveRating(t, "ada@example.com", imageURL, 4)
+
+		saved := s.ratingsOf(t, "ada@example.com")[0]
+		if saved.CreatedAt.Before(before) || saved.CreatedAt.After(time.Now()) || !saved.UpdatedAt.Equal(saved.CreatedAt) {
+			t.Errorf("got created %v and updated %v, want both set to when it was saved", saved.CreatedAt, saved.UpdatedAt)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		expectStatus(t, s.request(t, PUT, "/rating", User{Email: "ada@example.com", ImageURL: imageURL, Rating: 2}), http.StatusOK)
+		updated := s.ratingsOf(t, "ada@example.com")[0]
+		if !updated.CreatedAt.Equal(saved.CreatedAt) || !updated.UpdatedAt.After(saved.UpdatedAt) {
+			t.Errorf("got created %v and updated %v after a PUT, want only updated moved on from %v", updated.CreatedAt, updated.UpdatedAt, saved.UpdatedAt)
+		}
+	})
+}
+
+func TestRatingsSortOrders(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		s.createUser(t, "ada@example.com")
+		values := map[string]int{"2024-01-01": 2, "2024-01-02": 5, "2024-01-03": 3}
+		for date, value := range values {
+			s.saveRating(t, "ada@example.com", stubImage(date).Url, value)
+		}
+		// updates in a known order, the first image ending up the most recent
+		for _, date := range []string{"2024-01-02", "2024-01-03", "2024-01-01"} {
+			time.Sleep(5 * time.Millisecond)
+			expectStatus(t, s.request(t, PUT, "/rating", User{Email: "ada@example.com", ImageURL: stubImage(date).Url, Rating: values[date]}), http.StatusOK)
+		}
+
+		for order, want := range map[string][]string{
+			"":       {"2024-01-01", "2024-01-02", "2024-01-03"},
+			"url":    {"2024-01-01", "2024-01-02", "2024-01-03"},
+			"rating": {"2024-01-02", "2024-01-03", "2024-01-01"},
+			"recent": {"2024-01-01", "2024-01-03", "2024-01-02"},
+		} {
+			resp := s.get(t, "/rating?"+EMAIL_PARAM+"=ada@example.com&"+SORT_PARAM+"="+order)
+			expectStatus(t, resp, http.StatusOK)
+			var ratings []RatingEntry
+			resp.decode(t, &ratings)
+			var got []string
+			for _, entry := range ratings {
+				got = append(got, strings.TrimSuffix(path.Base(entry.ImageURL), ".jpg"))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("sort=%s: got %v, want %v", order, got, want)
+			}
+		}
+	})
+}
+
+func TestCreateImage(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		image := Image{Date: "1999-05-01", Title: "Imported", Url: "https://apod.nasa.gov/apod/image/9905/imported.jpg"}
+
+		resp := s.request(t, POST, "/image", image)
+		expectStatus(t, resp, http.StatusCreated)
+		var created ImageResponse
+		resp.decode(t, &created)
+		if created.MediaType != "image" || created.Year != 1999 {
+			t.Errorf("got %+v, want the image with media_type defaulted and its computed fields", created)
+		}
+		if stored, err := s.storage.GetImage(imageURL(image.Url)); err != nil || stored.Title != "Imported" {
+			t.Errorf("got stored image %+v (%v), want the one posted", stored, err)
+		}
+
+		image.Title = "Reimported"
+		expectStatus(t, s.request(t, POST, "/image", image), http.StatusConflict)
+		expectStatus(t, s.request(t, POST, "/image?"+OVERWRITE_PARAM+"=true", image), http.StatusOK)
+		if stored, _ := s.storage.GetImage(imageURL(image.Url)); stored.Title != "Reimported" {
+			t.Errorf("got stored title %q, want it overwritten", stored.Title)
+		}
+
+		for _, invalid := range []Image{{Url: image.Url}, {Date: "1999-05-01"}, {Date: "1999-05-01", Url: "ftp://apod.nasa.gov/a.jpg"}, {Date: "1990-01-01", Url: image.Url}} {
+			expectStatus(t, s.request(t, POST, "/image", invalid), http.StatusBadRequest)
+		}
+		if s.nasa.calls.Load() != 0 {
+			t.Errorf("storing an image called NASA")
+		}
+	})
+}
+
+func TestDeleteImage(t *testing.T) {
+	s := newTestServer(t)
+	kept, cascaded := s.fetchImage(t, "2024-01-01"), s.fetchImage(t, "2024-01-02")
+	s.createUser(t, "ada@example.com")
+	s.saveRating(t, "ada@example.com", kept.Url, 4)
+	s.saveRating(t, "ada@example.com", cascaded.Url, 4)
+
+	expectStatus(t, s.request(t, DELETE, "/image?"+URL_PARAM+"="+url.QueryEscape(kept.Url), nil), http.StatusNoContent)
+	expectStatus(t, s.get(t, "/image?"+URL_PARAM+"="+url.QueryEscape(kept.Url)), http.StatusNotFound)
+	expectStatus(t, s.request(t, DELETE, "/image?"+URL_PARAM+"="+url.QueryEscape(kept.Url), nil), http.StatusNotFound)
+	if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 2 {
+		t.Errorf("got ratings %+v, want both kept without cascade", ratings)
+	}
+
+	expectStatus(t, s.request(t, DELETE, "/image?"+URL_PARAM+"="+url.QueryEscape(cascaded.Url)+"&"+CASCADE_PARAM+"=true", nil), http.StatusNoContent)
+	if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 1 || ratings[0].ImageURL != kept.Url {
+		t.Errorf("got ratings %+v, want the cascaded image's rating gone", ratings)
+	}
+	expectStatus(t, s.request(t, DELETE, "/image", nil), http.StatusBadRequest)
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser(t, "ada@example.com")
+	for _, c := range []struct {
+		method, path string
+		body         interface{}
+		status       int
+		code         string
+	}{
+		{http.MethodPatch, "/user", nil, http.StatusMethodNotAllowed, "method_not_allowed"},
+		{POST, "/user", User{Email: "ada@example.com"}, http.StatusConflict, "conflict"},
+		{GET, "/user?" + EMAIL_PARAM + "=nobody@example.com", nil, http.StatusNotFound, "not_found"},
+		{POST, "/rating", User{Email: "ada@example.com"}, http.StatusBadRequest, "bad_request"},
+		{POST, "/user", "{", http.StatusBadRequest, "bad_request"},
+		{GET, "/image?" + COUNT_PARAM + "=0", nil, http.StatusBadRequest, "bad_request"},
+		{GET, "/nowhere", nil, http.StatusNotFound, "not_found"},
+	} {
+		resp := s.request(t, c.method, c.path, c.body)
+		expectStatus(t, resp, c.status)
+		if got := resp.Header.Get(CONTENT_TYPE); got != APPLICATION_JSON {
+			t.Errorf("%s %s: got content-type %q, want %q", c.method, c.path, got, APPLICATION_JSON)
+		}
+		var envelope map[string]map[string]interface{}
+		resp.decode(t, &envelope)
+		message, _ := envelope["error"]["message"].(string)
+		if len(envelope) != 1 || envelope["error"]["code"] != c.code || message == "" {
+			t.Errorf("%s %s: got %s, want an error envelope with code %s and a message", c.method, c.path, resp.body, c.code)
+		}
+	}
+	// a body sent as anything but JSON is turned away in JSON too
+	resp := s.request(t, POST, "/user", `{"email": "grace@example.com"}`, CONTENT_TYPE, "text/plain")
+	expectStatus(t, resp, http.StatusUnsupportedMediaType)
+	if code := resp.errorCode(t); code != "unsupported_media_type" {
+		t.Errorf("got error code %q, want unsupported_media_type", code)
+	}
+}
+
+func TestConceptTags(t *testing.T) {
+	s := newTestServer(t)
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+		if r.URL.Query().Get(DATE_PARAM) == "2010-03-01" && r.URL.Query().Get(CONCEPT_TAGS) == "true" {
+			w.Write([]byte(`{"date": "2010-03-01", "title": "Tagged", "media_type": "image", "url": "https://apod.nasa.gov/apod/image/1003/tagged.jpg",
+				"concept_tags": ["galaxy", "nebula"]}`))
+			return
+		}
+		apodImages(w, r)
+	})
+
+	resp := s.get(t, "/image?"+DATE_PARAM+"=2010-03-01&"+CONCEPT_TAGS+"=true")
+	expectStatus(t, resp, http.StatusOK)
+	var tagged ImageResponse
+	resp.decode(t, &tagged)
+	if !reflect.DeepEqual(tagged.ConceptTags, []string{"galaxy", "nebula"}) {
+		t.Errorf("got concept tags %v, want galaxy and nebula", tagged.ConceptTags)
+	}
+
+	// tags are off by default, and an image without any just comes without
+	image := s.fetchImage(t, "2024-01-01")
+	if s.nasa.lastQuery().Has(CONCEPT_TAGS) || image.ConceptTags != nil {
+		t.Errorf("NASA was queried with %v, want no %s by default", s.nasa.lastQuery(), CONCEPT_TAGS)
+	}
+	resp = s.get(t, "/image?"+DATE_PARAM+"=2024-01-02&"+CONCEPT_TAGS+"=true")
+	expectStatus(t, resp, http.StatusOK)
+	var untagged map[string]interface{}
+	resp.decode(t, &untagged)
+	if _, ok := untagged[CONCEPT_TAGS]; ok {
+		t.Errorf("got %v, want no concept tags when NASA returns none", untagged)
+	}
+	expectStatus(t, s.get(t, "/image?"+CONCEPT_TAGS+"=sure"), http.StatusBadRequest)
+}
+
+func TestMaxUsers(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, append(env, USERS_ENV_VAR+"=3")...)
+		for n := 0; n < 3; n++ {
+			s.createUser(t, fmt.Sprintf("user%d@example.com", n))
+		}
+		resp := s.request(t, POST, "/user", User{Email: "late@example.com"})
+		expectStatus(t, resp, http.StatusInsufficientStorage)
+
+		// a deleted user frees a place
+		expectStatus(t, s.request(t, DELETE, "/user", User{Email: "user0@example.com"}), http.StatusOK)
+		s.createUser(t, "late@example.com")
+	})
+
+	// creates racing for the last places can't overshoot the cap
+	s := newTestServer(t, USERS_ENV_VAR+"=5")
+	statuses := make(chan int, 20)
+	for n := 0; n < 20; n++ {
+		go func() {
+			resp, err := s.Client().Post(s.URL+"/user", APPLICATION_JSON, strings.NewReader(fmt.Sprintf(`{"email": "racer%d@example.com"}`, n)))
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	created := 0
+	for n := 0; n < 20; n++ {
+		switch status := <-statuses; status {
+		case http.StatusCreated:
+			created++
+		case http.StatusInsufficientStorage:
+		default:
+			t.Errorf("got status %d creating a user, want 201 or 507", status)
+		}
+	}
+	if created != 5 {
+		t.Errorf("created %d users concurrently, want the cap of 5", created)
+	}
+
+	t.Setenv(USERS_ENV_VAR, "-1")
+	expectPanic(t, USERS_ENV_VAR+"=-1", func() { maxUsers() })
+}
+
+func TestMaxRatingsPerUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, append(env, RATINGS_ENV_VAR+"=2")...)
+		first, second, third := stubImage("2024-01-01").Url, stubImage("2024-01-02").Url, stubImage("2024-01-03").Url
+		s.createUser(t, "ada@example.com")
+		s.saveRating(t, "ada@example.com", first, 3)
+		s.saveRating(t, "ada@example.com", second, 4)
+
+		resp := s.request(t, POST, "/rating", User{Email: "ada@example.com", ImageURL: third, Rating: 5})
+		expectStatus(t, resp, http.StatusInsufficientStorage)
+		expectStatus(t, s.request(t, POST, "/rating?"+UPSERT_PARAM+"=true", User{Email: "ada@example.com", ImageURL: third, Rating: 5}), http.StatusInsufficientStorage)
+		var results []BulkResult
+		resp = s.request(t, POST, "/ratings/bulk", BulkRatings{Email: "ada@example.com", Ratings: []ImageRating{{ImageURL: third, Rating: 5}}})
+		expectStatus(t, resp, http.StatusOK)
+		resp.decode(t, &results)
+		if len(results) != 1 || results[0].Status != "limit" {
+			t.Errorf("got bulk results %+v, want the new rating refused for the limit", results)
+		}
+
+		// ratings already there can still change
+		expectStatus(t, s.request(t, PUT, "/rating", User{Email: "ada@example.com", ImageURL: first, Rating: 1}), http.StatusOK)
+		expectStatus(t, s.request(t, POST, "/rating?"+UPSERT_PARAM+"=true", User{Email: "ada@example.com", ImageURL: second, Rating: 2}), http.StatusOK)
+		if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 2 || ratings[0].Rating != 1 || ratings[1].Rating != 2 {
+			t.Errorf("got ratings %+v, want both updated", ratings)
+		}
+
+		// the cap is per user, and a deleted rating frees a place
+		s.createUser(t, "grace@example.com")
+		s.saveRating(t, "grace@example.com", third, 5)
+		expectStatus(t, s.request(t, DELETE, "/rating", User{Email: "ada@example.com", ImageURL: first}), http.StatusNoContent)
+		s.saveRating(t, "ada@example.com", third, 5)
+	})
+}
+
+func TestMaxRatingsConcurrent(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, append(env, RATINGS_ENV_VAR+"=3")...)
+		email := userEmail("ada@example.com")
+		if err := s.storage.CreateUser(email, 0); err != nil {
+			t.Fatal(err)
+		}
+		var saved atomic.Int64
+		var wg sync.WaitGroup
+		for n := 0; n < 20; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				url := imageURL(fmt.Sprintf("https://apod.nasa.gov/apod/image/%d.jpg", n))
+				switch err := s.storage.SaveRating(email, url, 3, s.users.maxRatings); {
+				case err == nil:
+					saved.Add(1)
+				case !errors.Is(err, ErrRatingLimit):
+					t.Errorf("saving rating %d: %v", n, err)
+				}
+			}()
+		}
+		wg.Wait()
+		if saved.Load() != 3 {
+			t.Errorf("saved %d ratings concurrently, want the cap of 3", saved.Load())
+		}
+	})
+}
+
+func TestDeleteUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		s.createUser(t, "ada@example.com")
+		s.createUser(t, "grace@example.com")
+		for day := 1; day <= 3; day++ {
+			s.saveRating(t, "ada@example.com", stubImage(fmt.Sprintf("2024-01-0%d", day)).Url, day)
+		}
+		s.saveRating(t, "grace@example.com", stubImage("2024-01-01").Url, 4)
+
+		resp := s.request(t, DELETE, "/user", User{Email: "Ada@Example.com"})
+		expectStatus(t, resp, http.StatusOK)
+		var deleted DeletedUser
+		resp.decode(t, &deleted)
+		if deleted != (DeletedUser{Email: "ada@example.com", RatingsDeleted: 3}) {
+			t.Errorf("got %+v, want ada deleted along with 3 ratings", deleted)
+		}
+		if ratings := s.ratingsOf(t, "grace@example.com"); len(ratings) != 1 {
+			t.Errorf("got ratings %+v of grace, want them untouched", ratings)
+		}
+
+		// a user created again under the same email starts without ratings
+		s.createUser(t, "ada@example.com")
+		if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 0 {
+			t.Errorf("got ratings %+v for the recreated user, want none", ratings)
+		}
+
+		resp = s.request(t, DELETE, "/user", User{Email: "nobody@example.com"})
+		expectStatus(t, resp, http.StatusNotFound)
+		if code := resp.errorCode(t); code != "not_found" {
+			t.Errorf("got error code %q deleting a nonexistent user, want not_found", code)
+		}
+		expectStatus(t, s.request(t, DELETE, "/user", User{}), http.StatusBadRequest)
+	})
+}
+
+func TestServerTimeouts(t *testing.T) {
+	for _, name := range []string{READ_ENV_VAR, WRITE_ENV_VAR, IDLE_ENV_VAR} {
+		t.Setenv(name, "")
+	}
+	server := newServer(":0", http.NotFoundHandler())
+	if server.ReadTimeout != DEFAULT_READ || server.ReadHeaderTimeout != DEFAULT_READ || server.WriteTimeout != DEFAULT_WRITE || server.IdleTimeout != DEFAULT_IDLE {
+		t.Errorf("got timeouts read %v, header %v, write %v, idle %v, want the defaults", server.ReadTimeout, server.ReadHeaderTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
+
+	t.Setenv(READ_ENV_VAR, "1")
+	t.Setenv(WRITE_ENV_VAR, "90")
+	t.Setenv(IDLE_ENV_VAR, "5")
+	server = newServer(":0", http.NotFoundHandler())
+	if server.ReadTimeout != time.Second || server.ReadHeaderTimeout != time.Second || server.WriteTimeout != 90*time.Second || server.IdleTimeout != 5*time.Second {
+		t.Errorf("got timeouts read %v, header %v, write %v, idle %v, want 1s, 1s, 90s and 5s", server.ReadTimeout, server.ReadHeaderTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
+
+	// a client trickling its headers is cut off once the read timeout is up
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() { served <- serve(server, ln, stop) }()
+	t.Cleanup(func() {
+		stop <- syscall.SIGTERM
+		<-served
+	})
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: apod\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	io.Copy(io.Discard, conn)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("slow client held its connection for %v, want it closed after the 1s read timeout", elapsed)
+	}
+
+	t.Setenv(IDLE_ENV_VAR, "0")
+	expectPanic(t, IDLE_ENV_VAR+"=0", func() { newServer(":0", http.NotFoundHandler()) })
+}
+
+func TestFavoriteRatings(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		s.createUser(t, "ada@example.com")
+		fetched := s.fetchImage(t, "2024-01-01")
+		unfetched := "https://apod.nasa.gov/apod/image/unfetched.jpg"
+		s.saveRating(t, "ada@example.com", fetched.Url, 4)
+		s.saveRating(t, "ada@example.com", unfetched, 5)
+		s.saveRating(t, "ada@example.com", stubImage("2024-01-02").Url, 3)
+		s.saveRating(t, "ada@example.com", stubImage("2024-01-03").Url, 1)
+
+		resp := s.get(t, "/rating/favorites?"+EMAIL_PARAM+"=ada@example.com")
+		expectStatus(t, resp, http.StatusOK)
+		var favorites []Favorite
+		resp.decode(t, &favorites)
+		if len(favorites) != 2 || favorites[0].ImageURL != unfetched || favorites[0].Rating != 5 || favorites[1].ImageURL != fetched.Url || favorites[1].Rating != 4 {
+			t.Fatalf("got favorites %+v, want the ratings of 4 and up, highest first", favorites)
+		}
+		if favorites[0].Image != nil {
+			t.Errorf("got image %+v for an image never fetched, want just its url", favorites[0].Image)
+		}
+		if image := favorites[1].Image; image == nil || image.Title != fetched.Title || image.Url != fetched.Url {
+			t.Errorf("got image %+v, want the stored metadata of %s", image, fetched.Url)
+		}
+
+		resp = s.get(t, "/rating/favorites?"+EMAIL_PARAM+"=ada@example.com&"+MIN_PARAM+"=3")
+		expectStatus(t, resp, http.StatusOK)
+		resp.decode(t, &favorites)
+		if len(favorites) != 3 || favorites[2].Rating != 3 {
+			t.Errorf("got favorites %+v with %s=3, want the 3 ratings of 3 and up", favorites, MIN_PARAM)
+		}
+		resp = s.get(t, "/rating/favorites?"+EMAIL_PARAM+"=ada@example.com&"+MIN_PARAM+"=6")
+		expectStatus(t, resp, http.StatusOK)
+		if body := strings.TrimSpace(string(resp.body)); body != "[]" {
+			t.Errorf("got %s above every rating, want an empty array", body)
+		}
+
+		expectStatus(t, s.get(t, "/rating/favorites?"+EMAIL_PARAM+"=ada@example.com&"+MIN_PARAM+"=high"), http.StatusBadRequest)
+		expectStatus(t, s.get(t, "/rating/favorites?"+EMAIL_PARAM+"=nobody@example.com"), http.StatusNotFound)
+	})
+}
+
+func TestImageNegotiation(t *testing.T) {
+	s := newTestServer(t)
+	image := stubImage("2024-01-01")
+	path := "/image?" + DATE_PARAM + "=2024-01-01"
+
+	for accept, want := range map[string]string{
+		"":               APPLICATION_JSON,
+		APPLICATION_JSON: APPLICATION_JSON,
+		"image/png":      APPLICATION_JSON,
+		TEXT_HTML:        TEXT_HTML + "; charset=utf-8",
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8": TEXT_HTML + "; charset=utf-8",
+		TEXT_PLAIN:                          TEXT_PLAIN + "; charset=utf-8",
+		"text/*;q=0.5, text/plain":          TEXT_PLAIN + "; charset=utf-8",
+		"application/json;q=0.2, text/html": TEXT_HTML + "; charset=utf-8",
+	} {
+		resp := s.get(t, path, "Accept", accept)
+		expectStatus(t, resp, http.StatusOK)
+		if ct := resp.Header.Get(CONTENT_TYPE); ct != want {
+			t.Errorf("Accept %q: got content-type %q, want %q", accept, ct, want)
+		}
+		if vary := resp.Header.Values("Vary"); !slices.Contains(vary, "Accept") || !slices.Contains(vary, "Accept-Encoding") {
+			t.Errorf("Accept %q: got Vary %v, want it varying on Accept next to Accept-Encoding", accept, vary)
+		}
+	}
+
+	html := string(s.get(t, path, "Accept", TEXT_HTML).body)
+	for _, part := range []string{"<title>" + image.Title + "</title>", `<img src="` + image.Url + `"`, `<a href="` + image.HDUrl + `"`, image.Explanation} {
+		if !strings.Contains(html, part) {
+			t.Errorf("got page %q, want it to contain %q", html, part)
+		}
+	}
+	text := string(s.get(t, path, "Accept", TEXT_PLAIN).body)
+	if want := image.Title + " (" + image.Date + ")\n" + image.Url + "\n\n" + image.Explanation + "\n"; text != want {
+		t.Errorf("got summary %q, want %q", text, want)
+	}
+	if json, html := s.get(t, path).Header.Get("ETag"), s.get(t, path, "Accept", TEXT_HTML).Header.Get("ETag"); json == html {
+		t.Errorf("got ETag %s for both JSON and HTML, want one per representation", json)
+	}
+
+	// what NASA, or a client creating an image, puts in a title can't inject markup
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+		w.Write([]byte(`{"date": "2024-01-05", "title": "<script>alert(1)</script>", "media_type": "image", "url": "javascript:alert(1)"}`))
+	})
+	resp := s.get(t, "/image?"+DATE_PARAM+"=2024-01-05", "Accept", TEXT_HTML)
+	expectStatus(t, resp, http.StatusOK)
+	html = string(resp.body)
+	if strings.Contains(html, "<script>") || strings.Contains(html, "javascript:") {
+		t.Errorf("got page %q, want the title escaped and the URL dropped", html)
+	}
+
+	// several images get a card each
+	s.nasa.handle(apodImages)
+	resp = s.get(t, "/image?"+COUNT_PARAM+"=3", "Accept", TEXT_HTML)
+	expectStatus(t, resp, http.StatusOK)
+	if cards := strings.Count(string(resp.body), "<article>"); cards != 3 {
+		t.Errorf("got %d cards for 3 images, want 3", cards)
+	}
+
+	// so does the list of stored images, tagged like the other image responses
+	for accept, want := range map[string]string{"": APPLICATION_JSON, TEXT_HTML: TEXT_HTML + "; charset=utf-8", TEXT_PLAIN: TEXT_PLAIN + "; charset=utf-8"} {
+		resp := s.get(t, "/images?"+LIMIT_PARAM+"=2", "Accept", accept)
+		expectStatus(t, resp, http.StatusOK)
+		if ct := resp.Header.Get(CONTENT_TYPE); ct != want {
+			t.Errorf("/images, Accept %q: got content-type %q, want %q", accept, ct, want)
+		}
+		if vary := resp.Header.Values("Vary"); !slices.Contains(vary, "Accept") {
+			t.Errorf("/images, Accept %q: got Vary %v, want it varying on Accept", accept, vary)
+		}
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			t.Fatalf("/images, Accept %q: got no ETag", accept)
+		}
+		expectStatus(t, s.get(t, "/images?"+LIMIT_PARAM+"=2", "Accept", accept, "If-None-Match", etag), http.StatusNotModified)
+	}
+	if cards := strings.Count(string(s.get(t, "/images?"+LIMIT_PARAM+"=2", "Accept", TEXT_HTML).body), "<article>"); cards != 2 {
+		t.Errorf("got %d cards for a page of 2 stored images, want 2", cards)
+	}
+}
+
+// sendWithoutContentType sends method path to s with body, without the content-type s.request would add
+func (s *testServer) sendWithoutContentType(t *testing.T, method, path, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestGetWithoutContentType(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		s := newTestServer(t, STRICT_ENV_VAR+"="+strconv.FormatBool(strict))
+		s.createUser(t, "ada@example.com")
+		s.saveRating(t, "ada@example.com", stubImage("2024-01-01").Url, 5)
+
+		bodyStatus := http.StatusOK
+		if strict {
+			bodyStatus = http.StatusUnsupportedMediaType
+		}
+		for _, path := range []string{"/user", "/rating", "/rating/stats", "/rating/favorites"} {
+			if status := s.sendWithoutContentType(t, GET, path+"?"+EMAIL_PARAM+"=ada@example.com", ""); status != http.StatusOK {
+				t.Errorf("strict %v: GET %s with the email param got status %d, want 200", strict, path, status)
+			}
+			if status := s.sendWithoutContentType(t, GET, path, `{"email": "ada@example.com"}`); status != bodyStatus {
+				t.Errorf("strict %v: GET %s with the email in an untyped body got status %d, want %d", strict, path, status, bodyStatus)
+			}
+		}
+
+		// writes still need a JSON content-type
+		for _, write := range []struct{ method, path, body string }{
+			{POST, "/user", `{"email": "grace@example.com"}`},
+			{POST, "/rating", `{"email": "ada@example.com", "imageURL": "https://apod.nasa.gov/apod/image/x.jpg", "rating": 3}`},
+			{PUT, "/rating", `{"email": "ada@example.com", "imageURL": "` + stubImage("2024-01-01").Url + `", "rating": 3}`},
+			{DELETE, "/rating", `{"email": "ada@example.com", "imageURL": "` + stubImage("2024-01-01").Url + `"}`},
+			{DELETE, "/user", `{"email": "ada@example.com"}`},
+			{DELETE, "/rating/all", `{"email": "ada@example.com"}`},
+		} {
+			if status := s.sendWithoutContentType(t, write.method, write.path, write.body); status != http.StatusUnsupportedMediaType {
+				t.Errorf("strict %v: %s %s without content-type got status %d, want 415", strict, write.method, write.path, status)
+			}
+		}
+	}
+	t.Setenv(STRICT_ENV_VAR, "strictly")
+	expectPanic(t, STRICT_ENV_VAR+"=strictly", func() { strictGetContentType() })
+}
+
+func TestValidationErrors(t *testing.T) {
+	s := newTestServer(t, RATING_MAX_ENV_VAR+"=10")
+	invalid := User{Email: "ada", Rating: 11}
+
+	for _, method := range []string{POST, PUT} {
+		resp := s.request(t, method, "/rating", invalid)
+		expectStatus(t, resp, http.StatusBadRequest)
+		var body errorResponse
+		resp.decode(t, &body)
+		var fields []string
+		for _, field := range body.Error.Fields {
+			fields = append(fields, field.Field)
+			if field.Message == "" || !strings.Contains(body.Error.Message, field.Message) {
+				t.Errorf("%s /rating: got field error %+v in message %q, want its message in there too", method, field, body.Error.Message)
+			}
+		}
+		if !reflect.DeepEqual(fields, []string{"email", "imageURL", "rating"}) {
+			t.Errorf("%s /rating: got errors on %v, want email, imageURL and rating all reported", method, fields)
+		}
+		if body.Error.Code != "bad_request" || !strings.Contains(body.Error.Message, "1-10") {
+			t.Errorf("%s /rating: got %+v, want a bad_request naming the 1-10 scale", method, body.Error)
+		}
+	}
+
+	resp := s.request(t, PUT, "/user", RenamedUser{Email: "ada", NewEmail: "@example.com"})
+	expectStatus(t, resp, http.StatusBadRequest)
+	var body errorResponse
+	resp.decode(t, &body)
+	if len(body.Error.Fields) != 2 || body.Error.Fields[0].Field != "email" || body.Error.Fields[1].Field != "newEmail" {
+		t.Errorf("got field errors %+v renaming, want both emails reported", body.Error.Fields)
+	}
+
+	// a payload with a single fault lists just that field
+	resp = s.request(t, POST, "/rating", User{Email: "ada@example.com", ImageURL: stubImage("2024-01-01").Url})
+	expectStatus(t, resp, http.StatusBadRequest)
+	resp.decode(t, &body)
+	if len(body.Error.Fields) != 1 || body.Error.Fields[0].Field != "rating" {
+		t.Errorf("got field errors %+v, want only the rating reported", body.Error.Fields)
+	}
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+const (
+	SQLITE_PATH_ENV_VAR = "SQLITE_PATH"
+	SQLITE_FILE         = "apod.db"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	email TEXT PRIMARY KEY
+);
+CREATE TABLE IF NOT EXISTS images (
+	url           TEXT PRIMARY KEY,
+	date          TEXT NOT NULL,
+	explanation   TEXT NOT NULL,
+	title         TEXT NOT NULL,
+	media_type    TEXT NOT NULL,
+	thumbnail_url TEXT NOT NULL,
+	copyright     TEXT NOT NULL,
+	hdurl         TEXT NOT NULL,
+	concept_tags  TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS ratings (
+	email      TEXT NOT NULL REFERENCES users (email) ON UPDATE CASCADE ON DELETE CASCADE,
+	image_url  TEXT NOT NULL,
+	rating     INTEGER NOT NULL,
+	created_at INTEGER NOT NULL DEFAULT 0,
+	updated_at INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (email, image_url)
+);
+`
+
+// imageColumns are the columns of images, in the order scanImage reads them
+const imageColumns = `url, date, explanation, title, media_type, thumbnail_url, copyright, hdurl, concept_tags`
+
+// ratingTimestamps are the timestamp columns of ratings, in Unix nanoseconds, missing from tables created before them
+var ratingTimestamps = []string{"created_at", "updated_at"}
+
+// sqlitePath returns the database file, read from SQLITE_PATH or else placed in DATA_DIR
+func sqlitePath() string {
+	if path := os.Getenv(SQLITE_PATH_ENV_VAR); path != "" {
+		return path
+	}
+	return filepath.Join(os.Getenv(DATA_DIR_ENV_VAR), SQLITE_FILE)
+}
+
+// sqliteStorage keeps everything in a SQLite database with users, images and ratings tables
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+// newSQLiteStorage opens (creating if needed) the database at path and returns a pointer to it
+// transactions take the write lock as they begin, so one that counts before inserting waits its turn
+// instead of failing with "database is locked" when it can't upgrade its read lock
+func newSQLiteStorage(path string) (*sqliteStorage, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateImages(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateRatings(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStorage{db: db}, nil
+}
+
+// tableColumns returns the names of the columns of table
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// migrateImages adds the concept_tags column to an images table created before it existed
+func migrateImages(db *sql.DB) error {
+	columns, err := tableColumns(db, "images")
+	if err != nil || columns["concept_tags"] {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE images ADD COLUMN concept_tags TEXT NOT NULL DEFAULT ''`)
+	return err
+}
+
+// migrateRatings adds the timestamp columns to a ratings table created before they existed
+// the ratings already in it count as saved now
+func migrateRatings(db *sql.DB) error {
+	columns, err := tableColumns(db, "ratings")
+	if err != nil {
+		return err
+	}
+	for _, column := range ratingTimestamps {
+		if columns[column] {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE ratings ADD COLUMN ` + column + ` INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UnixNano()
+	_, err = db.Exec(`UPDATE ratings SET created_at = ?, updated_at = ? WHERE updated_at = 0`, now, now)
+	return err
+}
+
+// isConstraintError reports whether err is a primary key or unique constraint violation
+func isConstraintError(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && sqliteErr.Code == sqlite3.ErrConstraint
+}
+
+// requireRow returns notFound if the statement behind res didn't change any rows
+func requireRow(res sql.Result, notFound error) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+// requireUser returns ErrUserNotFound if no user with the given email exists
+func requireUser(tx *sql.Tx, email userEmail) error {
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE email = ?`, email).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// encodeTags stores concept tags as a JSON array, or an empty string if there are none
+func encodeTags(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(tags)
+	return string(data)
+}
+
+// scanImage reads an image selected as imageColumns from row, which is a *sql.Row or *sql.Rows
+func scanImage(row interface{ Scan(...interface{}) error }) (Image, error) {
+	var image Image
+	var tags string
+	err := row.Scan(&image.Url, &image.Date, &image.Explanation, &image.Title, &image.MediaType, &image.ThumbnailURL, &image.Copyright, &image.HDUrl, &tags)
+	if err != nil || tags == "" {
+		return image, err
+	}
+	return image, json.Unmarshal([]byte(tags), &image.ConceptTags)
+}
+
+func (s *sqliteStorage) SaveImage(image Image) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO images
+		(url, date, explanation, title, media_type, thumbnail_url, copyright, hdurl, concept_tags)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		image.Url, image.Date, image.Explanation, image.Title, image.MediaType, image.ThumbnailURL, image.Copyright, image.HDUrl, encodeTags(image.ConceptTags))
+	return err
+}
+
+func (s *sqliteStorage) CreateImage(image Image) error {
+	_, err := s.db.Exec(`INSERT INTO images
+		(url, date, explanation, title, media_type, thumbnail_url, copyright, hdurl, concept_tags)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		image.Url, image.Date, image.Explanation, image.Title, image.MediaType, image.ThumbnailURL, image.Copyright, image.HDUrl, encodeTags(image.ConceptTags))
+	if isConstraintError(err) {
+		return ErrImageExists
+	}
+	return err
+}
+
+func (s *sqliteStorage) GetImage(url imageURL) (Image, error) {
+	image, err := scanImage(s.db.QueryRow(`SELECT `+imageColumns+` FROM images WHERE url = ?`, url))
+	if err == sql.ErrNoRows {
+		return Image{}, ErrImageNotFound
+	}
+	return image, err
+}
+
+func (s *sqliteStorage) DeleteImage(url imageURL) error {
+	res, err := s.db.Exec(`DELETE FROM images WHERE url = ?`, url)
+	if err != nil {
+		return err
+	}
+	return requireRow(res, ErrImageNotFound)
+}
+
+func (s *sqliteStorage) ListImages() ([]Image, error) {
+	rows, err := s.db.Query(`SELECT ` + imageColumns + ` FROM images`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []Image{}
+	for rows.Next() {
+		image, err := scanImage(rows)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
+
+func (s *sqliteStorage) CreateUser(email userEmail, max int) error {
+	if max <= 0 {
+		_, err := s.db.Exec(`INSERT INTO users (email) VALUES (?)`, email)
+		if isConstraintError(err) {
+			return ErrUserExists
+		}
+		return err
+	}
+
+	// counting and inserting in one statement keeps concurrent creations from overshooting max
+	res, err := s.db.Exec(`INSERT INTO users (email) SELECT ? WHERE (SELECT COUNT(*) FROM users) < ?`, email, max)
+	if isConstraintError(err) {
+		return ErrUserExists
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	// nothing was inserted, the user may exist already though
+	var exists bool
+	if err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE email = ?)`, email).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrUserExists
+	}
+	return ErrUserLimit
+}
+
+func (s *sqliteStorage) RenameUser(email, newEmail userEmail) error {
+	res, err := s.db.Exec(`UPDATE users SET email = ? WHERE email = ?`, newEmail, email)
+	if isConstraintError(err) {
+		return ErrUserExists
+	}
+	if err != nil {
+		return err
+	}
+	return requireRow(res, ErrUserNotFound)
+}
+
+func (s *sqliteStorage) DeleteUser(email userEmail) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var deleted int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM ratings WHERE email = ?`, email).Scan(&deleted); err != nil {
+		return 0, err
+	}
+	// the ratings go along with the user, through the foreign key
+	res, err := tx.Exec(`DELETE FROM users WHERE email = ?`, email)
+	if err != nil {
+		return 0, err
+	}
+	if err := requireRow(res, ErrUserNotFound); err != nil {
+		return 0, err
+	}
+	return deleted, tx.Commit()
+}
+
+// insertRating inserts a new rating of the user, unless they already have max ratings (0 means no limit)
+// counting and inserting in one statement keeps concurrent saves from overshooting max
+func insertRating(tx *sql.Tx, email userEmail, url imageURL, value rating, now int64, max int) error {
+	res, err := tx.Exec(`INSERT INTO ratings (email, image_url, rating, created_at, updated_at)
+		SELECT ?, ?, ?, ?, ? WHERE ? <= 0 OR (SELECT COUNT(*) FROM ratings WHERE email = ?) < ?`,
+		email, url, value, now, now, max, email, max)
+	if isConstraintError(err) {
+		return ErrRatingExists
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	// nothing was inserted, the rating may exist already though
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM ratings WHERE email = ? AND image_url = ?)`, email, url).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrRatingExists
+	}
+	return ErrRatingLimit
+}
+
+func (s *sqliteStorage) SaveRating(email userEmail, url imageURL, value rating, max int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := requireUser(tx, email); err != nil {
+		return err
+	}
+	if err := insertRating(tx, email, url, value, time.Now().UnixNano(), max); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStorage) SaveRatings(email userEmail, ratings []ImageRating, max int) ([]error, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := requireUser(tx, email); err != nil {
+		return nil, err
+	}
+	results := make([]error, len(ratings))
+	now := time.Now().UnixNano()
+	for n, r := range ratings {
+		// a constraint violation only aborts its own statement, the transaction carries on
+		err := insertRating(tx, email, imageURL(r.ImageURL), rating(r.Rating), now, max)
+		if errors.Is(err, ErrRatingExists) || errors.Is(err, ErrRatingLimit) {
+			results[n] = err
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return results, tx.Commit()
+}
+
+// changeRating runs a statement against a single rating, reporting whether the user or the rating is missing
+func (s *sqliteStorage) changeRating(email userEmail, query string, args ...interface{}) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := requireUser(tx, email); err != nil {
+		return err
+	}
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if err := requireRow(res, ErrRatingNotFound); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStorage) UpdateRating(email userEmail, url imageURL, value rating) error {
+	return s.changeRating(email, `UPDATE ratings SET rating = ?, updated_at = ? WHERE email = ? AND image_url = ?`, value, time.Now().UnixNano(), email, url)
+}
+
+func (s *sqliteStorage) UpsertRating(email userEmail, url imageURL, value rating, max int) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if err := requireUser(tx, email); err != nil {
+		return false, err
+	}
+	now := time.Now().UnixNano()
+	res, err := tx.Exec(`UPDATE ratings SET rating = ?, updated_at = ? WHERE email = ? AND image_url = ?`, value, now, email, url)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		if err := insertRating(tx, email, url, value, now, max); err != nil {
+			return false, err
+		}
+	}
+	return n == 0, tx.Commit()
+}
+
+func (s *sqliteStorage) DeleteRating(email userEmail, url imageURL) error {
+	return s.changeRating(email, `DELETE FROM ratings WHERE email = ? AND image_url = ?`, email, url)
+}
+
+func (s *sqliteStorage) ClearRatings(email userEmail) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := requireUser(tx, email); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM ratings WHERE email = ?`, email); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStorage) DeleteImageRatings(url imageURL) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM ratings WHERE image_url = ?`, url)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *sqliteStorage) GetRatings(email userEmail) (map[imageURL]storedRating, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := requireUser(tx, email); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(`SELECT image_url, rating, created_at, updated_at FROM ratings WHERE email = ?`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ratings := map[imageURL]storedRating{}
+	for rows.Next() {
+		var url imageURL
+		var value rating
+		var createdAt, updatedAt int64
+		if err := rows.Scan(&url, &value, &createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
+		ratings[url] = storedRating{Value: value, CreatedAt: time.Unix(0, createdAt).UTC(), UpdatedAt: time.Unix(0, updatedAt).UTC()}
+	}
+	return ratings, rows.Err()
+}
+
+func (s *sqliteStorage) AllRatings() (map[userEmail]map[imageURL]rating, error) {
+	rows, err := s.db.Query(`SELECT email, image_url, rating FROM ratings`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := map[userEmail]map[imageURL]rating{}
+	for rows.Next() {
+		var email userEmail
+		var url imageURL
+		var value rating
+		if err := rows.Scan(&email, &url, &value); err != nil {
+			return nil, err
+		}
+		if all[email] == nil {
+			all[email] = map[imageURL]rating{}
+		}
+		all[email][url] = value
+	}
+	return all, rows.Err()
+}
+
+// Snapshot reads the three tables within a single transaction, so they are consistent with each other
+func (s *sqliteStorage) Snapshot() (Snapshot, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer tx.Rollback()
+
+	snapshot := Snapshot{Images: map[imageURL]Image{}, Users: map[userEmail]map[imageURL]storedRating{}}
+	images, err := tx.Query(`SELECT ` + imageColumns + ` FROM images`)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer images.Close()
+	for images.Next() {
+		image, err := scanImage(images)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		snapshot.Images[imageURL(image.Url)] = image
+	}
+	if err := images.Err(); err != nil {
+		return Snapshot{}, err
+	}
+
+	users, err := tx.Query(`SELECT email FROM users`)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer users.Close()
+	for users.Next() {
+		var email userEmail
+		if err := users.Scan(&email); err != nil {
+			return Snapshot{}, err
+		}
+		snapshot.Users[email] = map[imageURL]storedRating{}
+	}
+	if err := users.Err(); err != nil {
+		return Snapshot{}, err
+	}
+
+	ratings, err := tx.Query(`SELECT email, image_url, rating, created_at, updated_at FROM ratings`)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer ratings.Close()
+	for ratings.Next() {
+		var email userEmail
+		var url imageURL
+		var value rating
+		var createdAt, updatedAt int64
+		if err := ratings.Scan(&email, &url, &value, &createdAt, &updatedAt); err != nil {
+			return Snapshot{}, err
+		}
+		if snapshot.Users[email] == nil {
+			snapshot.Users[email] = map[imageURL]storedRating{}
+		}
+		snapshot.Users[email][url] = storedRating{Value: value, CreatedAt: time.Unix(0, createdAt).UTC(), UpdatedAt: time.Unix(0, updatedAt).UTC()}
+	}
+	return snapshot, ratings.Err()
+}
+
+// Restore loads snapshot within a single transaction, so a failure leaves the database untouched
+func (s *sqliteStorage) Restore(snapshot Snapshot, replace bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if replace {
+		// deleting the users cascades to their ratings
+		for _, table := range []string{"users", "images"} {
+			if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+				return err
+			}
+		}
+	}
+	for _, image := range snapshot.Images {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO images (`+imageColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			image.Url, image.Date, image.Explanation, image.Title, image.MediaType, image.ThumbnailURL, image.Copyright, image.HDUrl, encodeTags(image.ConceptTags)); err != nil {
+			return err
+		}
+	}
+	for email, userRatings := range snapshot.Users {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO users (email) VALUES (?)`, email); err != nil {
+			return err
+		}
+		for url, stored := range userRatings {
+			if _, err := tx.Exec(`INSERT OR REPLACE INTO ratings (email, image_url, rating, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+				email, url, stored.Value, stored.CreatedAt.UnixNano(), stored.UpdatedAt.UnixNano()); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStorage) SweepRatings(cutoff time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM ratings WHERE updated_at < ?`, cutoff.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *sqliteStorage) Close() error {
+	return s.db.Close()
+}
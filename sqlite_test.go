@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteStorageReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), SQLITE_FILE)
+	image := stubImage("2024-01-01")
+
+	db, err := newSQLiteStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveImage(image); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateUser("ada@example.com", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveRating("ada@example.com", imageURL(image.Url), 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := newSQLiteStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	ratings, err := reopened.GetRatings("ada@example.com")
+	if err != nil || len(ratings) != 1 || ratings[imageURL(image.Url)].Value != 2 {
+		t.Errorf("got ratings %+v (%v) after reopening, want the one saved", ratings, err)
+	}
+	if stored, err := reopened.GetImage(imageURL(image.Url)); err != nil || stored.Title != image.Title {
+		t.Errorf("got image %+v (%v) after reopening, want the one saved", stored, err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errBlockedAddress is returned when an outbound request would reach an address that isn't public
+var errBlockedAddress = errors.New("address not allowed")
+
+// blockedPrefixes are the non-public ranges the standard library has no predicate for
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT, home to Alibaba Cloud's 100.100.100.200 metadata service
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, broadcast included
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, embedding any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("2002::/16"),       // 6to4, embedding any IPv4 address
+	netip.MustParsePrefix("2001::/32"),       // Teredo
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("100::/64"),        // discard
+}
+
+// blockedIP reports whether ip is loopback, private, link-local (such as the 169.254.169.254 cloud metadata service),
+// multicast, unspecified or in one of blockedPrefixes, none of which a request built from client input may reach
+// IPv4-mapped IPv6 addresses are checked as the IPv4 address they carry
+func blockedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOutboundURL rejects URLs that aren't http(s), or whose host is localhost or a blocked IP
+// hostnames are only checked once resolved, when guardedDialer connects
+func checkOutboundURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme '%s': %w", u.Scheme, errBlockedAddress)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("host %s: %w", host, errBlockedAddress)
+	}
+	if ip := net.ParseIP(host); ip != nil && blockedIP(ip) {
+		return fmt.Errorf("address %s: %w", ip, errBlockedAddress)
+	}
+	return nil
+}
+
+// guardedDialer refuses to connect to blocked IPs, checking the address every name resolved to
+// so a public hostname pointing at an internal address is caught too
+var guardedDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+	Control: func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || blockedIP(ip) {
+			return fmt.Errorf("address %s: %w", host, errBlockedAddress)
+		}
+		return nil
+	},
+}
+
+// newGuardedClient returns a client for requests built from client input, which only reaches public addresses
+// every redirect is checked with checkOutboundURL and then allow, which may be nil
+// it ignores HTTP_PROXY and the like, connections must be direct for the dialer to see where they go
+func newGuardedClient(timeout time.Duration, allow func(*url.URL) error) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = guardedDialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if err := checkOutboundURL(req.URL); err != nil {
+				return err
+			}
+			if allow != nil {
+				return allow(req.URL)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCheckOutboundURL(t *testing.T) {
+	for raw, blocked := range map[string]bool{
+		"http://169.254.169.254/latest/meta-data/":  true,
+		"http://localhost/":                         true,
+		"http://LOCALHOST:8080/":                    true,
+		"http://api.localhost/":                     true,
+		"http://127.0.0.1/":                         true,
+		"http://10.0.0.1/":                          true,
+		"http://192.168.1.1/":                       true,
+		"http://[::1]/":                             true,
+		"http://[fe80::1]/":                         true,
+		"http://[::ffff:169.254.169.254]/":          true,
+		"http://0.0.0.0/":                           true,
+		"file:///etc/passwd":                        true,
+		"gopher://apod.nasa.gov/":                   true,
+		"https://apod.nasa.gov/apod/image/moon.jpg": false,
+		"http://93.184.215.14/":                     false,
+		"https://[2606:4700::6810:84e5]/":           false,
+	} {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatalf("parsing %s: %v", raw, err)
+		}
+		err = checkOutboundURL(u)
+		if blocked && !errors.Is(err, errBlockedAddress) {
+			t.Errorf("%s: got %v, want it blocked", raw, err)
+		}
+		if !blocked && err != nil {
+			t.Errorf("%s: got %v, want it allowed", raw, err)
+		}
+	}
+}
+
+func TestBlockedIP(t *testing.T) {
+	for _, addr := range []string{"100.100.100.200", "192.0.2.1", "198.18.0.1", "203.0.113.9", "255.255.255.255", "224.0.0.1", "64:ff9b::a9fe:a9fe", "2002:a9fe:a9fe::1", "2001:db8::1", "fc00::1"} {
+		if !blockedIP(net.ParseIP(addr)) {
+			t.Errorf("%s isn't blocked, want it blocked", addr)
+		}
+	}
+	for _, addr := range []string{"8.8.8.8", "151.101.1.1", "2001:4860:4860::8888"} {
+		if blockedIP(net.ParseIP(addr)) {
+			t.Errorf("%s is blocked, want it allowed as a public address", addr)
+		}
+	}
+}
+
+func TestGuardedClientRefusesInternal(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("internal server got %s, want the connection refused", r.URL)
+	}))
+	t.Cleanup(internal.Close)
+
+	_, err := newGuardedClient(time.Second, nil).Get(internal.URL)
+	if !errors.Is(err, errBlockedAddress) {
+		t.Errorf("got %v connecting to %s, want it blocked", err, internal.URL)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	STORAGE_ENV_VAR = "STORAGE_BACKEND"
+	MEMORY_BACKEND  = "memory"
+	SQLITE_BACKEND  = "sqlite"
+)
+
+var (
+	ErrImageNotFound  = errors.New("image not found")
+	ErrImageExists    = errors.New("image already exists")
+	ErrUserExists     = errors.New("user already exists")
+	ErrUserNotFound   = errors.New("user not found")
+	ErrUserLimit      = errors.New("maximum number of users reached")
+	ErrRatingExists   = errors.New("rating already exists")
+	ErrRatingNotFound = errors.New("rating not found")
+	ErrRatingLimit    = errors.New("maximum number of ratings reached")
+)
+
+// Storage abstracts where images, users and their ratings are kept
+// implementations must be safe for concurrent use
+type Storage interface {
+	SaveImage(image Image) error
+	// CreateImage stores image unless one with the same url is already stored, failing with ErrImageExists
+	CreateImage(image Image) error
+	GetImage(url imageURL) (Image, error)
+	DeleteImage(url imageURL) error
+	ListImages() ([]Image, error)
+
+	// CreateUser stores a new user, failing with ErrUserLimit if max users are already stored (0 means no limit)
+	CreateUser(email userEmail, max int) error
+	RenameUser(email, newEmail userEmail) error
+	// DeleteUser deletes the user along with their ratings, returning how many ratings were deleted
+	DeleteUser(email userEmail) (int, error)
+
+	// SaveRating, SaveRatings and UpsertRating fail with ErrRatingLimit rather than give a user more than max ratings (0 means no limit)
+	SaveRating(email userEmail, url imageURL, value rating, max int) error
+	// SaveRatings saves several ratings of a user at once, returning the outcome of each, in order
+	// a rating that already exists fails with ErrRatingExists without affecting the others
+	SaveRatings(email userEmail, ratings []ImageRating, max int) ([]error, error)
+	UpdateRating(email userEmail, url imageURL, value rating) error
+	// UpsertRating saves the rating, or updates it if it already exists, reporting whether it was created
+	UpsertRating(email userEmail, url imageURL, value rating, max int) (bool, error)
+	DeleteRating(email userEmail, url imageURL) error
+	ClearRatings(email userEmail) error
+	// DeleteImageRatings deletes every user's rating of the image, returning how many were deleted
+	DeleteImageRatings(url imageURL) (int, error)
+	GetRatings(email userEmail) (map[imageURL]storedRating, error)
+	// AllRatings returns every user's ratings, keyed by user email
+	AllRatings() (map[userEmail]map[imageURL]rating, error)
+	// SweepRatings deletes every rating last saved or updated before cutoff, returning how many were deleted
+	SweepRatings(cutoff time.Time) (int, error)
+
+	// Snapshot returns a consistent copy of every image and user stored, with their ratings
+	Snapshot() (Snapshot, error)
+	// Restore loads snapshot, replacing everything stored if replace is set, or else merging it in,
+	// its images and ratings overwriting stored ones with the same url and users being added as needed
+	Restore(snapshot Snapshot, replace bool) error
+
+	// Close flushes any pending state and releases the storage's resources
+	Close() error
+}
+
+// newStorage instantiates the backend selected by STORAGE_BACKEND, defaulting to in-memory maps
+func newStorage() (Storage, error) {
+	switch backend := os.Getenv(STORAGE_ENV_VAR); backend {
+	case "", MEMORY_BACKEND:
+		return newMemoryStorage(), nil
+	case SQLITE_BACKEND:
+		return newSQLiteStorage(sqlitePath())
+	default:
+		return nil, fmt.Errorf("environment variable %s must be '%s' or '%s', got '%s'", STORAGE_ENV_VAR, MEMORY_BACKEND, SQLITE_BACKEND, backend)
+	}
+}
+
+// Snapshot is everything a storage holds, in the format of /export and of the DATA_DIR files
+// every user is listed, with an empty map if they haven't rated any image
+type Snapshot struct {
+	Images map[imageURL]Image                      `json:"images"`
+	Users  map[userEmail]map[imageURL]storedRating `json:"users"`
+}
+
+// storedRating is a rating along with when it was first saved and last updated
+type storedRating struct {
+	Value     rating    `json:"rating"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// newStoredRating returns value as saved right now
+func newStoredRating(value rating) storedRating {
+	now := time.Now().UTC()
+	return storedRating{Value: value, CreatedAt: now, UpdatedAt: now}
+}
+
+// updated returns the rating changed to value, keeping when it was created
+func (s storedRating) updated(value rating) storedRating {
+	s.Value = value
+	s.UpdatedAt = time.Now().UTC()
+	return s
+}
+
+type user struct {
+	sync.Mutex
+	store map[imageURL]storedRating
+}
+
+// newUser instantiates user and returns a pointer to it
+func newUser() *user {
+	return &user{
+		store: map[imageURL]storedRating{},
+	}
+}
+
+// memoryStorage keeps everything in maps, optionally persisted to JSON files in DATA_DIR
+// images are bounded to IMAGE_CACHE_SIZE, evicting the least recently used
+type memoryStorage struct {
+	imagesLock sync.Mutex
+	imagesFile string
+	images     *imageLRU
+
+	usersLock sync.Mutex
+	usersFile string
+	users     map[userEmail]*user
+}
+
+// newMemoryStorage instantiates memoryStorage, loading any state saved in DATA_DIR, and returns a pointer to it
+func newMemoryStorage() *memoryStorage {
+	m := &memoryStorage{
+		imagesFile: dataFile(IMAGES_FILE),
+		images:     newImageLRU(imageCacheSize()),
+		usersFile:  dataFile(USERS_FILE),
+		users:      map[userEmail]*user{},
+	}
+	m.load()
+	return m
+}
+
+func (m *memoryStorage) SaveImage(image Image) error {
+	m.imagesLock.Lock()
+	defer m.imagesLock.Unlock()
+	m.images.put(image)
+	return nil
+}
+
+func (m *memoryStorage) CreateImage(image Image) error {
+	m.imagesLock.Lock()
+	defer m.imagesLock.Unlock()
+	if m.images.has(imageURL(image.Url)) {
+		return ErrImageExists
+	}
+	m.images.put(image)
+	return nil
+}
+
+func (m *memoryStorage) GetImage(url imageURL) (Image, error) {
+	m.imagesLock.Lock()
+	defer m.imagesLock.Unlock()
+	image, ok := m.images.get(url)
+	if !ok {
+		return Image{}, ErrImageNotFound
+	}
+	return image, nil
+}
+
+func (m *memoryStorage) DeleteImage(url imageURL) error {
+	m.imagesLock.Lock()
+	defer m.imagesLock.Unlock()
+	if !m.images.remove(url) {
+		return ErrImageNotFound
+	}
+	return nil
+}
+
+func (m *memoryStorage) ListImages() ([]Image, error) {
+	m.imagesLock.Lock()
+	defer m.imagesLock.Unlock()
+	return m.images.all(), nil
+}
+
+func (m *memoryStorage) CreateUser(email userEmail, max int) error {
+	m.usersLock.Lock()
+	defer m.usersLock.Unlock()
+	if _, ok := m.users[email]; ok {
+		return ErrUserExists
+	}
+	if max > 0 && len(m.users) >= max {
+		return ErrUserLimit
+	}
+	m.users[email] = newUser()
+	return nil
+}
+
+func (m *memoryStorage) RenameUser(email, newEmail userEmail) error {
+	m.usersLock.Lock()
+	defer m.usersLock.Unlock()
+	existingUser, ok := m.users[email]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if _, ok := m.users[newEmail]; ok {
+		return ErrUserExists
+	}
+	delete(m.users, email)
+	m.users[newEmail] = existingUser
+	return nil
+}
+
+func (m *memoryStorage) DeleteUser(email userEmail) (int, error) {
+	m.usersLock.Lock()
+	defer m.usersLock.Unlock()
+	existingUser, ok := m.users[email]
+	if !ok {
+		return 0, ErrUserNotFound
+	}
+	existingUser.Lock()
+	deleted := len(existingUser.store)
+	existingUser.Unlock()
+	delete(m.users, email)
+	return deleted, nil
+}
+
+// user looks up a user by email, the returned user must be locked before reading its ratings
+func (m *memoryStorage) user(email userEmail) (*user, error) {
+	m.usersLock.Lock()
+	defer m.usersLock.Unlock()
+	existingUser, ok := m.users[email]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return existingUser, nil
+}
+
+// full reports whether the user already has max ratings (0 meaning no limit), the caller must hold the user's lock
+func (usr *user) full(max int) bool {
+	return max > 0 && len(usr.store) >= max
+}
+
+func (m *memoryStorage) SaveRating(email userEmail, url imageURL, value rating, max int) error {
+	existingUser, err := m.user(email)
+	if err != nil {
+		return err
+	}
+	existingUser.Lock()
+	defer existingUser.Unlock()
+	if _, ok := existingUser.store[url]; ok {
+		return ErrRatingExists
+	}
+	if existingUser.full(max) {
+		return ErrRatingLimit
+	}
+	existingUser.store[url] = newStoredRating(value)
+	return nil
+}
+
+func (m *memoryStorage) SaveRatings(email userEmail, ratings []ImageRating, max int) ([]error, error) {
+	existingUser, err := m.user(email)
+	if err != nil {
+		return nil, err
+	}
+	existingUser.Lock()
+	defer existingUser.Unlock()
+	results := make([]error, len(ratings))
+	for n, r := range ratings {
+		url := imageURL(r.ImageURL)
+		if _, ok := existingUser.store[url]; ok {
+			results[n] = ErrRatingExists
+			continue
+		}
+		if existingUser.full(max) {
+			results[n] = ErrRatingLimit
+			continue
+		}
+		existingUser.store[url] = newStoredRating(rating(r.Rating))
+	}
+	return results, nil
+}
+
+func (m *memoryStorage) UpdateRating(email userEmail, url imageURL, value rating) error {
+	existingUser, err := m.user(email)
+	if err != nil {
+		return err
+	}
+	existingUser.Lock()
+	defer existingUser.Unlock()
+	existing, ok := existingUser.store[url]
+	if !ok {
+		return ErrRatingNotFound
+	}
+	existingUser.store[url] = existing.updated(value)
+	return nil
+}
+
+func (m *memoryStorage) UpsertRating(email userEmail, url imageURL, value rating, max int) (bool, error) {
+	existingUser, err := m.user(email)
+	if err != nil {
+		return false, err
+	}
+	existingUser.Lock()
+	defer existingUser.Unlock()
+	existing, exists := existingUser.store[url]
+	if exists {
+		existingUser.store[url] = existing.updated(value)
+	} else if existingUser.full(max) {
+		return false, ErrRatingLimit
+	} else {
+		existingUser.store[url] = newStoredRating(value)
+	}
+	return !exists, nil
+}
+
+func (m *memoryStorage) DeleteRating(email userEmail, url imageURL) error {
+	existingUser, err := m.user(email)
+	if err != nil {
+		return err
+	}
+	existingUser.Lock()
+	defer existingUser.Unlock()
+	if _, ok := existingUser.store[url]; !ok {
+		return ErrRatingNotFound
+	}
+	delete(existingUser.store, url)
+	return nil
+}
+
+func (m *memoryStorage) ClearRatings(email userEmail) error {
+	existingUser, err := m.user(email)
+	if err != nil {
+		return err
+	}
+	existingUser.Lock()
+	defer existingUser.Unlock()
+	existingUser.store = map[imageURL]storedRating{}
+	return nil
+}
+
+func (m *memoryStorage) DeleteImageRatings(url imageURL) (int, error) {
+	m.usersLock.Lock()
+	defer m.usersLock.Unlock()
+	deleted := 0
+	for _, existingUser := range m.users {
+		existingUser.Lock()
+		if _, ok := existingUser.store[url]; ok {
+			delete(existingUser.store, url)
+			deleted++
+		}
+		existingUser.Unlock()
+	}
+	return deleted, nil
+}
+
+func (m *memoryStorage) GetRatings(email userEmail) (map[imageURL]storedRating, error) {
+	existingUser, err := m.user(email)
+	if err != nil {
+		return nil, err
+	}
+	existingUser.Lock()
+	defer existingUser.Unlock()
+	ratings := make(map[imageURL]storedRating, len(existingUser.store))
+	for url, stored := range existingUser.store {
+		ratings[url] = stored
+	}
+	return ratings, nil
+}
+
+func (m *memoryStorage) AllRatings() (map[userEmail]map[imageURL]rating, error) {
+	m.usersLock.Lock()
+	defer m.usersLock.Unlock()
+	all := make(map[userEmail]map[imageURL]rating, len(m.users))
+	for email, existingUser := range m.users {
+		existingUser.Lock()
+		ratings := make(map[imageURL]rating, len(existingUser.store))
+		for url, stored := range existingUser.store {
+			ratings[url] = stored.Value
+		}
+		existingUser.Unlock()
+		all[email] = ratings
+	}
+	return all, nil
+}
+
+func (m *memoryStorage) SweepRatings(cutoff time.Time) (int, error) {
+	m.usersLock.Lock()
+	defer m.usersLock.Unlock()
+	swept := 0
+	for _, existingUser := range m.users {
+		existingUser.Lock()
+		for url, stored := range existingUser.store {
+			if stored.UpdatedAt.Before(cutoff) {
+				delete(existingUser.store, url)
+				swept++
+			}
+		}
+		existingUser.Unlock()
+	}
+	return swept, nil
+}
+
+// Close saves the maps to DATA_DIR, if set
+func (m *memoryStorage) Close() error {
+	return m.save()
+}
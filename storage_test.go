@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// run go test -race to have this catch unsynchronized access to a user's ratings
+func TestMemoryStorageConcurrentRatings(t *testing.T) {
+	t.Setenv(DATA_DIR_ENV_VAR, "")
+	m := newMemoryStorage()
+	email := userEmail("ada@example.com")
+	if err := m.CreateUser(email, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 50
+	var wg sync.WaitGroup
+	for n := 0; n < writers; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			url := imageURL(fmt.Sprintf("https://apod.nasa.gov/apod/image/%d.jpg", n))
+			if err := m.SaveRating(email, url, rating(n%5+1), 0); err != nil {
+				t.Errorf("saving rating %d: %v", n, err)
+			}
+			if _, err := m.UpsertRating(email, "https://apod.nasa.gov/apod/image/shared.jpg", rating(n%5+1), 0); err != nil {
+				t.Errorf("upserting rating %d: %v", n, err)
+			}
+			if _, err := m.GetRatings(email); err != nil {
+				t.Errorf("reading ratings: %v", err)
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	ratings, err := m.GetRatings(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ratings) != writers+1 {
+		t.Errorf("got %d ratings, want %d", len(ratings), writers+1)
+	}
+}
+
+// fakeStorage fails every user and rating write with err, leaving the rest of Storage unimplemented
+type fakeStorage struct {
+	Storage
+	err error
+}
+
+func (f fakeStorage) CreateUser(userEmail, int) error                   { return f.err }
+func (f fakeStorage) DeleteUser(userEmail) (int, error)                 { return 0, f.err }
+func (f fakeStorage) SaveRating(userEmail, imageURL, rating, int) error { return f.err }
+func (f fakeStorage) UpdateRating(userEmail, imageURL, rating) error    { return f.err }
+func (f fakeStorage) DeleteRating(userEmail, imageURL) error            { return f.err }
+func (f fakeStorage) GetRatings(userEmail) (map[imageURL]storedRating, error) {
+	return nil, f.err
+}
+
+func TestStorageErrorStatus(t *testing.T) {
+	t.Setenv(RATING_MIN_ENV_VAR, "")
+	t.Setenv(RATING_MAX_ENV_VAR, "")
+	body := `{"email": "ada@example.com", "imageURL": "https://apod.nasa.gov/apod/image/a.jpg", "rating": 3}`
+	for _, test := range []struct {
+		err    error
+		status int
+	}{
+		{ErrUserExists, http.StatusConflict},
+		{ErrUserNotFound, http.StatusNotFound},
+		{ErrRatingExists, http.StatusConflict},
+		{ErrRatingNotFound, http.StatusNotFound},
+		{ErrUserLimit, http.StatusInsufficientStorage},
+		{ErrRatingLimit, http.StatusInsufficientStorage},
+		{fmt.Errorf("wrapped: %w", ErrUserNotFound), http.StatusNotFound},
+		{errors.New("disk on fire"), http.StatusInternalServerError},
+	} {
+		u := &users{storage: fakeStorage{err: test.err}, scale: ratingRange()}
+		for _, req := range []struct {
+			method  string
+			handler http.HandlerFunc
+		}{
+			{POST, u.userHandlers},
+			{DELETE, u.userHandlers},
+			{GET, u.ratingHandlers},
+			{POST, u.ratingHandlers},
+			{PUT, u.ratingHandlers},
+			{DELETE, u.ratingHandlers},
+		} {
+			r := httptest.NewRequest(req.method, "/", strings.NewReader(body))
+			r.Header.Set(CONTENT_TYPE, APPLICATION_JSON)
+			w := httptest.NewRecorder()
+			req.handler(w, r)
+			if w.Code != test.status {
+				t.Errorf("%s with %v: got status %d, want %d", req.method, test.err, w.Code, test.status)
+			}
+			if test.status == http.StatusInternalServerError && strings.Contains(w.Body.String(), "disk on fire") {
+				t.Errorf("%s: an internal error leaked into the response %q", req.method, w.Body)
+			}
+		}
+	}
+}
+
+func TestFailedRatingReleasesUser(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, env []string) {
+		s := newTestServer(t, env...)
+		// a user left locked would hang every later request, fail it instead
+		s.Client().Timeout = 5 * time.Second
+		imageURL := stubImage("2024-01-01").Url
+		s.createUser(t, "ada@example.com")
+		s.saveRating(t, "ada@example.com", imageURL, 4)
+
+		unknown := stubImage("2024-01-02").Url
+		for _, c := range []struct {
+			method string
+			body   User
+			status int
+		}{
+			{POST, User{Email: "ada@example.com", ImageURL: imageURL, Rating: 2}, http.StatusConflict},
+			{PUT, User{Email: "ada@example.com", ImageURL: unknown, Rating: 2}, http.StatusNotFound},
+			{DELETE, User{Email: "ada@example.com", ImageURL: unknown}, http.StatusNotFound},
+		} {
+			expectStatus(t, s.request(t, c.method, "/rating", c.body), c.status)
+			if ratings := s.ratingsOf(t, "ada@example.com"); len(ratings) != 1 || ratings[0].Rating != 4 {
+				t.Errorf("after a failed %s: got ratings %+v, want the one rating of 4", c.method, ratings)
+			}
+		}
+		s.saveRating(t, "ada@example.com", unknown, 3)
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+	_ "time/tzdata"
+)
+
+const (
+	TIMEZONE_ENV_VAR = "APOD_TIMEZONE"
+	DEFAULT_TIMEZONE = "America/New_York"
+)
+
+// apodTimezone returns the timezone "today" is reckoned in, read from APOD_TIMEZONE, APOD publishes on US Eastern time by default
+// the timezone database is embedded, so names resolve even on hosts without one
+func apodTimezone() *time.Location {
+	name := os.Getenv(TIMEZONE_ENV_VAR)
+	if name == "" {
+		name = DEFAULT_TIMEZONE
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(fmt.Sprintf("environment variable %s must be a timezone name such as %s, got '%s'", TIMEZONE_ENV_VAR, DEFAULT_TIMEZONE, name))
+	}
+	return loc
+}
+
+// apodDate returns the APOD date of the instant now in loc, as YYYY-MM-DD
+func apodDate(now time.Time, loc *time.Location) string {
+	return now.In(loc).Format(DATE_LAYOUT)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAPODDate(t *testing.T) {
+	t.Setenv(TIMEZONE_ENV_VAR, "")
+	eastern := apodTimezone()
+	if eastern.String() != DEFAULT_TIMEZONE {
+		t.Fatalf("got timezone %s by default, want %s", eastern, DEFAULT_TIMEZONE)
+	}
+	t.Setenv(TIMEZONE_ENV_VAR, "Asia/Tokyo")
+	tokyo := apodTimezone()
+
+	for _, c := range []struct {
+		clock        string
+		eastern, utc string
+		tokyo        string
+	}{
+		// 03:30 UTC is still the evening before in New York, already midday in Tokyo
+		{"2024-03-10T03:30:00Z", "2024-03-09", "2024-03-10", "2024-03-10"},
+		{"2024-03-10T04:59:00Z", "2024-03-09", "2024-03-10", "2024-03-10"},
+		{"2024-03-10T05:00:00Z", "2024-03-10", "2024-03-10", "2024-03-10"},
+		// daylight saving time moves midnight in New York to 04:00 UTC
+		{"2024-07-04T04:00:00Z", "2024-07-04", "2024-07-04", "2024-07-04"},
+		{"2024-07-04T15:00:00Z", "2024-07-04", "2024-07-04", "2024-07-05"},
+	} {
+		clock, _ := time.Parse(time.RFC3339, c.clock)
+		for _, zone := range []struct {
+			loc  *time.Location
+			want string
+		}{{eastern, c.eastern}, {time.UTC, c.utc}, {tokyo, c.tokyo}} {
+			if got := apodDate(clock, zone.loc); got != zone.want {
+				t.Errorf("at %s in %s: got %s, want %s", c.clock, zone.loc, got, zone.want)
+			}
+		}
+	}
+
+	t.Setenv(TIMEZONE_ENV_VAR, "Mars/Olympus_Mons")
+	expectPanic(t, TIMEZONE_ENV_VAR+"=Mars/Olympus_Mons", func() { apodTimezone() })
+}
+
+func TestTodayInTimezone(t *testing.T) {
+	s := newTestServer(t, TIMEZONE_ENV_VAR+"=Pacific/Kiritimati", MODE_ENV_VAR+"="+MODE_TODAY)
+	zone, _ := time.LoadLocation("Pacific/Kiritimati")
+	want := apodDate(time.Now(), zone)
+	expectStatus(t, s.get(t, "/image"), http.StatusOK)
+	// checked twice in case the day rolled over in between
+	if got := s.nasa.lastQuery().Get(DATE_PARAM); got != want && got != apodDate(time.Now(), zone) {
+		t.Errorf("NASA was queried for %s, want today in Pacific/Kiritimati, %s", got, want)
+	}
+}
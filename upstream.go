@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ATTEMPTS_ENV_VAR = "NASA_MAX_ATTEMPTS"
+	DEFAULT_ATTEMPTS = 3
+	BASE_BACKOFF     = 200 * time.Millisecond
+	MAX_UPSTREAM     = 8 << 20
+	PROBE_ENV_VAR    = "UPSTREAM_PROBE_SECONDS"
+	DEFAULT_PROBE    = 10 * time.Minute
+	PROBE_TIMEOUT    = 5 * time.Second
+	DEADLINE_ENV_VAR = "NASA_DEADLINE_SECONDS"
+	DEFAULT_DEADLINE = 12 * time.Second
+
+	CONCURRENCY_ENV_VAR = "MAX_UPSTREAM_CONCURRENCY"
+	DEFAULT_CONCURRENCY = 4
+)
+
+// maxAttempts returns how many times an upstream fetch is tried, read from NASA_MAX_ATTEMPTS if set
+func maxAttempts() int {
+	attempts := os.Getenv(ATTEMPTS_ENV_VAR)
+	if attempts == "" {
+		return DEFAULT_ATTEMPTS
+	}
+	n, err := strconv.Atoi(attempts)
+	if err != nil || n <= 0 {
+		panic(fmt.Sprintf("environment variable %s must be a positive integer, got '%s'", ATTEMPTS_ENV_VAR, attempts))
+	}
+	return n
+}
+
+// upstreamConcurrency returns how many calls to NASA may run at once, read from MAX_UPSTREAM_CONCURRENCY if set
+func upstreamConcurrency() int {
+	concurrency := os.Getenv(CONCURRENCY_ENV_VAR)
+	if concurrency == "" {
+		return DEFAULT_CONCURRENCY
+	}
+	n, err := strconv.Atoi(concurrency)
+	if err != nil || n <= 0 {
+		panic(fmt.Sprintf("environment variable %s must be a positive integer, got '%s'", CONCURRENCY_ENV_VAR, concurrency))
+	}
+	return n
+}
+
+// probeInterval returns how long the outcome of probing NASA is reused for, read from UPSTREAM_PROBE_SECONDS
+func probeInterval() time.Duration {
+	return secondsEnv(PROBE_ENV_VAR, DEFAULT_PROBE)
+}
+
+// upstreamDeadline returns how long fetching from NASA may take overall, retries included, read from NASA_DEADLINE_SECONDS
+func upstreamDeadline() time.Duration {
+	return secondsEnv(DEADLINE_ENV_VAR, DEFAULT_DEADLINE)
+}
+
+// retryable reports whether an upstream response status is worth retrying
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// backoff returns the wait before the given retry (1 for the first), doubling each time with up to 100% jitter
+func backoff(retry int) time.Duration {
+	wait := BASE_BACKOFF << uint(retry-1)
+	return wait + time.Duration(rand.Int63n(int64(wait)))
+}
+
+// fetch GETs the upstream with query, retrying network errors and 429/5xx responses with exponential backoff
+// each attempt uses the next API key in turn, and a 429 moves straight on to another key, without backoff or using up an attempt
+// once attempts are exhausted the last 429/5xx response is returned for the caller to inspect
+// the request is bound to ctx, so it is aborted once ctx is done, and the caller must close the body of the returned response
+func (i *imageStore) fetch(ctx context.Context, query string) (*http.Response, error) {
+	var lastErr error
+	// retries counts the failed attempts since the last switch to another key, which the backoff grows with
+	switched, retries := 0, 0
+	for attempt := 1; attempt <= i.maxAttempts; attempt++ {
+		if retries > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("giving up after %d attempts: %w (last error: %v)", attempt-1, ctx.Err(), lastErr)
+			case <-time.After(backoff(retries)):
+			}
+		}
+
+		n, keyURL := i.keys.pick()
+		req, err := http.NewRequestWithContext(ctx, GET, keyURL+"&"+query, nil)
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		resp, err := i.client.Do(req)
+		appMetrics.observeUpstream(time.Since(start), err != nil || resp.StatusCode != http.StatusOK)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			retries++
+			continue
+		}
+		i.keys.observe(n, resp)
+		if resp.StatusCode == http.StatusTooManyRequests && switched < i.keys.len()-1 {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("upstream responded %s", resp.Status)
+			switched++
+			retries = 0
+			attempt--
+			continue
+		}
+		if retryable(resp.StatusCode) && attempt < i.maxAttempts {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("upstream responded %s", resp.Status)
+			retries++
+			continue
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w", i.maxAttempts, lastErr)
+}
+
+// upstreamError is a failure of NASA's APOD API that is passed on to the client with its own status
+type upstreamError struct {
+	status    int
+	message   string
+	remaining string
+}
+
+func (e *upstreamError) Error() string {
+	return e.message
+}
+
+// fetchImages fetches the images matching params from NASA's APOD API, along with their video thumbnails
+// the API returns a single JSON object when querying by date, and an array otherwise, both are returned as a slice
+// at most MAX_UPSTREAM_CONCURRENCY fetches run at once across all requests, the others wait for a free slot
+func (i *imageStore) fetchImages(ctx context.Context, params string) ([]Image, error) {
+	if i.keys == nil {
+		return nil, &upstreamError{status: http.StatusServiceUnavailable, message: "NASA API key not configured"}
+	}
+	select {
+	case i.slots <- struct{}{}:
+		defer func() { <-i.slots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	resp, err := i.fetch(ctx, params+"&"+THUMBS_PARAM)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, &upstreamError{
+			status:    http.StatusTooManyRequests,
+			message:   "NASA API rate limit reached",
+			remaining: resp.Header.Get(RATELIMIT_HEADER),
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &upstreamError{status: http.StatusBadGateway, message: fmt.Sprintf("NASA APOD responded %s", resp.Status)}
+	}
+	// an outage or maintenance page comes back as HTML, possibly even with a 200
+	if ct := resp.Header.Get(CONTENT_TYPE); !strings.Contains(ct, APPLICATION_JSON) {
+		return nil, &upstreamError{status: http.StatusBadGateway, message: fmt.Sprintf("NASA APOD responded with content-type '%s' instead of JSON", ct)}
+	}
+
+	// even 100 days of images stay well under MAX_UPSTREAM bytes, anything larger is cut off and fails to decode
+	var body json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MAX_UPSTREAM)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding upstream response: %v", err)
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		var image Image
+		if err := json.Unmarshal(body, &image); err != nil {
+			return nil, fmt.Errorf("decoding upstream image: %v", err)
+		}
+		return []Image{image}, nil
+	}
+
+	var images Images
+	if err := json.Unmarshal(body, &images); err != nil {
+		return nil, fmt.Errorf("decoding upstream images: %v", err)
+	}
+	if len(images) == 0 {
+		return nil, &upstreamError{status: http.StatusBadGateway, message: "NASA APOD returned no images"}
+	}
+	result := make([]Image, 0, len(images))
+	for _, image := range images {
+		result = append(result, Image(image))
+	}
+	return result, nil
+}
+
+// fetchShared is fetchImages for queries with a fixed answer, a date or a date range,
+// concurrent identical calls share a single upstream request, which isn't tied to any one caller's cancellation
+// (it is still bounded by NASA_DEADLINE_SECONDS), while each caller stops waiting once its own ctx is done
+func (i *imageStore) fetchShared(ctx context.Context, params string) ([]Image, error) {
+	ch := i.inflight.DoChan(params, func() (interface{}, error) {
+		shared, cancel := context.WithTimeout(context.WithoutCancel(ctx), i.deadline)
+		defer cancel()
+		return i.fetchImages(shared, params)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]Image), nil
+	}
+}
+
+// writeUpstreamError responds to a failed fetchImages, passing on upstream errors and hiding anything else behind a 502
+func writeUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) {
+		slog.WarnContext(r.Context(), "fetching NASA image", "status", upstreamErr.status, "error", err)
+		if upstreamErr.remaining != "" {
+			w.Header().Set(RATELIMIT_HEADER, upstreamErr.remaining)
+		}
+		writeError(w, upstreamErr.status, upstreamErr.message)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.WarnContext(r.Context(), "fetching NASA image timed out", "error", err)
+		writeError(w, http.StatusGatewayTimeout, "NASA APOD didn't respond in time")
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		// the client went away, aborting the upstream call, so nobody reads this response
+		slog.InfoContext(r.Context(), "fetching NASA image canceled by client", "error", err)
+	} else {
+		slog.ErrorContext(r.Context(), "fetching NASA image", "error", err)
+	}
+	writeError(w, http.StatusBadGateway, "failed to fetch image from NASA APOD")
+}
+
+// UpstreamHealth is the outcome of probing NASA's APOD API, reported by /health/upstream
+type UpstreamHealth struct {
+	Status    string    `json:"status"`
+	Reachable bool      `json:"reachable"`
+	KeyValid  bool      `json:"keyValid"`
+	CheckedAt time.Time `json:"checkedAt"`
+	Error     string    `json:"error,omitempty"`
+	// Keys is filled in at response time, since the quotas change with every call to NASA, not just probes
+	Keys []KeyQuota `json:"keys,omitempty"`
+}
+
+// probeUpstream makes a single request for today's image, without retries, to tell whether NASA is reachable and accepts the key
+// a 429 means the key is valid but out of quota, a 401 or 403 that it was rejected
+func (i *imageStore) probeUpstream(ctx context.Context) UpstreamHealth {
+	health := UpstreamHealth{Status: "unavailable", CheckedAt: time.Now().UTC()}
+	if i.keys == nil {
+		health.Error = "NASA API key not configured"
+		return health
+	}
+	n, keyURL := i.keys.pick()
+	req, err := http.NewRequestWithContext(ctx, GET, keyURL, nil)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	start := time.Now()
+	resp, err := i.client.Do(req)
+	appMetrics.observeUpstream(time.Since(start), err != nil || resp.StatusCode != http.StatusOK)
+	if err != nil {
+		health.Error = "NASA APOD unreachable"
+		if errors.Is(err, context.DeadlineExceeded) {
+			health.Error = "NASA APOD didn't respond in time"
+		}
+		slog.WarnContext(ctx, "probing NASA APOD", "error", err)
+		return health
+	}
+	resp.Body.Close()
+	i.keys.observe(n, resp)
+
+	health.Reachable = true
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		health.Status, health.KeyValid = "ok", true
+	case resp.StatusCode == http.StatusTooManyRequests:
+		health.KeyValid = true
+		health.Error = "NASA API rate limit reached"
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		health.Error = "NASA API key rejected"
+	default:
+		health.KeyValid = true
+		health.Error = fmt.Sprintf("NASA APOD responded %s", resp.Status)
+	}
+	return health
+}
+
+// refreshProbe probes NASA, bounded by PROBE_TIMEOUT, and records the outcome, closing done once it's recorded
+// it runs on its own, so the outcome doesn't depend on the request that started it going away
+func (i *imageStore) refreshProbe(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), PROBE_TIMEOUT)
+	defer cancel()
+	health := i.probeUpstream(ctx)
+
+	i.probeLock.Lock()
+	i.probe, i.probing = &health, nil
+	i.probeLock.Unlock()
+	close(done)
+}
+
+// upstreamHealth is responsible for requests sent to the /health/upstream endpoint
+// it reports whether NASA's APOD API is reachable and accepts the key, responding 503 if not
+// NASA is probed at most once every UPSTREAM_PROBE_SECONDS to spare the API quota, in the background,
+// the last outcome being returned meanwhile, only the very first callers wait for a probe to finish
+func (i *imageStore) upstreamHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != GET {
+		methodNotAllowed(w, GET)
+		return
+	}
+
+	i.probeLock.Lock()
+	if i.probing == nil && (i.probe == nil || time.Since(i.probe.CheckedAt) >= i.probeEvery) {
+		i.probing = make(chan struct{})
+		go i.refreshProbe(i.probing)
+	}
+	last, probing := i.probe, i.probing
+	i.probeLock.Unlock()
+	if last == nil {
+		<-probing
+		i.probeLock.Lock()
+		last = i.probe
+		i.probeLock.Unlock()
+	}
+	health := *last
+	if i.keys != nil {
+		health.Keys = i.keys.quotas()
+	}
+
+	status := http.StatusOK
+	if health.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowNASA answers only once the request is abandoned, or after wait
+func slowNASA(wait time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(wait):
+			apodImages(w, r)
+		}
+	}
+}
+
+func TestUpstreamClientTimeout(t *testing.T) {
+	s := newTestServer(t, TIMEOUT_ENV_VAR+"=7")
+	if s.images.client.Timeout != 7*time.Second {
+		t.Fatalf("got client timeout %v, want the 7s from %s", s.images.client.Timeout, TIMEOUT_ENV_VAR)
+	}
+
+	s.images.client.Timeout = 50 * time.Millisecond
+	s.images.maxAttempts = 1
+	s.nasa.handle(slowNASA(10 * time.Second))
+	start := time.Now()
+	resp := s.get(t, "/image?"+DATE_PARAM+"=2024-01-01")
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("request took %v, the client timeout didn't cut it short", elapsed)
+	}
+	expectStatus(t, resp, http.StatusGatewayTimeout)
+}
+
+func TestUpstreamCanceledWithClient(t *testing.T) {
+	s := newTestServer(t)
+	started, aborted := make(chan struct{}), make(chan struct{})
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	// a random image, calls for a date being shared among callers and outliving any one of them
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, GET, s.URL+"/image?"+COUNT_PARAM+"=1", nil)
+	failed := make(chan error)
+	go func() {
+		_, err := s.Client().Do(req)
+		failed <- err
+	}()
+	<-started
+	cancel()
+	if err := <-failed; !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want the request canceled", err)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(2 * time.Second):
+		t.Errorf("the call to NASA kept running after the client went away")
+	}
+	if calls := s.nasa.calls.Load(); calls != 1 {
+		t.Errorf("got %d upstream calls, want the canceled one not retried", calls)
+	}
+}
+
+func TestUpstreamBaseURL(t *testing.T) {
+	nasa := newStubNASA(t)
+	paths := make(chan string, 1)
+	nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		apodImages(w, r)
+	})
+	s := newTestServer(t, BASE_URL_ENV_VAR+"="+nasa.URL+"/mirror/apod?region=eu")
+
+	s.fetchImage(t, "2024-01-01")
+	if path := <-paths; path != "/mirror/apod" {
+		t.Errorf("NASA_API_BASE_URL path not used, got %q", path)
+	}
+	query := nasa.lastQuery()
+	if query.Get("region") != "eu" || query.Get(API_KEY_PARAM) != TEST_API_KEY || query.Get(DATE_PARAM) != "2024-01-01" {
+		t.Errorf("got query %v, want the base URL's own params along with the key and date", query)
+	}
+
+	t.Setenv(BASE_URL_ENV_VAR, "")
+	if i := newImageStore(s.storage); i.baseURL != BASE_URL {
+		t.Errorf("got base URL %q by default, want %q", i.baseURL, BASE_URL)
+	}
+	for _, base := range []string{"api.nasa.gov/planetary/apod", "/planetary/apod", "://nowhere"} {
+		t.Setenv(BASE_URL_ENV_VAR, base)
+		expectPanic(t, BASE_URL_ENV_VAR+"="+base, func() { newImageStore(s.storage) })
+	}
+}
+
+func TestDemoKeyFallback(t *testing.T) {
+	s := newTestServer(t, API_KEY_ENV_VAR+"=", DEMO_KEY_ENV_VAR+"=true")
+	if want := s.nasa.URL + "/planetary/apod?" + API_KEY_PARAM + "=" + DEMO_KEY; s.images.keys.urls[0] != want || s.images.keys.len() != 1 {
+		t.Errorf("got upstream URLs %v, want only %s", s.images.keys.urls, want)
+	}
+	s.fetchImage(t, "2024-01-01")
+	if key := s.nasa.lastQuery().Get(API_KEY_PARAM); key != DEMO_KEY {
+		t.Errorf("NASA was called with key %q, want %s", key, DEMO_KEY)
+	}
+
+	// a key of one's own wins over the demo key
+	t.Setenv(API_KEY_ENV_VAR, TEST_API_KEY)
+	if i := newImageStore(s.storage); i.keys.keys[0] != TEST_API_KEY {
+		t.Errorf("got keys %v, want %s alone", i.keys.keys, TEST_API_KEY)
+	}
+	t.Setenv(DEMO_KEY_ENV_VAR, "please")
+	expectPanic(t, DEMO_KEY_ENV_VAR+"=please", func() { allowDemoKey() })
+}
+
+// flakyNASA fails the first failures calls with status, then answers like NASA
+func flakyNASA(failures int64, status int) http.HandlerFunc {
+	var calls atomic.Int64
+	return func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		apodImages(w, r)
+	}
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	s := newTestServer(t)
+	if s.images.maxAttempts != DEFAULT_ATTEMPTS {
+		t.Fatalf("got %d attempts by default, want %d", s.images.maxAttempts, DEFAULT_ATTEMPTS)
+	}
+
+	s.nasa.handle(flakyNASA(2, http.StatusServiceUnavailable))
+	start := time.Now()
+	s.fetchImage(t, "2024-01-01")
+	if calls := s.nasa.calls.Load(); calls != 3 {
+		t.Errorf("NASA was called %d times, want 3", calls)
+	}
+	if elapsed := time.Since(start); elapsed < BASE_BACKOFF+2*BASE_BACKOFF {
+		t.Errorf("retries took %v, want backoff between them", elapsed)
+	}
+
+	// a 429 is retried too, a network error as well
+	s.nasa.calls.Store(0)
+	s.nasa.handle(flakyNASA(1, http.StatusTooManyRequests))
+	s.fetchImage(t, "2024-01-02")
+	s.nasa.calls.Store(0)
+	s.images.client = &http.Client{Transport: failingTransport{}}
+	expectStatus(t, s.get(t, "/image?"+DATE_PARAM+"=2024-01-03"), http.StatusBadGateway)
+	s.images.client = &http.Client{}
+
+	// other errors aren't worth retrying
+	s.nasa.calls.Store(0)
+	s.nasa.handle(flakyNASA(10, http.StatusBadRequest))
+	expectStatus(t, s.get(t, "/image?"+DATE_PARAM+"=2024-01-04"), http.StatusBadGateway)
+	if calls := s.nasa.calls.Load(); calls != 1 {
+		t.Errorf("a 400 was tried %d times, want 1", calls)
+	}
+
+	// once attempts run out the client gets a 502
+	s.nasa.calls.Store(0)
+	s.nasa.handle(flakyNASA(10, http.StatusInternalServerError))
+	expectStatus(t, s.get(t, "/image?"+DATE_PARAM+"=2024-01-05"), http.StatusBadGateway)
+	if calls := s.nasa.calls.Load(); calls != DEFAULT_ATTEMPTS {
+		t.Errorf("NASA was called %d times, want %d", calls, DEFAULT_ATTEMPTS)
+	}
+}
+
+func TestUpstreamRetriesHonorDeadline(t *testing.T) {
+	s := newTestServer(t, ATTEMPTS_ENV_VAR+"=10", DEADLINE_ENV_VAR+"=1")
+	s.nasa.handle(flakyNASA(100, http.StatusServiceUnavailable))
+	start := time.Now()
+	expectStatus(t, s.get(t, "/image?"+DATE_PARAM+"=2024-01-01"), http.StatusGatewayTimeout)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("retries went on for %v, past the 1s deadline", elapsed)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for retry := 1; retry <= 4; retry++ {
+		base := BASE_BACKOFF << uint(retry-1)
+		for n := 0; n < 20; n++ {
+			if wait := backoff(retry); wait < base || wait >= 2*base {
+				t.Fatalf("backoff(%d) = %v, want within [%v, %v)", retry, wait, base, 2*base)
+			}
+		}
+	}
+}
+
+func TestUpstreamRateLimit(t *testing.T) {
+	s := newTestServer(t, ATTEMPTS_ENV_VAR+"=1")
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+		w.Header().Set(RATELIMIT_HEADER, "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error": {"code": "OVER_RATE_LIMIT", "message": "You have exceeded your rate limit."}}`))
+	})
+
+	for _, path := range []string{"/image?" + DATE_PARAM + "=2024-01-01", "/image?" + COUNT_PARAM + "=2"} {
+		resp := s.get(t, path)
+		expectStatus(t, resp, http.StatusTooManyRequests)
+		var body errorResponse
+		resp.decode(t, &body)
+		if body.Error.Message != "NASA API rate limit reached" {
+			t.Errorf("%s: got message %q", path, body.Error.Message)
+		}
+		if remaining := resp.Header.Get(RATELIMIT_HEADER); remaining != "0" {
+			t.Errorf("%s: got %s %q, want NASA's passed on", path, RATELIMIT_HEADER, remaining)
+		}
+	}
+}
+
+func TestUpstreamEmptyArray(t *testing.T) {
+	s := newTestServer(t)
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(CONTENT_TYPE, APPLICATION_JSON)
+		w.Write([]byte(`[]`))
+	})
+
+	for _, path := range []string{"/image?" + COUNT_PARAM + "=3", "/image?" + DATE_PARAM + "=2024-01-01", "/image"} {
+		resp := s.get(t, path)
+		expectStatus(t, resp, http.StatusBadGateway)
+		var body errorResponse
+		resp.decode(t, &body)
+		if body.Error.Message != "NASA APOD returned no images" {
+			t.Errorf("%s: got message %q", path, body.Error.Message)
+		}
+	}
+	// the server survived
+	expectStatus(t, s.get(t, "/health"), http.StatusOK)
+}
+
+func TestUpstreamNotJSON(t *testing.T) {
+	s := newTestServer(t, ATTEMPTS_ENV_VAR+"=1")
+	for _, c := range []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		message     string
+	}{
+		{"200 HTML", http.StatusOK, "text/html", "<html>Down for maintenance</html>", "NASA APOD responded with content-type 'text/html' instead of JSON"},
+		{"500", http.StatusInternalServerError, APPLICATION_JSON, `{"error": "oops"}`, "NASA APOD responded 500 Internal Server Error"},
+		{"truncated JSON", http.StatusOK, APPLICATION_JSON, `{"date": "2024-`, "failed to fetch image from NASA APOD"},
+	} {
+		s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(CONTENT_TYPE, c.contentType)
+			w.WriteHeader(c.status)
+			io.WriteString(w, c.body)
+		})
+		resp := s.get(t, "/image?"+DATE_PARAM+"=2024-01-01")
+		expectStatus(t, resp, http.StatusBadGateway)
+		var body errorResponse
+		resp.decode(t, &body)
+		if body.Error.Code != "bad_gateway" || body.Error.Message != c.message {
+			t.Errorf("%s: got error %+v, want %q", c.name, body.Error, c.message)
+		}
+	}
+}
+
+// run go test -race to have this catch unsynchronized access to the cache and the shared fetch
+func TestConcurrentFetchesShared(t *testing.T) {
+	s := newTestServer(t, DAILY_CACHE_ENV_VAR+"=true")
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { close(started) })
+		<-release
+		apodImages(w, r)
+	})
+
+	const clients = 20
+	statuses := make(chan int, clients)
+	for n := 0; n < clients; n++ {
+		go func() {
+			resp, err := s.Client().Get(s.URL + "/image?" + DATE_PARAM + "=2024-01-01")
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	<-started
+	// give every client time to join the fetch in flight, before it answers
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	for n := 0; n < clients; n++ {
+		if status := <-statuses; status != http.StatusOK {
+			t.Errorf("got status %d, want 200", status)
+		}
+	}
+	if calls := s.nasa.calls.Load(); calls != 1 {
+		t.Errorf("got %d upstream calls for %d concurrent requests, want 1", calls, clients)
+	}
+}
+
+func TestUpstreamConcurrencyLimit(t *testing.T) {
+	s := newTestServer(t, CONCURRENCY_ENV_VAR+"=2")
+	var inFlight, most atomic.Int64
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		now := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			seen := most.Load()
+			if now <= seen || most.CompareAndSwap(seen, now) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		apodImages(w, r)
+	})
+
+	// more dates than the limit, fetched by more workers than the limit
+	resp := s.get(t, "/image?"+DATES_PARAM+"=2023-01-01,2023-01-02,2023-01-03,2023-01-04,2023-01-05,2023-01-06")
+	expectStatus(t, resp, http.StatusOK)
+	var result DatesResult
+	resp.decode(t, &result)
+	if len(result.Images) != 6 {
+		t.Errorf("got %d images, want 6", len(result.Images))
+	}
+	if got := most.Load(); got != 2 {
+		t.Errorf("got at most %d upstream calls at once, want 2", got)
+	}
+
+	t.Setenv(CONCURRENCY_ENV_VAR, "0")
+	expectPanic(t, CONCURRENCY_ENV_VAR+"=0", func() { upstreamConcurrency() })
+}
+
+// upstreamHealth reads /health/upstream, failing the test unless it responds with status
+func (s *testServer) upstreamHealth(t *testing.T, status int) UpstreamHealth {
+	t.Helper()
+	resp := s.get(t, "/health/upstream")
+	expectStatus(t, resp, status)
+	var health UpstreamHealth
+	resp.decode(t, &health)
+	return health
+}
+
+func TestUpstreamHealth(t *testing.T) {
+	s := newTestServer(t)
+	health := s.upstreamHealth(t, http.StatusOK)
+	if health.Status != "ok" || !health.Reachable || !health.KeyValid || len(health.Keys) != 1 {
+		t.Errorf("got %+v, want NASA reachable with a valid key", health)
+	}
+	// probes are spaced out to spare the quota
+	s.upstreamHealth(t, http.StatusOK)
+	if calls := s.nasa.calls.Load(); calls != 1 {
+		t.Errorf("got %d probes, want 1 within %s", calls, PROBE_ENV_VAR)
+	}
+
+	for name, c := range map[string]struct {
+		handler   http.HandlerFunc
+		transport http.RoundTripper
+		reachable bool
+		message   string
+	}{
+		"key rejected": {handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusForbidden) }, reachable: true, message: "NASA API key rejected"},
+		"down":         {transport: failingTransport{}, message: "NASA APOD unreachable"},
+	} {
+		s := newTestServer(t)
+		if c.handler != nil {
+			s.nasa.handle(c.handler)
+		}
+		if c.transport != nil {
+			s.images.client = &http.Client{Transport: c.transport}
+		}
+		health := s.upstreamHealth(t, http.StatusServiceUnavailable)
+		if health.Status != "unavailable" || health.Reachable != c.reachable || health.KeyValid || health.Error != c.message {
+			t.Errorf("%s: got %+v, want %q", name, health, c.message)
+		}
+	}
+}
+
+func TestUpstreamHealthRefresh(t *testing.T) {
+	s := newTestServer(t)
+	s.images.probeEvery = 50 * time.Millisecond
+	first := s.upstreamHealth(t, http.StatusOK)
+
+	release := make(chan struct{})
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	time.Sleep(60 * time.Millisecond)
+	// the stale result is served while NASA is probed again in the background
+	start := time.Now()
+	if stale := s.upstreamHealth(t, http.StatusOK); !stale.CheckedAt.Equal(first.CheckedAt) || time.Since(start) > time.Second {
+		t.Errorf("got %+v after %v, want the last result right away", stale, time.Since(start))
+	}
+	close(release)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.get(t, "/health/upstream").StatusCode != http.StatusServiceUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatalf("the background probe never reported NASA down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Setenv(PROBE_ENV_VAR, "0")
+	expectPanic(t, PROBE_ENV_VAR+"=0", func() { probeInterval() })
+}
+
+func TestUpstreamDeadline(t *testing.T) {
+	s := newTestServer(t, DEADLINE_ENV_VAR+"=1", TIMEOUT_ENV_VAR+"=10")
+	s.nasa.handle(slowNASA(5 * time.Second))
+	start := time.Now()
+	resp := s.get(t, "/image?"+COUNT_PARAM+"=1")
+	expectStatus(t, resp, http.StatusGatewayTimeout)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("got the 504 after %v, want it at the 1s deadline", elapsed)
+	}
+	if code := resp.errorCode(t); code != "gateway_timeout" {
+		t.Errorf("got error code %q, want gateway_timeout", code)
+	}
+}
+
+func TestUpstreamCanceledSilently(t *testing.T) {
+	s := newTestServer(t)
+	logs := captureLogs(t)
+	started := make(chan struct{})
+	s.nasa.handle(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		slowNASA(5*time.Second)(w, r)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, GET, s.URL+"/image?"+COUNT_PARAM+"=1", nil)
+	go func() {
+		<-started
+		cancel()
+	}()
+	if _, err := s.Client().Do(req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want the request canceled", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(logs.withMessage(t, "fetching NASA image canceled by client")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the canceled fetch was never logged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if records := logs.withMessage(t, "fetching NASA image canceled by client"); records[0][slog.LevelKey] != "INFO" {
+		t.Errorf("got %v, want the cancellation logged at info", records[0])
+	}
+	if records := logs.withMessage(t, "fetching NASA image"); len(records) != 0 {
+		t.Errorf("got %v, want no error logged for a client going away", records)
+	}
+}
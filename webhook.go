@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	WEBHOOK_ENV_VAR = "IMAGE_WEBHOOK_URL"
+	WEBHOOK_TIMEOUT = 10 * time.Second
+)
+
+// webhook posts every image newly fetched from NASA to a URL, e.g. a chat bot announcing it
+type webhook struct {
+	url    string
+	client *http.Client
+	wg     sync.WaitGroup
+}
+
+// newWebhook instantiates webhook for the URL read from IMAGE_WEBHOOK_URL, and returns a pointer to it
+// it returns nil when the variable is unset, a nil webhook notifies nobody
+func newWebhook() *webhook {
+	raw := os.Getenv(WEBHOOK_ENV_VAR)
+	if raw == "" {
+		return nil
+	}
+	if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		panic(fmt.Sprintf("environment variable %s must be an absolute http(s) URL, got '%s'", WEBHOOK_ENV_VAR, raw))
+	}
+	return &webhook{url: raw, client: &http.Client{Timeout: WEBHOOK_TIMEOUT}}
+}
+
+// notify posts image as JSON to the webhook in the background, failures are only logged
+func (h *webhook) notify(image Image) {
+	if h == nil {
+		return
+	}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		if err := h.post(image); err != nil {
+			slog.Error("notifying webhook", "image_url", image.Url, "error", err)
+		}
+	}()
+}
+
+// post sends image to the webhook, which must answer with a 2xx status
+func (h *webhook) post(image Image) error {
+	body, err := json.Marshal(image)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), WEBHOOK_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, POST, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(CONTENT_TYPE, APPLICATION_JSON)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// wait blocks until every notification in flight is done, so none is cut off on shutdown
+func (h *webhook) wait() {
+	if h == nil {
+		return
+	}
+	h.wg.Wait()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	received := make(chan Image, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var image Image
+		if r.Method != POST || r.Header.Get(CONTENT_TYPE) != APPLICATION_JSON {
+			t.Errorf("webhook got %s with content-type %q, want a JSON POST", r.Method, r.Header.Get(CONTENT_TYPE))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&image); err != nil {
+			t.Errorf("decoding webhook body: %v", err)
+		}
+		received <- image
+	}))
+	t.Cleanup(receiver.Close)
+	s := newTestServer(t, WEBHOOK_ENV_VAR+"="+receiver.URL)
+
+	s.fetchImage(t, "2024-01-01")
+	select {
+	case image := <-received:
+		if !reflect.DeepEqual(image, stubImage("2024-01-01")) {
+			t.Errorf("webhook got %+v, want the fetched image", image)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook wasn't called for a newly fetched image")
+	}
+
+	// a stored image isn't new, fetching it again notifies nobody
+	s.fetchImage(t, "2024-01-01")
+	s.images.webhook.wait()
+	if len(received) != 0 {
+		t.Errorf("webhook got %d more calls for an image already stored, want none", len(received))
+	}
+}
+
+func TestWebhookUnset(t *testing.T) {
+	s := newTestServer(t)
+	if s.images.webhook != nil {
+		t.Fatalf("got webhook %+v without %s, want none", s.images.webhook, WEBHOOK_ENV_VAR)
+	}
+	s.fetchImage(t, "2024-01-01")
+
+	t.Setenv(WEBHOOK_ENV_VAR, "hooks.example.com/apod")
+	expectPanic(t, WEBHOOK_ENV_VAR+" without a scheme", func() { newWebhook() })
+}